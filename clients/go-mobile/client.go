@@ -63,13 +63,31 @@ func buildRSAPublicKey(publicBytes []byte, exponent int) rsa.PublicKey {
 	same TPM that the endorsement key @ekn + @eke.
 */
 func MakeCredential(ekn []byte, eke int, encodedap []byte) (*CredentialBlob, error) {
+	return MakeCredentialForEK(EK_TYPE_RSA, ekn, eke, encodedap)
+}
+
+/*
+	MakeCredentialForEK is the same as MakeCredential, for
+	an endorsement key of type @ektype, as sent by the attester
+	on enrollment: an RSA key of modulus @ekpub and exponent
+	@eke, or an ECC key whose uncompressed point is @ekpub.
+	An empty @ektype stands for RSA.
+*/
+func MakeCredentialForEK(ektype string, ekpub []byte, eke int, encodedap []byte) (*CredentialBlob, error) {
 	var ap attest.AttestationParameters
 
 	err := cbor.Unmarshal(encodedap, &ap)
 	if err != nil {
 		return nil, err
 	}
-	ekPub := buildRSAPublicKey(ekn, eke)
+	switch ektype {
+	case EK_TYPE_RSA, "":
+	case EK_TYPE_ECC:
+		return makeECCCredential(ekpub, &ap)
+	default:
+		return nil, errors.New("Unsupported EK type: " + ektype)
+	}
+	ekPub := buildRSAPublicKey(ekpub, eke)
 	activationParams := attest.ActivationParameters{
 		TPMVersion: attest.TPMVersion20,
 		EK:         &ekPub,
@@ -89,7 +107,8 @@ func MakeCredential(ekn []byte, eke int, encodedap []byte) (*CredentialBlob, err
 	nonce.
 
 	It also asserts that the final PCRs values from the attestation
-	data matches the quotes ones.
+	data matches the quotes ones. Quotes can be over the SHA1,
+	SHA256 or SHA384 banks.
 */
 func CheckQuotesSignature(encodedap, encodedpp, nonce []byte) error {
 	var ap attest.AttestationParameters
@@ -108,18 +127,15 @@ func CheckQuotesSignature(encodedap, encodedpp, nonce []byte) error {
 	if err != nil {
 		return err
 	}
-	for _, quote := range pp.Quotes {
-		if err := akpub.Verify(quote, pp.PCRs, nonce); err != nil {
-			return err
-		}
-	}
-	return nil
+	return verifyQuotes(akpub, pp.Quotes, pp.PCRs, nonce)
 }
 
 /*
 	ReplayEventLog verifies that the eventlog from @encodedpp
 	matches the final PCRs values (that were previously checked
 	against the quotes ones).
+	go-attestation only replays the SHA1 and SHA256 banks: the
+	other PCRs are ignored, and it fails if there are none.
 */
 func ReplayEventLog(encodedpp []byte) error {
 	var pp attest.PlatformParameters
@@ -131,7 +147,11 @@ func ReplayEventLog(encodedpp []byte) error {
 	if err != nil {
 		return err
 	}
-	_, err = el.Verify(pp.PCRs)
+	pcrs := replayablePCRs(pp.PCRs)
+	if len(pcrs) == 0 {
+		return errors.New("The event log can only be replayed against SHA1 or SHA256 PCRs")
+	}
+	_, err = el.Verify(pcrs)
 	if rErr, isReplayErr := err.(attest.ReplayError); isReplayErr {
 		return errors.New(rErr.Error())
 	}
@@ -0,0 +1,258 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file generates credential activation challenges for
+	ECC NIST P-256 endorsement keys, which go-attestation doesn't
+	support. The challenge follows the TPM 2.0 specification part 1,
+	section 24 and annex C.6.4.
+*/
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const (
+	EK_TYPE_RSA = "RSA"
+	EK_TYPE_ECC = "ECC"
+)
+
+const (
+	// Size of the secret, as generated by go-attestation
+	activationSecretLen = 32
+	// Size of the AES key protecting the credential, as the EK symmetric key
+	symBlockSize = 16
+	// TPM_GENERATED_VALUE
+	tpmGeneratedMagic = 0xff544347
+	// Name algorithm of the TCG ECC NIST P-256 EK templates
+	eccEKNameAlg = tpm2.AlgSHA256
+)
+
+/*
+	checkAKParameters asserts that the AK described by @ap has been
+	created by a TPM and is restricted to attestation, as
+	go-attestation does before generating a challenge.
+	It returns the name of the AK.
+*/
+func checkAKParameters(ap *attest.AttestationParameters) (*tpm2.HashValue, error) {
+	pub, err := tpm2.DecodePublic(ap.Public)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tpm2.DecodeCreationData(ap.CreateData); err != nil {
+		return nil, err
+	}
+	att, err := tpm2.DecodeAttestationData(ap.CreateAttestation)
+	if err != nil {
+		return nil, err
+	}
+	if att.Type != tpm2.TagAttestCreation || att.AttestedCreationInfo == nil {
+		return nil, errors.New("The AK attestation doesn't apply to creation data")
+	}
+	if att.Magic != tpmGeneratedMagic {
+		return nil, errors.New("The AK creation attestation was not produced by a TPM")
+	}
+	if pub.Type != tpm2.AlgRSA || pub.RSAParameters == nil || pub.RSAParameters.KeyBits < 2048 {
+		return nil, errors.New("The AK must be an RSA key of at least 2048 bits")
+	}
+	var required = tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagRestricted
+	if pub.Attributes & required != required {
+		return nil, errors.New("The AK is not limited to attestation")
+	}
+
+	nameHash, err := pub.NameAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	h := nameHash.New()
+	h.Write(ap.CreateData)
+	if !bytes.Equal(att.AttestedCreationInfo.OpaqueDigest, h.Sum(nil)) {
+		return nil, errors.New("The AK attestation refers to different creation data")
+	}
+	match, err := att.AttestedCreationInfo.Name.MatchesPublic(pub)
+	if err != nil {
+		return nil, err
+	}
+	if !match || att.AttestedCreationInfo.Name.Digest == nil {
+		return nil, errors.New("The AK attestation refers to a different key")
+	}
+
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(ap.CreateSignature))
+	if err != nil {
+		return nil, err
+	}
+	if sig.RSA == nil {
+		return nil, errors.New("The AK attestation isn't signed with RSA")
+	}
+	signHash, err := pub.RSAParameters.Sign.Hash.Hash()
+	if err != nil {
+		return nil, err
+	}
+	h = signHash.New()
+	h.Write(ap.CreateAttestation)
+	pk := rsa.PublicKey{E: int(pub.RSAParameters.Exponent()), N: pub.RSAParameters.Modulus()}
+	if err = rsa.VerifyPKCS1v15(&pk, signHash, h.Sum(nil), sig.RSA.Signature); err != nil {
+		return nil, err
+	}
+	return att.AttestedCreationInfo.Name.Digest, nil
+}
+
+/*
+	createECCSeed derives the credential seed from a key exchange
+	between the ephemeral private key @eph and the EK @x, @y, whose
+	name algorithm is @nameAlg, and returns it along with the
+	ephemeral public key the TPM will derive it from.
+*/
+func createECCSeed(nameAlg tpm2.Algorithm, x, y *big.Int, eph []byte) ([]byte, []byte, error) {
+	var curve = elliptic.P256()
+	var size = (curve.Params().BitSize + 7) / 8
+
+	hash, err := nameAlg.Hash()
+	if err != nil {
+		return nil, nil, err
+	}
+	ephX, ephY := curve.ScalarBaseMult(eph)
+	zX, _ := curve.ScalarMult(x, y, eph)
+
+	var z = zX.FillBytes(make([]byte, size))
+	var ephXBytes = ephX.FillBytes(make([]byte, size))
+	var ephYBytes = ephY.FillBytes(make([]byte, size))
+	var ekXBytes = x.FillBytes(make([]byte, size))
+	seed, err := tpm2.KDFe(nameAlg, z, "IDENTITY", ephXBytes, ekXBytes, hash.Size() * 8)
+	if err != nil {
+		return nil, nil, err
+	}
+	encSeed, err := tpmutil.Pack(tpmutil.U16Bytes(ephXBytes), tpmutil.U16Bytes(ephYBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	return seed, encSeed, nil
+}
+
+/*
+	generateECCCredential protects @secret so that only the TPM
+	holding both the EK @x, @y and the AK named @ak can recover it,
+	with the ephemeral private key @eph. The keys are derived with
+	@nameAlg, the name algorithm of the EK, whatever the one of the AK.
+	It returns the TPM2B_ID_OBJECT and TPM2B_ENCRYPTED_SECRET
+	to give to TPM2_ActivateCredential.
+*/
+func generateECCCredential(nameAlg tpm2.Algorithm, ak *tpm2.HashValue, x, y *big.Int, secret, eph []byte) ([]byte, []byte, error) {
+	hash, err := nameAlg.Hash()
+	if err != nil {
+		return nil, nil, err
+	}
+	seed, encSeed, err := createECCSeed(nameAlg, x, y, eph)
+	if err != nil {
+		return nil, nil, err
+	}
+	akName, err := ak.Encode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	symKey, err := tpm2.KDFa(nameAlg, seed, "STORAGE", akName, nil, symBlockSize * 8)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cv, err := tpmutil.Pack(tpmutil.U16Bytes(secret))
+	if err != nil {
+		return nil, nil, err
+	}
+	encIdentity := make([]byte, len(cv))
+	cipher.NewCFBEncrypter(c, make([]byte, aes.BlockSize)).XORKeyStream(encIdentity, cv)
+
+	macKey, err := tpm2.KDFa(nameAlg, seed, "INTEGRITY", nil, nil, hash.Size() * 8)
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmac.New(hash.New, macKey)
+	mac.Write(encIdentity)
+	mac.Write(akName)
+
+	id, err := tpmutil.Pack(&tpm2.IDObject{IntegrityHMAC: mac.Sum(nil), EncIdentity: encIdentity})
+	if err != nil {
+		return nil, nil, err
+	}
+	cred, err := tpmutil.Pack(tpmutil.U16Bytes(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	encSecret, err := tpmutil.Pack(tpmutil.U16Bytes(encSeed))
+	if err != nil {
+		return nil, nil, err
+	}
+	return cred, encSecret, nil
+}
+
+/*
+	makeECCCredential is the ECC counterpart of the go-attestation
+	ActivationParameters.Generate method, for the EK whose
+	uncompressed point is @ekpoint. Only the point is sent by the
+	attester, so the EK is assumed to follow the TCG templates.
+*/
+func makeECCCredential(ekpoint []byte, ap *attest.AttestationParameters) (*CredentialBlob, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), ekpoint)
+	if x == nil {
+		return nil, errors.New("Invalid ECC EK public key")
+	}
+	akName, err := checkAKParameters(ap)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid AK: %v", err)
+	}
+	secret := make([]byte, activationSecretLen)
+	if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	eph, _, _, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cred, encSecret, err := generateECCCredential(eccEKNameAlg, akName, x, y, secret, eph)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialBlob{secret, cred, encSecret}, nil
+}
+
+/*
+	IsCertifiedAK returns whether the AK @encodedap sent by the
+	attester is @certifiedap, the one whose credential has been
+	activated on a previous run. In that case, the verifier can send
+	an empty CredentialBlob to skip the credential activation.
+*/
+func IsCertifiedAK(encodedap, certifiedap []byte) (bool, error) {
+	var ap, certified attest.AttestationParameters
+
+	if len(certifiedap) == 0 {
+		return false, nil
+	}
+	if err := cbor.Unmarshal(encodedap, &ap); err != nil {
+		return false, err
+	}
+	if err := cbor.Unmarshal(certifiedap, &certified); err != nil {
+		return false, err
+	}
+	return len(ap.Public) > 0 && bytes.Equal(ap.Public, certified.Public), nil
+}
@@ -0,0 +1,309 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+/*
+	activateECCCredential plays the TPM side of TPM2_ActivateCredential
+	for the software P-256 EK @ek, whose name algorithm is SHA256, and
+	the AK named @ak: it recovers the secret protected by @cred and
+	@encSecret, after checking their integrity.
+*/
+func activateECCCredential(ek *ecdsa.PrivateKey, ak *tpm2.HashValue, cred, encSecret []byte) ([]byte, error) {
+	var size = (ek.Curve.Params().BitSize + 7) / 8
+	var encSeed, ephX, ephY, id, integrity tpmutil.U16Bytes
+
+	if _, err := tpmutil.Unpack(encSecret, &encSeed); err != nil {
+		return nil, err
+	}
+	if _, err := tpmutil.Unpack(encSeed, &ephX, &ephY); err != nil {
+		return nil, err
+	}
+	x, y := new(big.Int).SetBytes(ephX), new(big.Int).SetBytes(ephY)
+	if !ek.Curve.IsOnCurve(x, y) {
+		return nil, errors.New("The ephemeral key isn't on the EK curve")
+	}
+	zX, _ := ek.Curve.ScalarMult(x, y, ek.D.Bytes())
+	seed, err := tpm2.KDFe(tpm2.AlgSHA256, zX.FillBytes(make([]byte, size)), "IDENTITY", ephX, ek.X.FillBytes(make([]byte, size)), sha256.Size * 8)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = tpmutil.Unpack(cred, &id); err != nil {
+		return nil, err
+	}
+	if _, err = tpmutil.Unpack(id, &integrity); err != nil {
+		return nil, err
+	}
+	var encIdentity = id[2 + len(integrity):]
+	akName, err := ak.Encode()
+	if err != nil {
+		return nil, err
+	}
+	macKey, err := tpm2.KDFa(tpm2.AlgSHA256, seed, "INTEGRITY", nil, nil, sha256.Size * 8)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(encIdentity)
+	mac.Write(akName)
+	if !hmac.Equal(mac.Sum(nil), integrity) {
+		return nil, errors.New("The credential integrity check failed")
+	}
+
+	symKey, err := tpm2.KDFa(tpm2.AlgSHA256, seed, "STORAGE", akName, nil, symBlockSize * 8)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(symKey)
+	if err != nil {
+		return nil, err
+	}
+	cv := make([]byte, len(encIdentity))
+	cipher.NewCFBDecrypter(c, make([]byte, aes.BlockSize)).XORKeyStream(cv, encIdentity)
+	var secret tpmutil.U16Bytes
+	if _, err = tpmutil.Unpack(cv, &secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+/*
+	akParameters returns the attestation parameters of an AK
+	whose key is @key, created by a TPM with the attributes
+	@attrs and certified by @signer.
+*/
+func akParameters(t *testing.T, key, signer *rsa.PrivateKey, attrs tpm2.KeyProp) *attest.AttestationParameters {
+	pub := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: attrs,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:       &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits:    2048,
+			ModulusRaw: key.N.Bytes(),
+		},
+	}
+	public, err := pub.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := pub.Name()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owner = tpm2.HandleOwner
+	createData, err := (&tpm2.CreationData{
+		PCRSelection:        tpm2.PCRSelection{Hash: tpm2.AlgSHA256},
+		ParentNameAlg:       tpm2.AlgSHA256,
+		ParentName:          tpm2.Name{Handle: &owner},
+		ParentQualifiedName: tpm2.Name{Handle: &owner},
+	}).EncodeCreationData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	createDigest := sha256.Sum256(createData)
+	createAttestation, err := tpm2.AttestationData{
+		Magic:                tpmGeneratedMagic,
+		Type:                 tpm2.TagAttestCreation,
+		QualifiedSigner:      tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: make([]byte, sha256.Size)}},
+		AttestedCreationInfo: &tpm2.CreationInfo{Name: name, OpaqueDigest: createDigest[:]},
+	}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &attest.AttestationParameters{
+		Public:            public,
+		CreateData:        createData,
+		CreateAttestation: createAttestation,
+		CreateSignature:   tpmSignAK(t, signer, createAttestation),
+	}
+}
+
+func TestCheckAKParameters(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrs = tpm2.FlagSignerDefault | tpm2.FlagNoDA
+	var foreign = akParameters(t, key, key, attrs)
+	foreign.Public = akParameters(t, other, key, attrs).Public
+	var alteredData = akParameters(t, key, key, attrs)
+	alteredData.CreateData[len(alteredData.CreateData) - 1] ^= 1
+
+	var cases = []struct {
+		ap    *attest.AttestationParameters
+		valid bool
+		name  string
+	}{
+		{akParameters(t, key, key, attrs), true, "Restricted signing key"},
+		{akParameters(t, key, key, attrs &^ tpm2.FlagRestricted), false, "Unrestricted key"},
+		{akParameters(t, key, key, attrs &^ tpm2.FlagFixedTPM), false, "Key that can leave the TPM"},
+		{akParameters(t, key, other, attrs), false, "Attestation signed by another key"},
+		{foreign, false, "Attestation of another key"},
+		{alteredData, false, "Altered creation data"},
+		{&attest.AttestationParameters{Public: foreign.Public}, false, "Missing attestation"},
+	}
+
+	for _, c := range cases {
+		name, err := checkAKParameters(c.ap)
+		if (err == nil) != c.valid {
+			t.Errorf("[%s]: expected valid: %t, got error: %v", c.name, c.valid, err)
+			continue
+		}
+		if c.valid && (name.Alg != tpm2.AlgSHA256 || len(name.Value) != sha256.Size) {
+			t.Errorf("[%s]: unexpected AK name %+v", c.name, name)
+		}
+	}
+}
+
+func TestMakeECCCredential(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap := akParameters(t, key, key, tpm2.FlagSignerDefault | tpm2.FlagNoDA)
+	ekpoint := elliptic.Marshal(elliptic.P256(), ek.X, ek.Y)
+
+	blob, err := makeECCCredential(ekpoint, ap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blob.Secret) != activationSecretLen {
+		t.Errorf("Expected a %d bytes secret, got %d", activationSecretLen, len(blob.Secret))
+	}
+	akName, err := checkAKParameters(ap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := activateECCCredential(ek, akName, blob.Cred, blob.CredSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, blob.Secret) {
+		t.Errorf("The TPM recovered %x instead of %x", secret, blob.Secret)
+	}
+
+	otherName := &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: make([]byte, sha256.Size)}
+	if _, err = activateECCCredential(ek, otherName, blob.Cred, blob.CredSecret); err == nil {
+		t.Error("The credential must only be activated with the AK it was made for")
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = activateECCCredential(other, akName, blob.Cred, blob.CredSecret); err == nil {
+		t.Error("The credential must only be activated with the EK it was made for")
+	}
+
+	if _, err = makeECCCredential(ekpoint[1:], ap); err == nil {
+		t.Error("An invalid EK point must be rejected")
+	}
+	ap.CreateSignature = nil
+	if _, err = makeECCCredential(ekpoint, ap); err == nil {
+		t.Error("An uncertified AK must be rejected")
+	}
+}
+
+/*
+	TestECCCredentialKnownAnswer checks the challenge against one
+	computed from the TPM2 Library, Part 1, section 24 definitions
+	with another implementation (Python hashlib, hmac and P-256
+	arithmetic, OpenSSL AES-128-CFB). The AK name is a SHA1 one, so
+	that the keys must be derived with the EK name algorithm.
+*/
+func TestECCCredentialKnownAnswer(t *testing.T) {
+	var d = make([]byte, 32)
+	var secret = make([]byte, activationSecretLen)
+	for i := range d {
+		d[i] = byte(i + 1)
+		secret[i] = byte(i)
+	}
+	var eph = bytes.Repeat([]byte{0x11}, 32)
+	var ak = &tpm2.HashValue{Alg: tpm2.AlgSHA1, Value: bytes.Repeat([]byte{0xaa}, 20)}
+
+	x, y := elliptic.P256().ScalarBaseMult(d)
+	if expected := "515c3d6eb9e396b904d3feca7f54fdcd0cc1e997bf375dca515ad0a6c3b4035f"; hex.EncodeToString(x.Bytes()) != expected {
+		t.Fatalf("EK: expected x %s, got %x", expected, x)
+	}
+	cred, encSecret, err := generateECCCredential(eccEKNameAlg, ak, x, y, secret, eph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "00440020ce9e248e2d4af53f600cf39a831e85b48bc40d9bf9eddb919df1f0879b98a95fa7c1f85014b381822b670c702ae96ccd48c11e2b060404bb19b7ac5b45467de3a3a1"; hex.EncodeToString(cred) != expected {
+		t.Errorf("Credential: expected %s, got %x", expected, cred)
+	}
+	if expected := "004400200217e617f0b6443928278f96999e69a23a4f2c152bdf6d6cdf66e5b80282d4ed0020194a7debcb97712d2dda3ca85aa8765a56f45fc758599652f2897c65306e5794"; hex.EncodeToString(encSecret) != expected {
+		t.Errorf("Encrypted secret: expected %s, got %x", expected, encSecret)
+	}
+}
+
+func TestIsCertifiedAK(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ak, foreign = encodeAK(t, key), encodeAK(t, other)
+	empty, err := cbor.Marshal(attest.AttestationParameters{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		ap, certified []byte
+		certifiedAK   bool
+		valid         bool
+		name          string
+	}{
+		{ak, ak, true, true, "Certified AK"},
+		{ak, foreign, false, true, "Other AK certified"},
+		{ak, nil, false, true, "No AK certified"},
+		{empty, empty, false, true, "AK without public key"},
+		{[]byte("not CBOR"), ak, false, false, "Malformed AK"},
+		{ak, []byte("not CBOR"), false, false, "Malformed certified AK"},
+	}
+
+	for _, c := range cases {
+		certified, err := IsCertifiedAK(c.ap, c.certified)
+		if (err == nil) != c.valid {
+			t.Errorf("[%s]: expected valid: %t, got error: %v", c.name, c.valid, err)
+			continue
+		}
+		if certified != c.certifiedAK {
+			t.Errorf("[%s]: expected %t, got %t", c.name, c.certifiedAK, certified)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file validates the EK certificates sent by attesters on
+	enrollment, so that verifiers only trust keys belonging to a
+	genuine TPM.
+
+	The chain is built up to the TPM manufacturers roots bundled in
+	the ekroots directory. Intermediate CAs are taken from the
+	ekroots/intermediates directory when they are known, and fetched
+	from the Authority Information Access URLs of the certificates
+	otherwise.
+
+	No manufacturer root is bundled yet, and every certificate would
+	be rejected: the verification will only be exported to the
+	applications once they are.
+*/
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"embed"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency-go/asn1"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"github.com/google/go-attestation/attest"
+)
+
+// Bounds the number of intermediate CAs fetched for a single certificate.
+const MAX_CHAIN_LENGTH = 5
+
+//go:embed ekroots
+var ekroots embed.FS
+
+var (
+	oidSubjectAltName  = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// TCG EK Credential Profile, section 3.1.2
+	oidTPMManufacturer = asn1.ObjectIdentifier{2, 23, 133, 2, 1}
+	oidTPMModel        = asn1.ObjectIdentifier{2, 23, 133, 2, 2}
+	oidTPMVersion      = asn1.ObjectIdentifier{2, 23, 133, 2, 3}
+)
+
+// TCG TPM Vendor ID Registry, for the manufacturers
+// whose roots are bundled, and some others.
+var tpmVendors = map[string]string{
+	"AMD":  "AMD",
+	"IFX":  "Infineon",
+	"INTC": "Intel",
+	"NTC":  "Nuvoton Technology",
+	"STM":  "STMicroelectronics",
+	"MSFT": "Microsoft",
+	"GOOG": "Google",
+	"IBM":  "IBM",
+	"QCOM": "Qualcomm",
+	"SMSC": "SMSC",
+	"ATML": "Atmel",
+}
+
+/*
+	certificateFetcher downloads the certificate at @url, when an
+	intermediate CA is missing. It will be implemented by the
+	native application, e.g. to go through its own HTTP stack, or
+	to forbid network accesses.
+*/
+type certificateFetcher interface {
+	Fetch(url string) ([]byte, error)
+}
+
+/*
+	httpFetcher is the certificateFetcher used
+	when the caller doesn't provide one.
+*/
+type httpFetcher struct{}
+
+func (httpFetcher) Fetch(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1 << 16))
+}
+
+/*
+	ekInfo describes the TPM an EK certificate has
+	been issued for, as stated by its manufacturer.
+*/
+type ekInfo struct {
+	ManufacturerID string // TPM vendor ID, e.g. "IFX"
+	Vendor         string // TPM vendor name, e.g. "Infineon"
+	Model          string
+	Version        string
+	Issuer         string // Common name of the CA that issued the certificate
+	Root           string // Common name of the manufacturer root CA
+}
+
+/*
+	parseCertificates parses @data as one or many PEM
+	certificates, or as a single DER one.
+*/
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil && x509.IsFatal(err) {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if certs != nil {
+		return certs, nil
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil && x509.IsFatal(err) {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+/*
+	loadCertPool returns a pool of all the certificates
+	found in the embedded directory @dir.
+*/
+func loadCertPool(dir string) (*x509.CertPool, error) {
+	var pool = x509.NewCertPool()
+
+	entries, err := ekroots.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		switch path.Ext(e.Name()) {
+		case ".pem", ".crt", ".cer", ".der":
+		default:
+			continue
+		}
+		data, err := ekroots.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name(), err)
+		}
+		for _, c := range certs {
+			pool.AddCert(c)
+		}
+	}
+	return pool, nil
+}
+
+/*
+	parseTPMSubjectAltName returns the TPM manufacturer, model and
+	version from the directory name of the SAN extension of @cert.
+	As Go doesn't handle directory names in SANs, the extension
+	is marked as handled once parsed.
+*/
+func parseTPMSubjectAltName(cert *x509.Certificate, info *ekInfo) error {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			// directoryName [4] Name
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 4 {
+				continue
+			}
+			var rdns pkix.RDNSequence
+			if _, err := asn1.Unmarshal(name.Bytes, &rdns); err != nil {
+				return err
+			}
+			for _, rdn := range rdns {
+				for _, atv := range rdn {
+					value, _ := atv.Value.(string)
+					switch {
+					case atv.Type.Equal(oidTPMManufacturer):
+						info.ManufacturerID = value
+					case atv.Type.Equal(oidTPMModel):
+						info.Model = value
+					case atv.Type.Equal(oidTPMVersion):
+						info.Version = value
+					}
+				}
+			}
+		}
+	}
+
+	var unhandled []asn1.ObjectIdentifier
+	for _, oid := range cert.UnhandledCriticalExtensions {
+		if !oid.Equal(oidSubjectAltName) {
+			unhandled = append(unhandled, oid)
+		}
+	}
+	cert.UnhandledCriticalExtensions = unhandled
+	return nil
+}
+
+/*
+	vendorName decodes the TPM manufacturer ID @id, written
+	as "id:" followed by the hexadecimal ASCII vendor ID.
+*/
+func vendorName(id string) (string, string) {
+	var ascii []byte
+
+	hex := strings.TrimPrefix(strings.ToLower(id), "id:")
+	if _, err := fmt.Sscanf(hex, "%x", &ascii); err != nil {
+		return id, "unknown"
+	}
+	code := strings.TrimRight(string(ascii), "\x00 ")
+	if name, ok := tpmVendors[code]; ok {
+		return code, name
+	}
+	return code, "unknown"
+}
+
+/*
+	fetchIntermediates follows the AIA URLs of @cert until a
+	certificate issued by one of @roots is found, and adds
+	the fetched certificates to @intermediates.
+*/
+func fetchIntermediates(cert *x509.Certificate, roots, intermediates *x509.CertPool, fetcher certificateFetcher) error {
+	for i := 0; i < MAX_CHAIN_LENGTH; i++ {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err == nil {
+			return nil
+		}
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			return errors.New("The EK certificate chains to an unknown root: " + cert.Subject.CommonName)
+		}
+		if len(cert.IssuingCertificateURL) == 0 {
+			return errors.New("The EK certificate chains to an unknown CA: " + cert.Subject.CommonName)
+		}
+		var issuer *x509.Certificate
+		var errs []string
+		for _, url := range cert.IssuingCertificateURL {
+			data, err := fetcher.Fetch(url)
+			if err == nil {
+				var certs []*x509.Certificate
+				if certs, err = parseCertificates(data); err == nil {
+					issuer = certs[0]
+					break
+				}
+			}
+			errs = append(errs, err.Error())
+		}
+		if issuer == nil {
+			return errors.New("Failed to fetch an intermediate CA: " + strings.Join(errs, ", "))
+		}
+		intermediates.AddCert(issuer)
+		cert = issuer
+	}
+	return errors.New("The EK certificate chain is too long")
+}
+
+/*
+	matchesEK asserts that the public key of @cert is the EK
+	described by @ektype, @ekpub and @eke, as for MakeCredentialForEK.
+*/
+func matchesEK(cert *x509.Certificate, ektype string, ekpub []byte, eke int) error {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key := buildRSAPublicKey(ekpub, eke)
+		if (ektype == EK_TYPE_RSA || ektype == "") && pub.Equal(&key) {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		x, y := elliptic.Unmarshal(elliptic.P256(), ekpub)
+		if ektype == EK_TYPE_ECC && x != nil && pub.Curve == elliptic.P256() && pub.X.Cmp(x) == 0 && pub.Y.Cmp(y) == 0 {
+			return nil
+		}
+	}
+	return errors.New("The EK certificate doesn't certify the EK")
+}
+
+/*
+	verifyBundledEKCertificate asserts that @der, the EK certificate sent by an
+	attester on enrollment, has been issued by a TPM manufacturer for the
+	EK @ektype, @ekpub, @eke. Intermediate CAs that aren't bundled are
+	downloaded with @fetcher, or over HTTP if it's nil.
+	It returns the description of the TPM found in the certificate.
+*/
+func verifyBundledEKCertificate(ektype string, ekpub []byte, eke int, der []byte, fetcher certificateFetcher) (*ekInfo, error) {
+	roots, err := loadCertPool("ekroots")
+	if err != nil {
+		return nil, err
+	}
+	intermediates, err := loadCertPool("ekroots/intermediates")
+	if err != nil {
+		return nil, err
+	}
+	if fetcher == nil {
+		fetcher = httpFetcher{}
+	}
+	return verifyEKCertificate(ektype, ekpub, eke, der, roots, intermediates, fetcher)
+}
+
+func verifyEKCertificate(ektype string, ekpub []byte, eke int, der []byte, roots, intermediates *x509.CertPool, fetcher certificateFetcher) (*ekInfo, error) {
+	var info ekInfo
+
+	if len(der) == 0 {
+		return nil, errors.New("The attester didn't send an EK certificate")
+	}
+	cert, err := attest.ParseEKCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err = matchesEK(cert, ektype, ekpub, eke); err != nil {
+		return nil, err
+	}
+	if err = parseTPMSubjectAltName(cert, &info); err != nil {
+		return nil, fmt.Errorf("Invalid TPM subject alternative name: %v", err)
+	}
+	info.ManufacturerID, info.Vendor = vendorName(info.ManufacturerID)
+	info.Issuer = cert.Issuer.CommonName
+
+	if err = fetchIntermediates(cert, roots, intermediates, fetcher); err != nil {
+		return nil, err
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	chain := chains[0]
+	info.Root = chain[len(chain) - 1].Subject.CommonName
+	return &info, nil
+}
@@ -0,0 +1,233 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	stdx509 "crypto/x509"
+	stdpkix "crypto/x509/pkix"
+	stdasn1 "encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/certificate-transparency-go/x509"
+)
+
+const intermediateURL = "http://pki.example.com/ek-intermediate.crt"
+
+/*
+	testFetcher serves the certificates of its map,
+	and counts the fetches.
+*/
+type testFetcher struct {
+	certs   map[string][]byte
+	fetches int
+}
+
+func (f *testFetcher) Fetch(url string) ([]byte, error) {
+	f.fetches++
+	if data, ok := f.certs[url]; ok {
+		return data, nil
+	}
+	return nil, errors.New("Not found: " + url)
+}
+
+/*
+	tpmSubjectAltName returns the critical SAN extension of
+	EK certificates, describing the TPM in a directory name.
+*/
+func tpmSubjectAltName(t *testing.T, manufacturer, model, version string) stdpkix.Extension {
+	name, err := stdasn1.Marshal(stdpkix.RDNSequence{
+		{{Type: stdasn1.ObjectIdentifier(oidTPMManufacturer), Value: manufacturer}},
+		{{Type: stdasn1.ObjectIdentifier(oidTPMModel), Value: model}},
+		{{Type: stdasn1.ObjectIdentifier(oidTPMVersion), Value: version}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	san, err := stdasn1.Marshal([]stdasn1.RawValue{{Class: stdasn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdpkix.Extension{Id: stdasn1.ObjectIdentifier(oidSubjectAltName), Critical: true, Value: san}
+}
+
+/*
+	issue returns the DER certificate of @template, for @key,
+	issued by @parent with @parentKey, or self signed if nil.
+*/
+func issue(t *testing.T, template *stdx509.Certificate, key *rsa.PrivateKey, parent *stdx509.Certificate, parentKey *rsa.PrivateKey) ([]byte, *stdx509.Certificate) {
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1 << 62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := stdx509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := stdx509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, cert
+}
+
+func caTemplate(name string) *stdx509.Certificate {
+	return &stdx509.Certificate{
+		Subject:               stdpkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              stdx509.KeyUsageCertSign,
+	}
+}
+
+func certPool(t *testing.T, ders ...[]byte) *x509.CertPool {
+	var pool = x509.NewCertPool()
+	for _, der := range ders {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+func TestVendorName(t *testing.T) {
+	var cases = []struct {
+		id, code, name string
+	}{
+		{"id:49465800", "IFX", "Infineon"},
+		{"id:53544D20", "STM", "STMicroelectronics"},
+		{"ID:4e544300", "NTC", "Nuvoton Technology"},
+		{"id:494E5443", "INTC", "Intel"},
+		{"id:414D4400", "AMD", "AMD"},
+		{"id:58595A00", "XYZ", "unknown"},
+		{"Infineon", "Infineon", "unknown"},
+	}
+
+	for _, c := range cases {
+		if code, name := vendorName(c.id); code != c.code || name != c.name {
+			t.Errorf("%s: expected %s (%s), got %s (%s)", c.id, c.code, c.name, code, name)
+		}
+	}
+}
+
+func TestVerifyEKCertificate(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDER, root := issue(t, caTemplate("Infineon OPTIGA(TM) RSA Root CA"), caKey, nil, nil)
+	interDER, inter := issue(t, caTemplate("Infineon OPTIGA(TM) RSA Manufacturing CA 003"), caKey, root, caKey)
+	otherRootDER, otherRoot := issue(t, caTemplate("Unknown Root CA"), caKey, nil, nil)
+	leaf := &stdx509.Certificate{
+		KeyUsage:              stdx509.KeyUsageKeyEncipherment,
+		IssuingCertificateURL: []string{intermediateURL},
+		ExtraExtensions:       []stdpkix.Extension{tpmSubjectAltName(t, "id:49465800", "SLB9670", "id:00070055")},
+	}
+	ekDER, _ := issue(t, leaf, ek, inter, caKey)
+	orphanDER, _ := issue(t, leaf, ek, otherRoot, caKey)
+	noAIA := *leaf
+	noAIA.IssuingCertificateURL = nil
+	noAIADER, _ := issue(t, &noAIA, ek, inter, caKey)
+	interPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: interDER})
+
+	var cases = []struct {
+		der           []byte
+		ekpub         []byte
+		intermediates *x509.CertPool
+		served        map[string][]byte
+		fetches       int
+		err           string
+		name          string
+	}{
+		{ekDER, ek.N.Bytes(), certPool(t, interDER), nil, 0, "", "Bundled intermediate"},
+		{ekDER, ek.N.Bytes(), certPool(t), map[string][]byte{intermediateURL: interDER}, 1, "", "Fetched DER intermediate"},
+		{ekDER, ek.N.Bytes(), certPool(t), map[string][]byte{intermediateURL: interPEM}, 1, "", "Fetched PEM intermediate"},
+		{ekDER, ek.N.Bytes(), certPool(t), nil, 1, "Failed to fetch an intermediate CA", "Unreachable intermediate"},
+		{ekDER, ek.N.Bytes(), certPool(t), map[string][]byte{intermediateURL: otherRootDER}, 1, "unknown root", "Fetched unknown root"},
+		{noAIADER, ek.N.Bytes(), certPool(t), nil, 0, "unknown CA", "Missing intermediate without AIA"},
+		{orphanDER, ek.N.Bytes(), certPool(t), nil, 1, "Failed to fetch", "Other manufacturer"},
+		{ekDER, caKey.N.Bytes(), certPool(t, interDER), nil, 0, "doesn't certify the EK", "Other EK"},
+		{nil, ek.N.Bytes(), certPool(t, interDER), nil, 0, "didn't send an EK certificate", "No certificate"},
+	}
+
+	for _, c := range cases {
+		fetcher := &testFetcher{certs: c.served}
+		info, err := verifyEKCertificate(EK_TYPE_RSA, c.ekpub, ek.E, c.der, certPool(t, rootDER), c.intermediates, fetcher)
+		if fetcher.fetches != c.fetches {
+			t.Errorf("[%s]: expected %d fetches, got %d", c.name, c.fetches, fetcher.fetches)
+		}
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("[%s]: expected error %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		expected := ekInfo{"IFX", "Infineon", "SLB9670", "id:00070055", inter.Subject.CommonName, root.Subject.CommonName}
+		if *info != expected {
+			t.Errorf("[%s]: expected %+v, got %+v", c.name, expected, *info)
+		}
+	}
+}
+
+/*
+	TestEmbeddedRoots checks that the bundled CAs can be
+	loaded, and that the README of their directory lists
+	their SHA256 fingerprint, as checked with the manufacturer.
+*/
+func TestEmbeddedRoots(t *testing.T) {
+	for _, dir := range []string{"ekroots", "ekroots/intermediates"} {
+		if _, err := loadCertPool(dir); err != nil {
+			t.Fatalf("%s: %v", dir, err)
+		}
+		readme, err := ekroots.ReadFile(path.Join(dir, "README.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := fs.ReadDir(ekroots, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			switch path.Ext(e.Name()) {
+			case ".pem", ".crt", ".cer", ".der":
+			default:
+				continue
+			}
+			data, _ := ekroots.ReadFile(path.Join(dir, e.Name()))
+			certs, _ := parseCertificates(data)
+			for _, cert := range certs {
+				fingerprint := fmt.Sprintf("%X", sha256.Sum256(cert.Raw))
+				if !cert.IsCA {
+					t.Errorf("%s: %s isn't a CA", e.Name(), cert.Subject.CommonName)
+				}
+				if !strings.Contains(strings.ToUpper(strings.ReplaceAll(string(readme), ":", "")), fingerprint) {
+					t.Errorf("%s: the fingerprint %s of %s isn't listed in %s/README.md", e.Name(), fingerprint, cert.Subject.CommonName, dir)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,463 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file explains PCR mismatches by comparing the event log
+	of an attestation with the one stored on enrollment.
+
+	Events are described from their data, following the TCG PC
+	Client Platform Firmware Profile: the path of the loaded boot
+	applications, the name of the measured UEFI variables, or the
+	strings measured by boot loaders, such as the kernel command
+	line. This tells e.g. a kernel update, where the digest of the
+	same boot application changes, from a replaced boot loader.
+*/
+
+package gomobile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+)
+
+// Kind of an EventChange.
+const (
+	EVENT_ADDED   = "ADDED"
+	EVENT_REMOVED = "REMOVED"
+	EVENT_CHANGED = "CHANGED" // Same event, with a different digest
+)
+
+// Number of PCRs of a PC Client TPM
+const PCR_COUNT = 24
+
+// Event types, from the TCG PC Client Platform Firmware Profile.
+const (
+	evPostCode                   = 0x00000001
+	evNoAction                   = 0x00000003
+	evSeparator                  = 0x00000004
+	evAction                     = 0x00000005
+	evSCRTMVersion               = 0x00000008
+	evIPL                        = 0x0000000d
+	evEFIVariableDriverConfig    = 0x80000001
+	evEFIVariableBoot            = 0x80000002
+	evEFIBootServicesApplication = 0x80000003
+	evEFIBootServicesDriver      = 0x80000004
+	evEFIRuntimeServicesDriver   = 0x80000005
+	evEFIGPTEvent                = 0x80000006
+	evEFIAction                  = 0x80000007
+	evEFIVariableBoot2           = 0x8000000c
+	evEFIVariableAuthority       = 0x800000e0
+)
+
+/*
+	loggedEvent is an event of the event log, as stored on
+	enrollment to be compared with the next attestations.
+*/
+type loggedEvent struct {
+	Index       int
+	Type        uint32
+	Description string
+	Digests     map[string][]byte // Digest of the event in each bank
+}
+
+/*
+	EncodedEventLog is the parsed event log of an attester,
+	encoded to CBOR, to be stored on enrollment.
+*/
+type EncodedEventLog struct {
+	Data []byte
+}
+
+/*
+	EventChange describes an event that differs between the event
+	log stored on enrollment and the one of an attestation.
+*/
+type EventChange struct {
+	PCR            int
+	Kind           string // One of the EVENT_* constants
+	Type           string // e.g. "EV_EFI_BOOT_SERVICES_APPLICATION"
+	Description    string // Description of the new event, or of the removed one
+	OldDescription string // Description of the event before a CHANGED one
+	OldDigest      []byte // SHA256 digest, or SHA1 one if the log hasn't SHA256 digests
+	NewDigest      []byte
+}
+
+/*
+	EventLogDiff lists the changes between two event logs,
+	ordered by PCR then position in the event log.
+*/
+type EventLogDiff struct {
+	changes []*EventChange
+}
+
+/*
+	ChangeCount returns the number of changed events.
+*/
+func (d *EventLogDiff) ChangeCount() int {
+	return len(d.changes)
+}
+
+/*
+	Change returns the @i-th changed event,
+	or nil if @i is out of range.
+*/
+func (d *EventLogDiff) Change(i int) *EventChange {
+	if i < 0 || i >= len(d.changes) {
+		return nil
+	}
+	return d.changes[i]
+}
+
+/*
+	decodeUTF16 decodes the little endian UTF-16 string @b,
+	up to its first NUL character.
+*/
+func decodeUTF16(b []byte) string {
+	var chars = make([]uint16, 0, len(b) / 2)
+
+	for i := 0; i + 1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars))
+}
+
+/*
+	decodeString decodes the string measured in @b, which
+	boot loaders write in either ASCII or UTF-16.
+*/
+func decodeString(b []byte) string {
+	if len(b) >= 2 && b[0] != 0 && b[1] == 0 {
+		return decodeUTF16(b)
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
+
+/*
+	parseDevicePath returns the file path of the EFI device
+	path @b, empty if it isn't a file, e.g. a firmware volume.
+*/
+func parseDevicePath(b []byte) string {
+	var paths []string
+
+	for len(b) >= 4 {
+		typ, subtype := b[0], b[1]
+		length := int(binary.LittleEndian.Uint16(b[2:4]))
+		if length < 4 || length > len(b) || typ == 0x7f {
+			break
+		}
+		// Media device path, file path node
+		if typ == 0x04 && subtype == 0x04 {
+			paths = append(paths, decodeUTF16(b[4:length]))
+		}
+		b = b[length:]
+	}
+	return strings.Join(paths, "")
+}
+
+/*
+	parseImageLoad returns the path of the image whose
+	UEFI_IMAGE_LOAD_EVENT structure is @data.
+*/
+func parseImageLoad(data []byte) (string, error) {
+	var hdr struct {
+		Location       uint64
+		Length         uint64
+		LinkTime       uint64
+		DevicePathSize uint64
+	}
+
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return "", err
+	}
+	if hdr.DevicePathSize > uint64(r.Len()) {
+		return "", errors.New("Invalid device path length")
+	}
+	return parseDevicePath(data[len(data) - r.Len():][:hdr.DevicePathSize]), nil
+}
+
+/*
+	parseVariable returns the vendor GUID, name and value of
+	the variable whose UEFI_VARIABLE_DATA structure is @data.
+*/
+func parseVariable(data []byte) ([16]byte, string, []byte, error) {
+	var hdr struct {
+		GUID       [16]byte
+		NameLength uint64
+		DataLength uint64
+	}
+
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return hdr.GUID, "", nil, err
+	}
+	rest := data[len(data) - r.Len():]
+	if hdr.NameLength > uint64(len(rest) / 2) || hdr.DataLength > uint64(len(rest)) - hdr.NameLength * 2 {
+		return hdr.GUID, "", nil, errors.New("Invalid variable length")
+	}
+	name := decodeUTF16(rest[:hdr.NameLength * 2])
+	return hdr.GUID, name, rest[hdr.NameLength * 2:][:hdr.DataLength], nil
+}
+
+/*
+	describeEvent returns a human readable description
+	of the event of type @typ and data @data.
+*/
+func describeEvent(typ uint32, data []byte) string {
+	switch typ {
+	case evEFIBootServicesApplication, evEFIBootServicesDriver, evEFIRuntimeServicesDriver:
+		path, err := parseImageLoad(data)
+		if err != nil {
+			return "Image with an invalid description"
+		}
+		if path == "" {
+			return "Image loaded from the firmware or memory"
+		}
+		return "Image " + path
+	case evEFIVariableDriverConfig, evEFIVariableBoot, evEFIVariableBoot2, evEFIVariableAuthority:
+		_, name, _, err := parseVariable(data)
+		if err != nil {
+			return "Variable with an invalid description"
+		}
+		return "Variable " + name
+	case evIPL, evPostCode, evAction, evEFIAction, evSCRTMVersion:
+		return decodeString(data)
+	case evSeparator:
+		return "Separator"
+	case evEFIGPTEvent:
+		return "GPT partition table"
+	}
+	return attest.EventType(typ).String()
+}
+
+/*
+	parseEvents returns the events of @el,
+	with their description and digests.
+*/
+func parseEvents(el *attest.EventLog) []loggedEvent {
+	var events []loggedEvent
+
+	sha1 := el.Events(attest.HashSHA1)
+	sha256 := el.Events(attest.HashSHA256)
+	for i, e := range sha1 {
+		if e.Type == evNoAction {
+			// Not measured
+			continue
+		}
+		ev := loggedEvent{
+			Index:       e.Index,
+			Type:        uint32(e.Type),
+			Description: describeEvent(uint32(e.Type), e.Data),
+			Digests:     make(map[string][]byte),
+		}
+		if e.Digest != nil {
+			ev.Digests["SHA1"] = e.Digest
+		}
+		if i < len(sha256) && sha256[i].Digest != nil {
+			ev.Digests["SHA256"] = sha256[i].Digest
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+/*
+	readEvents parses and returns the events of the
+	event log from the attestation data @encodedpp.
+*/
+func readEvents(encodedpp []byte) ([]loggedEvent, error) {
+	var pp attest.PlatformParameters
+
+	if err := cbor.Unmarshal(encodedpp, &pp); err != nil {
+		return nil, err
+	}
+	el, err := attest.ParseEventLog(pp.EventLog)
+	if err != nil {
+		return nil, err
+	}
+	return parseEvents(el), nil
+}
+
+/*
+	GetEventLog parses, encodes and returns the event log from
+	the attestation data @encodedpp, to be stored on enrollment
+	and given to DiffEventLogs on the next attestations.
+*/
+func GetEventLog(encodedpp []byte) (*EncodedEventLog, error) {
+	events, err := readEvents(encodedpp)
+	if err != nil {
+		return nil, err
+	}
+	data, err := cbor.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+	return &EncodedEventLog{data}, nil
+}
+
+/*
+	digest returns the digest of @e used to compare events:
+	the SHA256 one, or the SHA1 one for older event logs.
+*/
+func (e *loggedEvent) digest() []byte {
+	if d, ok := e.Digests["SHA256"]; ok {
+		return d
+	}
+	return e.Digests["SHA1"]
+}
+
+func (e *loggedEvent) equals(o *loggedEvent) bool {
+	return e.Type == o.Type && bytes.Equal(e.digest(), o.digest())
+}
+
+/*
+	diffEvents compares @old and @new, the events of a single
+	PCR, by finding their longest common subsequence. In each run
+	of removed and added events, events of the same type and
+	description, or else the same type, are paired as CHANGED.
+*/
+func diffEvents(pcr int, old, new []loggedEvent) []*EventChange {
+	var changes []*EventChange
+
+	// lcs[i][j] is the length of the LCS of old[i:] and new[j:]
+	lcs := make([][]int, len(old) + 1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new) + 1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i].equals(&new[j]) {
+				lcs[i][j] = lcs[i + 1][j + 1] + 1
+			} else if lcs[i + 1][j] >= lcs[i][j + 1] {
+				lcs[i][j] = lcs[i + 1][j]
+			} else {
+				lcs[i][j] = lcs[i][j + 1]
+			}
+		}
+	}
+
+	var removed, added []loggedEvent
+	flush := func() {
+		changes = append(changes, pairEvents(pcr, removed, added)...)
+		removed, added = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		switch {
+		case i < len(old) && j < len(new) && old[i].equals(&new[j]):
+			flush()
+			i, j = i + 1, j + 1
+		case j == len(new) || (i < len(old) && lcs[i + 1][j] >= lcs[i][j + 1]):
+			removed = append(removed, old[i])
+			i++
+		default:
+			added = append(added, new[j])
+			j++
+		}
+	}
+	flush()
+	return changes
+}
+
+/*
+	pairEvents turns a run of @removed and @added events
+	of the PCR @pcr into changes.
+*/
+func pairEvents(pcr int, removed, added []loggedEvent) []*EventChange {
+	var changes []*EventChange
+	var paired = make(map[int]int)
+	var used = make(map[int]bool)
+
+	match := func(sameDescription bool) {
+		for i := range removed {
+			if _, ok := paired[i]; ok {
+				continue
+			}
+			for j := range added {
+				if used[j] || added[j].Type != removed[i].Type {
+					continue
+				}
+				if sameDescription && added[j].Description != removed[i].Description {
+					continue
+				}
+				paired[i], used[j] = j, true
+				break
+			}
+		}
+	}
+	match(true)
+	match(false)
+
+	for i, e := range removed {
+		change := &EventChange{
+			PCR:         pcr,
+			Kind:        EVENT_REMOVED,
+			Type:        attest.EventType(e.Type).String(),
+			Description: e.Description,
+			OldDigest:   e.digest(),
+		}
+		if j, ok := paired[i]; ok {
+			change.Kind = EVENT_CHANGED
+			change.Description = added[j].Description
+			change.OldDescription = e.Description
+			change.NewDigest = added[j].digest()
+		}
+		changes = append(changes, change)
+	}
+	for j, e := range added {
+		if used[j] {
+			continue
+		}
+		changes = append(changes, &EventChange{
+			PCR:         pcr,
+			Kind:        EVENT_ADDED,
+			Type:        attest.EventType(e.Type).String(),
+			Description: e.Description,
+			NewDigest:   e.digest(),
+		})
+	}
+	return changes
+}
+
+/*
+	DiffEventLogs compares the event log @encodedreference, as
+	returned by GetEventLog on enrollment, with the one of the
+	attestation data @encodedpp, to explain why PCRs changed.
+	The event log should have been replayed before, with Verify
+	or ReplayEventLog, for the changes to be trusted.
+*/
+func DiffEventLogs(encodedreference, encodedpp []byte) (*EventLogDiff, error) {
+	var reference []loggedEvent
+	var diff EventLogDiff
+
+	if err := cbor.Unmarshal(encodedreference, &reference); err != nil {
+		return nil, fmt.Errorf("Invalid reference event log: %v", err)
+	}
+	events, err := readEvents(encodedpp)
+	if err != nil {
+		return nil, err
+	}
+
+	var old, new = make(map[int][]loggedEvent), make(map[int][]loggedEvent)
+	for _, e := range reference {
+		old[e.Index] = append(old[e.Index], e)
+	}
+	for _, e := range events {
+		new[e.Index] = append(new[e.Index], e)
+	}
+	for pcr := 0; pcr < PCR_COUNT; pcr++ {
+		diff.changes = append(diff.changes, diffEvents(pcr, old[pcr], new[pcr])...)
+	}
+	return &diff, nil
+}
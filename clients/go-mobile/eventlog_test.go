@@ -0,0 +1,285 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+)
+
+/*
+	testEvent is an event of the event logs built by buildEventLog.
+	Its digest is the one of its data, unless @digest is set.
+*/
+type testEvent struct {
+	pcr    int
+	typ    uint32
+	data   []byte
+	digest []byte // SHA256 digest, the SHA1 one is then its SHA1 digest
+}
+
+/*
+	buildEventLog returns the crypto agile event log of @events, with
+	SHA1 and SHA256 digests, and the PCRs of both banks it replays to.
+*/
+func buildEventLog(t *testing.T, events []testEvent) ([]byte, []attest.PCR) {
+	var log bytes.Buffer
+	var le = binary.LittleEndian
+	var values = map[crypto.Hash]map[int][]byte{
+		crypto.SHA1:   make(map[int][]byte),
+		crypto.SHA256: make(map[int][]byte),
+	}
+
+	// TCG_EfiSpecIDEvent, in the SHA1 log format
+	var spec bytes.Buffer
+	spec.WriteString("Spec ID Event03\x00")
+	binary.Write(&spec, le, uint32(0))        // Platform class
+	spec.Write([]byte{0, 2, 0, 2})            // Version 2.0, errata 0, UINTN size
+	binary.Write(&spec, le, uint32(2))        // Number of algorithms
+	binary.Write(&spec, le, []uint16{uint16(tpm2.AlgSHA1), sha1.Size, uint16(tpm2.AlgSHA256), sha256.Size})
+	spec.WriteByte(0)                         // Vendor info size
+	binary.Write(&log, le, []uint32{0, evNoAction})
+	log.Write(make([]byte, sha1.Size))
+	binary.Write(&log, le, uint32(spec.Len()))
+	log.Write(spec.Bytes())
+
+	for _, e := range events {
+		d256 := e.digest
+		if d256 == nil {
+			h := sha256.Sum256(e.data)
+			d256 = h[:]
+		}
+		h1 := sha1.Sum(d256)
+		if e.digest == nil {
+			h1 = sha1.Sum(e.data)
+		}
+		binary.Write(&log, le, []uint32{uint32(e.pcr), e.typ, 2})
+		binary.Write(&log, le, uint16(tpm2.AlgSHA1))
+		log.Write(h1[:])
+		binary.Write(&log, le, uint16(tpm2.AlgSHA256))
+		log.Write(d256)
+		binary.Write(&log, le, uint32(len(e.data)))
+		log.Write(e.data)
+
+		if e.typ == evNoAction {
+			continue
+		}
+		for hash, digest := range map[crypto.Hash][]byte{crypto.SHA1: h1[:], crypto.SHA256: d256} {
+			value, ok := values[hash][e.pcr]
+			if !ok {
+				value = make([]byte, hash.Size())
+			}
+			h := hash.New()
+			h.Write(value)
+			h.Write(digest)
+			values[hash][e.pcr] = h.Sum(nil)
+		}
+	}
+
+	var pcrs []attest.PCR
+	for _, hash := range []crypto.Hash{crypto.SHA1, crypto.SHA256} {
+		for index := 0; index < PCR_COUNT; index++ {
+			if value, ok := values[hash][index]; ok {
+				pcrs = append(pcrs, attest.PCR{Index: index, Digest: value, DigestAlg: hash})
+			}
+		}
+	}
+	if _, err := attest.ParseEventLog(log.Bytes()); err != nil {
+		t.Fatalf("Invalid test event log: %v", err)
+	}
+	return log.Bytes(), pcrs
+}
+
+/*
+	encodePlatform returns the CBOR attestation data of the event
+	log @log and @pcrs, as sent by the attester.
+*/
+func encodePlatform(t *testing.T, log []byte, pcrs []attest.PCR) []byte {
+	encoded, err := cbor.Marshal(attest.PlatformParameters{
+		TPMVersion: attest.TPMVersion20,
+		PCRs:       pcrs,
+		EventLog:   log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s + "\x00")) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+/*
+	imageLoadData returns the UEFI_IMAGE_LOAD_EVENT of an image loaded
+	from @path, or from memory if it's empty.
+*/
+func imageLoadData(path string) []byte {
+	var devicePath []byte
+	if path != "" {
+		name := utf16Bytes(path)
+		devicePath = binary.LittleEndian.AppendUint16([]byte{0x04, 0x04}, uint16(4 + len(name)))
+		devicePath = append(devicePath, name...)
+	}
+	devicePath = append(devicePath, 0x7f, 0xff, 0x04, 0x00)
+
+	var data = make([]byte, 32)
+	binary.LittleEndian.PutUint64(data[24:], uint64(len(devicePath)))
+	return append(data, devicePath...)
+}
+
+/*
+	variableData returns the UEFI_VARIABLE_DATA of
+	the variable @name, of vendor @guid, set to @value.
+*/
+func variableData(guid [16]byte, name string, value []byte) []byte {
+	var data = append([]byte{}, guid[:]...)
+	var encoded = utf16Bytes(name)
+	encoded = encoded[:len(encoded) - 2]
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(encoded) / 2))
+	data = binary.LittleEndian.AppendUint64(data, uint64(len(value)))
+	data = append(data, encoded...)
+	return append(data, value...)
+}
+
+func TestDescribeEvent(t *testing.T) {
+	var cases = []struct {
+		typ      uint32
+		data     []byte
+		expected string
+	}{
+		{evEFIBootServicesApplication, imageLoadData(`\EFI\debian\shimx64.efi`), `Image \EFI\debian\shimx64.efi`},
+		{evEFIBootServicesApplication, imageLoadData(""), "Image loaded from the firmware or memory"},
+		{evEFIBootServicesApplication, []byte{1, 2}, "Image with an invalid description"},
+		{evEFIVariableDriverConfig, variableData([16]byte{}, "SecureBoot", []byte{1}), "Variable SecureBoot"},
+		{evIPL, []byte("grub_cmd: linux /vmlinuz\x00"), "grub_cmd: linux /vmlinuz"},
+		{evIPL, utf16Bytes("initrd=initrd.img"), "initrd=initrd.img"},
+		{evSeparator, []byte{0, 0, 0, 0}, "Separator"},
+	}
+
+	for _, c := range cases {
+		if d := describeEvent(c.typ, c.data); d != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, d)
+		}
+	}
+}
+
+func TestDiffEvents(t *testing.T) {
+	event := func(typ uint32, description string, digest byte) loggedEvent {
+		return loggedEvent{
+			Index:       4,
+			Type:        typ,
+			Description: description,
+			Digests:     map[string][]byte{"SHA256": bytes.Repeat([]byte{digest}, sha256.Size)},
+		}
+	}
+	var (
+		action = event(evEFIAction, "Calling EFI Application from Boot Option", 1)
+		shim   = event(evEFIBootServicesApplication, `Image \EFI\debian\shimx64.efi`, 2)
+		grub   = event(evEFIBootServicesApplication, `Image \EFI\debian\grubx64.efi`, 3)
+		kernel = event(evEFIBootServicesApplication, `Image \vmlinuz-6.1`, 4)
+		sep    = event(evSeparator, "Separator", 5)
+
+		newGrub   = event(evEFIBootServicesApplication, `Image \EFI\debian\grubx64.efi`, 6)
+		newKernel = event(evEFIBootServicesApplication, `Image \vmlinuz-6.5`, 7)
+	)
+
+	type change struct {
+		kind        string
+		description string
+	}
+	var cases = []struct {
+		old, new []loggedEvent
+		expected []change
+		name     string
+	}{
+		{[]loggedEvent{action, shim, grub, sep}, []loggedEvent{action, shim, grub, sep}, nil, "Same events"},
+		{[]loggedEvent{shim, grub, kernel}, []loggedEvent{shim, newGrub, kernel}, []change{{EVENT_CHANGED, grub.Description}}, "Updated boot loader"},
+		{[]loggedEvent{shim, grub, kernel}, []loggedEvent{shim, grub, newKernel}, []change{{EVENT_CHANGED, newKernel.Description}}, "Kernel with another path"},
+		{[]loggedEvent{shim, kernel}, []loggedEvent{shim, grub, kernel}, []change{{EVENT_ADDED, grub.Description}}, "Added event"},
+		{[]loggedEvent{action, shim, sep}, []loggedEvent{shim, sep}, []change{{EVENT_REMOVED, action.Description}}, "Removed event"},
+		{[]loggedEvent{action, sep}, []loggedEvent{kernel, sep}, []change{{EVENT_REMOVED, action.Description}, {EVENT_ADDED, kernel.Description}}, "Events of different types"},
+	}
+
+	for _, c := range cases {
+		changes := diffEvents(4, c.old, c.new)
+		if len(changes) != len(c.expected) {
+			t.Errorf("[%s]: expected %d changes, got %d", c.name, len(c.expected), len(changes))
+			continue
+		}
+		for i, expected := range c.expected {
+			if changes[i].Kind != expected.kind || changes[i].Description != expected.description || changes[i].PCR != 4 {
+				t.Errorf("[%s]: expected %+v, got %+v", c.name, expected, *changes[i])
+			}
+		}
+	}
+}
+
+func TestPairEvents(t *testing.T) {
+	event := func(description string, digest byte) loggedEvent {
+		return loggedEvent{
+			Index:       4,
+			Type:        evEFIBootServicesApplication,
+			Description: description,
+			Digests:     map[string][]byte{"SHA1": bytes.Repeat([]byte{digest}, sha1.Size)},
+		}
+	}
+	var removed = []loggedEvent{event("Image shim", 1), event("Image grub", 2)}
+	var added = []loggedEvent{event("Image grub", 3), event("Image shim", 4)}
+
+	// Events are paired by description first, then by type
+	changes := pairEvents(4, removed, added)
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %d", len(changes))
+	}
+	for i, c := range changes {
+		if c.Kind != EVENT_CHANGED || c.Description != c.OldDescription {
+			t.Errorf("Change %d: unexpected pairing %+v", i, *c)
+		}
+	}
+	if !bytes.Equal(changes[0].NewDigest, added[1].Digests["SHA1"]) {
+		t.Errorf("The SHA1 digest must be used without SHA256 one")
+	}
+
+	changes = pairEvents(4, removed[:1], added)
+	if len(changes) != 2 || changes[0].Kind != EVENT_CHANGED || changes[0].Description != "Image shim" || changes[1].Kind != EVENT_ADDED {
+		t.Errorf("Unexpected changes: %+v, %+v", *changes[0], *changes[1])
+	}
+}
+
+func TestDiffEventLogs(t *testing.T) {
+	var events = []testEvent{
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\debian\shimx64.efi`)},
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\vmlinuz-6.1`)},
+		{pcr: 7, typ: evSeparator, data: []byte{0, 0, 0, 0}},
+	}
+	log, pcrs := buildEventLog(t, events)
+	reference, err := GetEventLog(encodePlatform(t, log, pcrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events[1].data = imageLoadData(`\vmlinuz-6.5`)
+	log, pcrs = buildEventLog(t, events)
+	diff, err := DiffEventLogs(reference.Data, encodePlatform(t, log, pcrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.ChangeCount() != 1 || diff.Change(0).Kind != EVENT_CHANGED || diff.Change(0).OldDescription != `Image \vmlinuz-6.1` || diff.Change(1) != nil {
+		t.Errorf("Unexpected diff: %+v", diff.changes)
+	}
+}
@@ -3,10 +3,13 @@ module gomobile
 go 1.18
 
 require (
-	github.com/fxamacker/cbor/v2 v2.4.0 // indirect
-	github.com/google/certificate-transparency-go v1.1.1 // indirect
-	github.com/google/go-attestation v0.4.3 // indirect
-	github.com/google/go-tpm v0.3.3 // indirect
+	github.com/fxamacker/cbor/v2 v2.4.0
+	github.com/google/certificate-transparency-go v1.1.1
+	github.com/google/go-attestation v0.4.3
+	github.com/google/go-tpm v0.3.3
+)
+
+require (
 	github.com/google/go-tspi v0.2.1-0.20190423175329-115dea689aad // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b // indirect
@@ -0,0 +1,357 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file verifies the IMA runtime measurement log, which the
+	attester sends along with the event log when asked to, so that
+	the state of the system after boot can be attested.
+
+	The log is replayed against the quoted PCRs, usually PCR 10.
+	As it's read after the quote, it may end with measurements that
+	weren't quoted yet, which are ignored. The files it measured
+	are then matched against an allowlist, in the format of the
+	sha256sum output:
+
+		<hex digest>  <path>
+
+	Only the ima-ng based templates (ima-ng, ima-sig, ima-buf...)
+	are supported for SHA256 replays, the legacy ima template only
+	is for SHA1 ones.
+*/
+
+package gomobile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+)
+
+// Status of the entries of an IMAReport.
+const (
+	IMA_UNKNOWN   = "UNKNOWN"   // The file isn't in the allowlist
+	IMA_MISMATCH  = "MISMATCH"  // The file is in the allowlist, with other digests
+	IMA_VIOLATION = "VIOLATION" // The file was measured while open for writing, or the reverse
+)
+
+/*
+	IMAEntry describes a measurement of the IMA log.
+*/
+type IMAEntry struct {
+	PCR      int
+	Template string // e.g. "ima-ng"
+	Path     string
+	Digest   []byte // Digest of the file
+	Status   string // One of the IMA_* constants
+}
+
+/*
+	IMAReport is the result of CheckIMALog.
+*/
+type IMAReport struct {
+	Valid            bool // The log has been replayed, and all its measurements are allowed
+	Replayed         bool
+	ReplayError      string
+	MeasurementCount int // Number of quoted measurements
+	entries          []*IMAEntry
+}
+
+/*
+	EntryCount returns the number of
+	measurements that aren't allowed.
+*/
+func (r *IMAReport) EntryCount() int {
+	return len(r.entries)
+}
+
+/*
+	Entry returns the @i-th measurement that isn't
+	allowed, or nil if @i is out of range.
+*/
+func (r *IMAReport) Entry(i int) *IMAEntry {
+	if i < 0 || i >= len(r.entries) {
+		return nil
+	}
+	return r.entries[i]
+}
+
+/*
+	imaMeasurement is an entry of the IMA log.
+*/
+type imaMeasurement struct {
+	PCR            int
+	TemplateDigest []byte // SHA1 digest of the template data
+	Template       string
+	Data           []byte // Template data
+	Path           string
+	Digest         []byte
+}
+
+/*
+	readField reads a length prefixed field of
+	template data from @data, and returns the rest.
+*/
+func readField(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("Truncated IMA template data")
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if uint64(size) > uint64(len(data) - 4) {
+		return nil, nil, errors.New("Truncated IMA template data")
+	}
+	return data[4:4 + size], data[4 + size:], nil
+}
+
+/*
+	parseTemplateData sets the path and digest of @m,
+	from the d-ng and n-ng fields of its template data.
+*/
+func (m *imaMeasurement) parseTemplateData() error {
+	digest, rest, err := readField(m.Data)
+	if err != nil {
+		return err
+	}
+	name, _, err := readField(rest)
+	if err != nil {
+		return err
+	}
+	// The digest is prefixed by its algorithm, e.g. "sha256:\0"
+	if i := bytes.IndexByte(digest, 0); i >= 0 && bytes.HasSuffix(digest[:i], []byte(":")) {
+		digest = digest[i + 1:]
+	}
+	m.Digest = digest
+	m.Path = strings.TrimRight(string(name), "\x00")
+	return nil
+}
+
+/*
+	parseIMALog parses the binary IMA log @data, as
+	exported by the kernel in little endian order.
+*/
+func parseIMALog(data []byte) ([]*imaMeasurement, error) {
+	var measurements []*imaMeasurement
+	var invalid = errors.New("Truncated IMA log")
+
+	for len(data) > 0 {
+		var m imaMeasurement
+		if len(data) < 28 {
+			return nil, invalid
+		}
+		m.PCR = int(binary.LittleEndian.Uint32(data))
+		m.TemplateDigest = data[4:24]
+		size := binary.LittleEndian.Uint32(data[24:])
+		if uint64(size) > uint64(len(data) - 28) {
+			return nil, invalid
+		}
+		m.Template = string(data[28:28 + size])
+		data = data[28 + size:]
+
+		if m.Template == "ima" {
+			// SHA1 digest, then the path
+			if len(data) < 24 {
+				return nil, invalid
+			}
+			m.Digest = data[:20]
+			size = binary.LittleEndian.Uint32(data[20:])
+			if uint64(size) > uint64(len(data) - 24) {
+				return nil, invalid
+			}
+			m.Path = string(data[24:24 + size])
+			data = data[24 + size:]
+		} else {
+			var err error
+			if m.Data, data, err = readField(data); err != nil {
+				return nil, err
+			}
+			if err = m.parseTemplateData(); err != nil {
+				return nil, err
+			}
+		}
+		if m.PCR < 0 || m.PCR >= PCR_COUNT {
+			return nil, fmt.Errorf("Invalid PCR index in the IMA log: %d", m.PCR)
+		}
+		measurements = append(measurements, &m)
+	}
+	return measurements, nil
+}
+
+/*
+	violation returns whether @m is a violation, which
+	IMA logs with a zero digest and extends with ones.
+*/
+func (m *imaMeasurement) violation() bool {
+	return bytes.Equal(m.TemplateDigest, make([]byte, 20))
+}
+
+/*
+	extendedDigest returns the digest IMA extended the PCR
+	bank of @hash with when measuring @m.
+*/
+func (m *imaMeasurement) extendedDigest(hash crypto.Hash) ([]byte, error) {
+	switch {
+	case m.violation():
+		return bytes.Repeat([]byte{0xff}, hash.Size()), nil
+	case hash == crypto.SHA1:
+		return m.TemplateDigest, nil
+	case m.Template == "ima":
+		return nil, errors.New("The ima template can only be replayed against SHA1 PCRs")
+	}
+	h := hash.New()
+	h.Write(m.Data)
+	return h.Sum(nil), nil
+}
+
+/*
+	replayIMALog replays @measurements against @pcrs, in the
+	SHA256 bank if quoted, SHA1 otherwise. It returns the
+	number of quoted measurements, those that follow being
+	more recent than the quote.
+*/
+func replayIMALog(measurements []*imaMeasurement, pcrs []attest.PCR) (int, error) {
+	var quoted = make(map[int]attest.PCR)
+	var values = make(map[int][]byte)
+	var count = make(map[int]int)
+
+	for _, pcr := range pcrs {
+		if q, ok := quoted[pcr.Index]; !ok || (q.DigestAlg == crypto.SHA1 && pcr.DigestAlg == crypto.SHA256) {
+			quoted[pcr.Index] = pcr
+		}
+	}
+	for i, m := range measurements {
+		pcr, ok := quoted[m.PCR]
+		if !ok {
+			return 0, fmt.Errorf("PCR %d, measured by IMA, hasn't been quoted", m.PCR)
+		}
+		if pcr.DigestAlg != crypto.SHA1 && pcr.DigestAlg != crypto.SHA256 {
+			return 0, fmt.Errorf("PCR %d has been quoted in an unsupported bank", m.PCR)
+		}
+		if values[m.PCR] == nil {
+			values[m.PCR] = make([]byte, pcr.DigestAlg.Size())
+		}
+		digest, err := m.extendedDigest(pcr.DigestAlg)
+		if err != nil {
+			return 0, err
+		}
+		h := pcr.DigestAlg.New()
+		h.Write(values[m.PCR])
+		h.Write(digest)
+		values[m.PCR] = h.Sum(nil)
+		// The quote holds the measurements up to the last match,
+		// as the values of a PCR never repeat
+		if bytes.Equal(values[m.PCR], pcr.Digest) {
+			count[m.PCR] = i + 1
+		}
+	}
+
+	var last int
+	for index := range values {
+		if count[index] == 0 {
+			return 0, fmt.Errorf("The IMA log doesn't match PCR %d", index)
+		}
+		if count[index] > last {
+			last = count[index]
+		}
+	}
+	// Measurements of other PCRs between the last matches
+	// must also have been quoted
+	for index, n := range count {
+		for _, m := range measurements[n:last] {
+			if m.PCR == index {
+				return 0, fmt.Errorf("The IMA log doesn't match PCR %d", index)
+			}
+		}
+	}
+	return last, nil
+}
+
+/*
+	parseAllowlist parses the allowlist @data, in the
+	sha256sum format, to the allowed digests by path.
+*/
+func parseAllowlist(data []byte) (map[string][][]byte, error) {
+	var allowlist = make(map[string][][]byte)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid allowlist line %d", n)
+		}
+		digest, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid allowlist line %d: %v", n, err)
+		}
+		// sha256sum separates binary files with " *"
+		path := strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		allowlist[path] = append(allowlist[path], digest)
+	}
+	return allowlist, scanner.Err()
+}
+
+/*
+	CheckIMALog replays the IMA log of the attestation data
+	@encodedpp against its PCRs, and matches the measured files
+	against @allowlist, as described above. The PCRs must have
+	been checked against the quotes before, e.g. with Verify.
+	The boot_aggregate measurement, of the boot PCRs, is
+	always allowed.
+*/
+func CheckIMALog(encodedpp, allowlist []byte) (*IMAReport, error) {
+	var pp struct {
+		attest.PlatformParameters
+		IMALog []byte
+	}
+	var report IMAReport
+
+	if err := cbor.Unmarshal(encodedpp, &pp); err != nil {
+		return nil, err
+	}
+	allowed, err := parseAllowlist(allowlist)
+	if err != nil {
+		return nil, err
+	}
+	if len(pp.IMALog) == 0 {
+		return nil, errors.New("The attester didn't send its IMA log")
+	}
+	measurements, err := parseIMALog(pp.IMALog)
+	if err != nil {
+		return nil, err
+	}
+	report.MeasurementCount, err = replayIMALog(measurements, pp.PCRs)
+	if err != nil {
+		report.ReplayError = err.Error()
+	}
+	report.Replayed = err == nil
+
+	for _, m := range measurements[:report.MeasurementCount] {
+		var status string
+		digests, ok := allowed[m.Path]
+		switch {
+		case m.violation():
+			status = IMA_VIOLATION
+		case m.Path == "boot_aggregate":
+			continue
+		case !ok:
+			status = IMA_UNKNOWN
+		case !containsDigest(digestsOf(digests), m.Digest):
+			status = IMA_MISMATCH
+		default:
+			continue
+		}
+		report.entries = append(report.entries, &IMAEntry{m.PCR, m.Template, m.Path, m.Digest, status})
+	}
+	report.Valid = report.Replayed && len(report.entries) == 0
+	return &report, nil
+}
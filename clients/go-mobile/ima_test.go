@@ -0,0 +1,229 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+)
+
+/*
+	testMeasurement is a measurement of the IMA logs built by imaLog.
+*/
+type testMeasurement struct {
+	template  string // "ima-ng" or "ima"
+	path      string
+	content   string // Content of the measured file
+	violation bool
+}
+
+func field(b []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+/*
+	imaLog returns the binary IMA log of @measurements in PCR 10,
+	and the values of PCR 10 in the SHA1 and SHA256 banks after
+	each measurement.
+*/
+func imaLog(measurements []testMeasurement) ([]byte, [][]byte, [][]byte) {
+	var log []byte
+	var sha1Values, sha256Values [][]byte
+	var pcr1, pcr256 = make([]byte, sha1.Size), make([]byte, sha256.Size)
+
+	for _, m := range measurements {
+		var data, entry []byte
+		if m.template == "ima" {
+			digest := sha1.Sum([]byte(m.content))
+			entry = append(digest[:], field([]byte(m.path))...)
+			data = entry
+		} else {
+			digest := sha256.Sum256([]byte(m.content))
+			data = append(field(append([]byte("sha256:\x00"), digest[:]...)), field([]byte(m.path + "\x00"))...)
+			entry = field(data)
+		}
+		templateDigest := sha1.Sum(data)
+		extended1, extended256 := templateDigest[:], sha256.Sum256(data)
+		if m.violation {
+			templateDigest = [sha1.Size]byte{}
+			extended1 = bytes.Repeat([]byte{0xff}, sha1.Size)
+			copy(extended256[:], bytes.Repeat([]byte{0xff}, sha256.Size))
+		}
+
+		log = binary.LittleEndian.AppendUint32(log, 10)
+		log = append(log, templateDigest[:]...)
+		log = append(log, field([]byte(m.template))...)
+		log = append(log, entry...)
+
+		h1 := sha1.Sum(append(pcr1, extended1...))
+		h256 := sha256.Sum256(append(pcr256, extended256[:]...))
+		pcr1, pcr256 = h1[:], h256[:]
+		sha1Values, sha256Values = append(sha1Values, pcr1), append(sha256Values, pcr256)
+	}
+	return log, sha1Values, sha256Values
+}
+
+var testMeasurements = []testMeasurement{
+	{"ima-ng", "boot_aggregate", "boot", false},
+	{"ima-ng", "/usr/bin/bash", "bash", false},
+	{"ima-ng", "/usr/lib/libc.so.6", "libc", false},
+	{"ima-ng", "/var/log/journal", "", true},
+	{"ima-ng", "/usr/local/bin/tool", "tool", false},
+}
+
+func TestReplayIMALog(t *testing.T) {
+	var legacy = []testMeasurement{{"ima", "boot_aggregate", "boot", false}, {"ima", "/usr/bin/bash", "bash", false}}
+	log, sha1Values, sha256Values := imaLog(testMeasurements)
+	legacyLog, legacySHA1, legacySHA256 := imaLog(legacy)
+	var pcr = func(hash crypto.Hash, value []byte) attest.PCR {
+		return attest.PCR{Index: 10, Digest: value, DigestAlg: hash}
+	}
+
+	var cases = []struct {
+		log   []byte
+		pcrs  []attest.PCR
+		count int
+		err   string
+		name  string
+	}{
+		{log, []attest.PCR{pcr(crypto.SHA256, sha256Values[4])}, 5, "", "SHA256 bank"},
+		{log, []attest.PCR{pcr(crypto.SHA1, sha1Values[4])}, 5, "", "SHA1 bank"},
+		{log, []attest.PCR{pcr(crypto.SHA1, sha1Values[0]), pcr(crypto.SHA256, sha256Values[4])}, 5, "", "SHA256 bank preferred"},
+		{log, []attest.PCR{pcr(crypto.SHA256, sha256Values[2])}, 3, "", "Measurements after the quote"},
+		{log, []attest.PCR{pcr(crypto.SHA256, sha256Values[3])}, 4, "", "Violation before the quote"},
+		{legacyLog, []attest.PCR{pcr(crypto.SHA1, legacySHA1[1])}, 2, "", "ima template in the SHA1 bank"},
+		{legacyLog, []attest.PCR{pcr(crypto.SHA256, legacySHA256[1])}, 0, "only be replayed against SHA1", "ima template in the SHA256 bank"},
+		{log, []attest.PCR{pcr(crypto.SHA256, sha1Values[4])}, 0, "doesn't match PCR 10", "Wrong PCR value"},
+		{log, []attest.PCR{{Index: 11, Digest: sha256Values[4], DigestAlg: crypto.SHA256}}, 0, "hasn't been quoted", "Unquoted PCR"},
+		{log, []attest.PCR{pcr(crypto.SHA384, sha256Values[4])}, 0, "unsupported bank", "SHA384 bank"},
+	}
+
+	for _, c := range cases {
+		measurements, err := parseIMALog(c.log)
+		if err != nil {
+			t.Fatalf("[%s]: %v", c.name, err)
+		}
+		count, err := replayIMALog(measurements, c.pcrs)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("[%s]: expected error %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil || count != c.count {
+			t.Errorf("[%s]: expected %d measurements, got %d (%v)", c.name, c.count, count, err)
+		}
+	}
+}
+
+func TestParseIMALog(t *testing.T) {
+	log, _, _ := imaLog(testMeasurements)
+	measurements, err := parseIMALog(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(measurements) != len(testMeasurements) {
+		t.Fatalf("Expected %d measurements, got %d", len(testMeasurements), len(measurements))
+	}
+	bash := sha256.Sum256([]byte("bash"))
+	if m := measurements[1]; m.PCR != 10 || m.Template != "ima-ng" || m.Path != "/usr/bin/bash" || !bytes.Equal(m.Digest, bash[:]) || m.violation() {
+		t.Errorf("Unexpected measurement %+v", *m)
+	}
+	if !measurements[3].violation() {
+		t.Errorf("The violation hasn't been detected")
+	}
+
+	for _, n := range []int{1, 27, 40, len(log) - 1} {
+		if _, err := parseIMALog(log[:n]); err == nil {
+			t.Errorf("An IMA log truncated to %d bytes must be refused", n)
+		}
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	var bash, libc = sha256.Sum256([]byte("bash")), sha256.Sum256([]byte("libc"))
+	allowlist, err := parseAllowlist([]byte(fmt.Sprintf(`
+# Debian 12
+%x  /usr/bin/bash
+%x *%s
+
+   %x  /usr/lib/file with spaces
+`, bash, libc, "/usr/lib/libc.so.6", bash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowlist) != 3 || len(allowlist["/usr/bin/bash"]) != 1 || !bytes.Equal(allowlist["/usr/lib/libc.so.6"][0], libc[:]) || allowlist["/usr/lib/file with spaces"] == nil {
+		t.Errorf("Unexpected allowlist %v", allowlist)
+	}
+
+	allowlist, _ = parseAllowlist([]byte(fmt.Sprintf("%x  /usr/bin/bash\n%x  /usr/bin/bash\n", bash, libc)))
+	if len(allowlist["/usr/bin/bash"]) != 2 {
+		t.Errorf("A file may have many allowed digests")
+	}
+
+	for _, invalid := range []string{"/usr/bin/bash", "0g  /usr/bin/bash", "\n\nabc  /usr/bin/bash"} {
+		if _, err := parseAllowlist([]byte(invalid)); err == nil {
+			t.Errorf("%q must be refused", invalid)
+		}
+	}
+}
+
+func TestCheckIMALog(t *testing.T) {
+	log, _, sha256Values := imaLog(testMeasurements)
+	var bash, libc, tool = sha256.Sum256([]byte("bash")), sha256.Sum256([]byte("libc")), sha256.Sum256([]byte("tool"))
+	var encode = func(pcr []byte, log []byte) []byte {
+		encoded, err := cbor.Marshal(struct {
+			attest.PlatformParameters
+			IMALog []byte
+		}{attest.PlatformParameters{PCRs: []attest.PCR{{Index: 10, Digest: pcr, DigestAlg: crypto.SHA256}}}, log})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+
+	var cases = []struct {
+		pp        []byte
+		allowlist string
+		valid     bool
+		entries   []string
+		name      string
+	}{
+		{encode(sha256Values[2], log), fmt.Sprintf("%x  /usr/bin/bash\n%x  /usr/lib/libc.so.6\n", bash, libc), true, nil, "Allowed files"},
+		{encode(sha256Values[2], log), fmt.Sprintf("%x  /usr/bin/bash\n%x  /usr/lib/libc.so.6\n", bash, bash), false, []string{IMA_MISMATCH}, "Other digest"},
+		{encode(sha256Values[2], log), fmt.Sprintf("%x  /usr/bin/bash\n", bash), false, []string{IMA_UNKNOWN}, "Unknown file"},
+		{encode(sha256Values[4], log), fmt.Sprintf("%x  /usr/bin/bash\n%x  /usr/lib/libc.so.6\n%x  /usr/local/bin/tool\n", bash, libc, tool), false, []string{IMA_VIOLATION}, "Violation"},
+		{encode(make([]byte, sha256.Size), log), "", false, nil, "Wrong PCR value"},
+	}
+
+	for _, c := range cases {
+		report, err := CheckIMALog(c.pp, []byte(c.allowlist))
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		if report.Valid != c.valid || report.EntryCount() != len(c.entries) {
+			t.Errorf("[%s]: unexpected report %+v", c.name, *report)
+			continue
+		}
+		for i, status := range c.entries {
+			if report.Entry(i).Status != status {
+				t.Errorf("[%s]: expected %s, got %+v", c.name, status, *report.Entry(i))
+			}
+		}
+	}
+
+	if _, err := CheckIMALog(encode(sha256Values[4], nil), nil); err == nil {
+		t.Errorf("A missing IMA log must be refused")
+	}
+}
@@ -0,0 +1,443 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file verifies event logs against signed reference
+	manifests: the digests of the events expected in some PCRs for
+	a given OS image, as computed by its build pipeline from e.g.
+	its shim and UKI, instead of the values seen on enrollment.
+
+	Manifests are COSE_Sign1 messages (RFC 9052), signed with ES256,
+	ES384 or PS256. Their payload is either a JSON document:
+
+	{
+		"name": "debian-12",
+		"version": "2023.10.1",
+		"pcrs": {"4": ["<hex>", "<hex>"], "11": ["<hex>"]}
+	}
+
+	or an unsigned CoRIM (draft-ietf-rats-corim), whose CoMIDs
+	reference values have the PCR index as measurement key and
+	the allowed SHA256 event digests as digests.
+*/
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+)
+
+// COSE algorithms, from the IANA registry
+const (
+	coseES256 = -7
+	coseES384 = -35
+	cosePS256 = -37
+)
+
+// CBOR tags of the CoRIM specification
+const (
+	corimTag = 501
+	comidTag = 506
+)
+
+// Hash algorithm of CoRIM digests, from the IANA Named Information registry
+const namedInfoSHA256 = 1
+
+/*
+	referenceManifest is a verified reference manifest,
+	as described above.
+*/
+type referenceManifest struct {
+	Name    string              `json:"name"`
+	Version string              `json:"version"`
+	PCRs    map[int][]hexDigest `json:"pcrs"`
+}
+
+/*
+	ManifestMismatch describes an event of a PCR covered by
+	the manifest, whose digest isn't listed in the manifest.
+*/
+type ManifestMismatch struct {
+	PCR         int
+	Type        string
+	Description string
+	Digest      []byte
+}
+
+/*
+	ManifestReport is the result of CheckManifest.
+*/
+type ManifestReport struct {
+	Valid      bool   // All the PCRs covered by the manifest were sent, and their events are listed
+	Name       string // Name of the OS image, from the manifest
+	Version    string
+	mismatches []*ManifestMismatch
+	missing    []int
+}
+
+/*
+	MismatchCount returns the number of events
+	that aren't listed in the manifest.
+*/
+func (r *ManifestReport) MismatchCount() int {
+	return len(r.mismatches)
+}
+
+/*
+	Mismatch returns the @i-th event that isn't listed
+	in the manifest, or nil if @i is out of range.
+*/
+func (r *ManifestReport) Mismatch(i int) *ManifestMismatch {
+	if i < 0 || i >= len(r.mismatches) {
+		return nil
+	}
+	return r.mismatches[i]
+}
+
+/*
+	MissingPCRCount returns the number of PCRs covered by the
+	manifest that the attester didn't send: their events
+	can't be trusted, so they aren't checked.
+*/
+func (r *ManifestReport) MissingPCRCount() int {
+	return len(r.missing)
+}
+
+/*
+	MissingPCR returns the index of the @i-th PCR covered by the
+	manifest that wasn't sent, or -1 if @i is out of range.
+*/
+func (r *ManifestReport) MissingPCR(i int) int {
+	if i < 0 || i >= len(r.missing) {
+		return -1
+	}
+	return r.missing[i]
+}
+
+/*
+	parsePublicKey parses the PEM public key, or
+	certificate, @data of a manifest signer.
+*/
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("The manifest key isn't PEM encoded")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+/*
+	verifyCOSESign1 verifies that the COSE_Sign1 message
+	@msg is signed by @key, and returns its payload.
+*/
+func verifyCOSESign1(msg []byte, key crypto.PublicKey) ([]byte, error) {
+	var sign1 struct {
+		_           struct{} `cbor:",toarray"`
+		Protected   []byte
+		Unprotected cbor.RawMessage
+		Payload     []byte
+		Signature   []byte
+	}
+	var headers map[int]interface{}
+
+	// The COSE_Sign1 tag is optional
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(msg, &tag); err == nil {
+		msg = tag.Content
+	}
+	if err := cbor.Unmarshal(msg, &sign1); err != nil {
+		return nil, fmt.Errorf("Invalid COSE_Sign1 message: %v", err)
+	}
+	if err := cbor.Unmarshal(sign1.Protected, &headers); err != nil {
+		return nil, fmt.Errorf("Invalid COSE protected headers: %v", err)
+	}
+	alg, _ := headers[1].(int64)
+
+	tbs, err := cbor.Marshal([]interface{}{"Signature1", sign1.Protected, []byte{}, sign1.Payload})
+	if err != nil {
+		return nil, err
+	}
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch alg {
+		case coseES256:
+			h := sha256.Sum256(tbs)
+			digest = h[:]
+		case coseES384:
+			h := sha512.Sum384(tbs)
+			digest = h[:]
+		default:
+			return nil, fmt.Errorf("Unsupported COSE algorithm %d for an ECDSA key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sign1.Signature) != 2 * size {
+			return nil, errors.New("Invalid manifest signature")
+		}
+		r := new(big.Int).SetBytes(sign1.Signature[:size])
+		s := new(big.Int).SetBytes(sign1.Signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return nil, errors.New("Invalid manifest signature")
+		}
+	case *rsa.PublicKey:
+		if alg != cosePS256 {
+			return nil, fmt.Errorf("Unsupported COSE algorithm %d for an RSA key", alg)
+		}
+		h := sha256.Sum256(tbs)
+		if err := rsa.VerifyPSS(pub, crypto.SHA256, h[:], sign1.Signature, nil); err != nil {
+			return nil, errors.New("Invalid manifest signature")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported manifest key type: %T", key)
+	}
+	return sign1.Payload, nil
+}
+
+/*
+	parseCoMID adds the reference values of the
+	CoMID @data to @manifest.
+*/
+func parseCoMID(data []byte, manifest *referenceManifest) error {
+	var comid map[int]cbor.RawMessage
+	var identity map[int]interface{}
+	var triples map[int]cbor.RawMessage
+	var references []struct {
+		_            struct{} `cbor:",toarray"`
+		Environment  cbor.RawMessage
+		Measurements []map[int]cbor.RawMessage
+	}
+
+	if err := cbor.Unmarshal(data, &comid); err != nil {
+		return err
+	}
+	if err := cbor.Unmarshal(comid[1], &identity); err == nil && manifest.Version == "" {
+		if version, ok := identity[1].(uint64); ok {
+			manifest.Version = strconv.FormatUint(version, 10)
+		}
+	}
+	if err := cbor.Unmarshal(comid[4], &triples); err != nil {
+		return fmt.Errorf("Invalid CoMID triples: %v", err)
+	}
+	if triples[0] == nil {
+		return nil
+	}
+	if err := cbor.Unmarshal(triples[0], &references); err != nil {
+		return fmt.Errorf("Invalid CoMID reference values: %v", err)
+	}
+	for _, ref := range references {
+		for _, m := range ref.Measurements {
+			var pcr uint64
+			var values map[int]cbor.RawMessage
+			var digests []struct {
+				_      struct{} `cbor:",toarray"`
+				Alg    int
+				Digest []byte
+			}
+			if err := cbor.Unmarshal(m[0], &pcr); err != nil || pcr >= PCR_COUNT {
+				return errors.New("Invalid CoMID measurement key: a PCR index is expected")
+			}
+			if err := cbor.Unmarshal(m[1], &values); err != nil {
+				return fmt.Errorf("Invalid CoMID measurement values: %v", err)
+			}
+			if values[2] == nil {
+				continue
+			}
+			if err := cbor.Unmarshal(values[2], &digests); err != nil {
+				return fmt.Errorf("Invalid CoMID digests: %v", err)
+			}
+			for _, d := range digests {
+				if d.Alg == namedInfoSHA256 {
+					manifest.PCRs[int(pcr)] = append(manifest.PCRs[int(pcr)], d.Digest)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+	parseCoRIM returns the reference manifest
+	described by the unsigned CoRIM @tag.
+*/
+func parseCoRIM(tag cbor.RawTag) (*referenceManifest, error) {
+	var corim map[int]cbor.RawMessage
+	var tags []cbor.RawTag
+	var manifest = referenceManifest{PCRs: make(map[int][]hexDigest)}
+
+	if err := cbor.Unmarshal(tag.Content, &corim); err != nil {
+		return nil, fmt.Errorf("Invalid CoRIM: %v", err)
+	}
+	// The CoRIM ID is either a string or an UUID
+	if err := cbor.Unmarshal(corim[0], &manifest.Name); err != nil {
+		var uuid cbor.RawTag
+		if err = cbor.Unmarshal(corim[0], &uuid); err == nil {
+			var id []byte
+			cbor.Unmarshal(uuid.Content, &id)
+			manifest.Name = fmt.Sprintf("%x", id)
+		}
+	}
+	if err := cbor.Unmarshal(corim[1], &tags); err != nil {
+		return nil, fmt.Errorf("Invalid CoRIM tags: %v", err)
+	}
+	for _, t := range tags {
+		var comid []byte
+		if t.Number != comidTag {
+			continue
+		}
+		if err := cbor.Unmarshal(t.Content, &comid); err != nil {
+			return nil, fmt.Errorf("Invalid CoMID: %v", err)
+		}
+		if err := parseCoMID(comid, &manifest); err != nil {
+			return nil, err
+		}
+	}
+	return &manifest, nil
+}
+
+/*
+	parseManifest verifies the signature of the manifest
+	@signed with the PEM encoded @key, and parses it.
+*/
+func parseManifest(signed, key []byte) (*referenceManifest, error) {
+	var manifest referenceManifest
+	var tag cbor.RawTag
+
+	pub, err := parsePublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := verifyCOSESign1(signed, pub)
+	if err != nil {
+		return nil, err
+	}
+	if err = cbor.Unmarshal(payload, &tag); err == nil && tag.Number == corimTag {
+		m, err := parseCoRIM(tag)
+		if err == nil && len(m.PCRs) == 0 {
+			err = errors.New("Invalid manifest: no PCR is covered")
+		}
+		return m, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest: %v", err)
+	}
+	if len(manifest.PCRs) == 0 {
+		return nil, errors.New("Invalid manifest: no PCR is covered")
+	}
+	for pcr := range manifest.PCRs {
+		if pcr < 0 || pcr >= PCR_COUNT {
+			return nil, fmt.Errorf("Invalid manifest: invalid PCR index %d", pcr)
+		}
+	}
+	return &manifest, nil
+}
+
+/*
+	missingPCRs returns the sorted indexes of the PCRs covered by
+	@m that aren't in the SHA256 PCRs of @pcrs. The event log is
+	only replayed against the PCRs sent, so the events of the
+	others would be checked without being trusted.
+*/
+func (m *referenceManifest) missingPCRs(pcrs []attest.PCR) []int {
+	var sent = make(map[int]bool)
+	var missing []int
+
+	for _, pcr := range pcrs {
+		if pcr.DigestAlg == crypto.SHA256 {
+			sent[pcr.Index] = true
+		}
+	}
+	for index := 0; index < PCR_COUNT; index++ {
+		if _, covered := m.PCRs[index]; covered && !sent[index] {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+/*
+	checkEvents returns the events of @events, in the PCRs
+	covered by @m, whose digest isn't listed in @m.
+	Separators are not measurements, and are always allowed.
+*/
+func (m *referenceManifest) checkEvents(events []attest.Event) []*ManifestMismatch {
+	var mismatches []*ManifestMismatch
+
+	for _, e := range events {
+		allowed, covered := m.PCRs[e.Index]
+		if !covered || containsDigest(allowed, e.Digest) {
+			continue
+		}
+		if e.Type == evSeparator && bytes.Equal(e.Data, []byte{0, 0, 0, 0}) {
+			continue
+		}
+		mismatches = append(mismatches, &ManifestMismatch{
+			PCR:         e.Index,
+			Type:        e.Type.String(),
+			Description: describeEvent(uint32(e.Type), e.Data),
+			Digest:      e.Digest,
+		})
+	}
+	return mismatches
+}
+
+/*
+	CheckManifest verifies the signature of the reference manifest
+	@signed with the PEM encoded public key or certificate @key,
+	and checks the event log of the attestation data @encodedpp
+	against it. The event log is replayed against the SHA256 PCRs,
+	which must have been checked against the quotes before, e.g.
+	with Verify. The report is invalid if a PCR covered by the
+	manifest wasn't sent.
+*/
+func CheckManifest(encodedpp, signed, key []byte) (*ManifestReport, error) {
+	var pp attest.PlatformParameters
+
+	manifest, err := parseManifest(signed, key)
+	if err != nil {
+		return nil, err
+	}
+	if err = cbor.Unmarshal(encodedpp, &pp); err != nil {
+		return nil, err
+	}
+	el, err := attest.ParseEventLog(pp.EventLog)
+	if err != nil {
+		return nil, err
+	}
+	events, err := verifiedEvents(el, pp.PCRs)
+	if err != nil {
+		return nil, err
+	}
+	mismatches := manifest.checkEvents(events)
+	missing := manifest.missingPCRs(pp.PCRs)
+	return &ManifestReport{
+		Valid:      len(mismatches) == 0 && len(missing) == 0,
+		Name:       manifest.Name,
+		Version:    manifest.Version,
+		mismatches: mismatches,
+		missing:    missing,
+	}, nil
+}
@@ -0,0 +1,205 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+/*
+	signCOSE returns the COSE_Sign1 message of @payload,
+	signed by @key with the COSE algorithm @alg.
+*/
+func signCOSE(t *testing.T, payload []byte, key crypto.Signer, alg int) []byte {
+	protected, err := cbor.Marshal(map[int]int{1: alg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs, err := cbor.Marshal([]interface{}{"Signature1", protected, []byte{}, payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if k.Curve == elliptic.P384() {
+			h := sha512.Sum384(tbs)
+			digest = h[:]
+		} else {
+			h := sha256.Sum256(tbs)
+			digest = h[:]
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2 * size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	case *rsa.PrivateKey:
+		h := sha256.Sum256(tbs)
+		if sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, h[:], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, err := cbor.Marshal(cbor.Tag{Number: 18, Content: []interface{}{protected, map[int]interface{}{}, payload, sig}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func publicKeyPEM(t *testing.T, key crypto.Signer) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+/*
+	jsonManifest returns the JSON manifest payload
+	allowing @pcrs, SHA256 event digests by PCR.
+*/
+func jsonManifest(pcrs map[int][][]byte) []byte {
+	var entries []string
+	for index, digests := range pcrs {
+		var hexes []string
+		for _, d := range digests {
+			hexes = append(hexes, fmt.Sprintf("%q", hex.EncodeToString(d)))
+		}
+		entries = append(entries, fmt.Sprintf("%q: [%s]", fmt.Sprint(index), strings.Join(hexes, ", ")))
+	}
+	return []byte(fmt.Sprintf(`{"name": "debian-12", "version": "2023.10.1", "pcrs": {%s}}`, strings.Join(entries, ", ")))
+}
+
+/*
+	corimManifest returns the CoRIM manifest payload
+	allowing @pcrs, SHA256 event digests by PCR.
+*/
+func corimManifest(t *testing.T, pcrs map[int][][]byte) []byte {
+	var measurements []interface{}
+	for index, digests := range pcrs {
+		var values []interface{}
+		for _, d := range digests {
+			values = append(values, []interface{}{namedInfoSHA256, d})
+		}
+		measurements = append(measurements, map[int]interface{}{0: index, 1: map[int]interface{}{2: values}})
+	}
+	comid, err := cbor.Marshal(map[int]interface{}{
+		1: map[int]interface{}{0: "ultrablue", 1: 3},
+		4: map[int]interface{}{0: []interface{}{[]interface{}{map[int]interface{}{}, measurements}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corim, err := cbor.Marshal(cbor.Tag{Number: corimTag, Content: map[int]interface{}{
+		0: "debian-12",
+		1: []interface{}{cbor.Tag{Number: comidTag, Content: comid}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return corim
+}
+
+func TestCheckManifest(t *testing.T) {
+	var events = []testEvent{
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\debian\shimx64.efi`)},
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\Linux\debian.efi`)},
+		{pcr: 4, typ: evSeparator, data: []byte{0, 0, 0, 0}},
+		{pcr: 11, typ: evIPL, data: []byte(".linux\x00")},
+	}
+	var digest = func(i int) []byte {
+		h := sha256.Sum256(events[i].data)
+		return h[:]
+	}
+	log, pcrs := buildEventLog(t, events)
+	pp := encodePlatform(t, log, pcrs)
+
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherRSA, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var good = map[int][][]byte{4: {digest(0), digest(1)}, 11: {digest(3)}}
+	var oldKernel = map[int][][]byte{4: {digest(0)}, 11: {digest(3)}}
+	var uncovered = map[int][][]byte{4: {digest(0), digest(1)}, 9: {digest(3)}}
+
+	var cases = []struct {
+		name       string
+		signed     []byte
+		key        []byte
+		err        string
+		mismatches int
+		missing    []int
+	}{
+		{"JSON ES256", signCOSE(t, jsonManifest(good), p256, coseES256), publicKeyPEM(t, p256), "", 0, nil},
+		{"JSON PS256", signCOSE(t, jsonManifest(good), rsaKey, cosePS256), publicKeyPEM(t, rsaKey), "", 0, nil},
+		{"CoRIM ES384", signCOSE(t, corimManifest(t, good), p384, coseES384), publicKeyPEM(t, p384), "", 0, nil},
+		{"Unlisted kernel", signCOSE(t, jsonManifest(oldKernel), p256, coseES256), publicKeyPEM(t, p256), "", 1, nil},
+		{"Unlisted kernel in a CoRIM", signCOSE(t, corimManifest(t, oldKernel), p256, coseES256), publicKeyPEM(t, p256), "", 1, nil},
+		{"Uncovered PCR", signCOSE(t, jsonManifest(uncovered), p256, coseES256), publicKeyPEM(t, p256), "", 0, []int{9}},
+		{"Uncovered PCR in a CoRIM", signCOSE(t, corimManifest(t, uncovered), p256, coseES256), publicKeyPEM(t, p256), "", 0, []int{9}},
+		{"No covered PCR", signCOSE(t, jsonManifest(nil), p256, coseES256), publicKeyPEM(t, p256), "no PCR is covered", 0, nil},
+		{"Bad signature", signCOSE(t, jsonManifest(good), other, coseES256), publicKeyPEM(t, p256), "Invalid manifest signature", 0, nil},
+		{"Bad RSA signature", signCOSE(t, jsonManifest(good), otherRSA, cosePS256), publicKeyPEM(t, rsaKey), "Invalid manifest signature", 0, nil},
+		{"RSA signature with an ECDSA key", signCOSE(t, jsonManifest(good), rsaKey, cosePS256), publicKeyPEM(t, other), "Unsupported COSE algorithm", 0, nil},
+		{"ECDSA with an RSA algorithm", signCOSE(t, jsonManifest(good), p256, cosePS256), publicKeyPEM(t, p256), "Unsupported COSE algorithm", 0, nil},
+		{"RSA with an ECDSA algorithm", signCOSE(t, jsonManifest(good), rsaKey, coseES256), publicKeyPEM(t, rsaKey), "Unsupported COSE algorithm", 0, nil},
+		{"ES384 with a P-256 key", signCOSE(t, jsonManifest(good), p384, coseES384), publicKeyPEM(t, p256), "Invalid manifest signature", 0, nil},
+		{"Unencoded key", signCOSE(t, jsonManifest(good), p256, coseES256), []byte("key"), "isn't PEM encoded", 0, nil},
+	}
+
+	for _, c := range cases {
+		report, err := CheckManifest(pp, c.signed, c.key)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("[%s]: expected error %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		if report.Name != "debian-12" {
+			t.Errorf("[%s]: unexpected name %q", c.name, report.Name)
+		}
+		if report.MismatchCount() != c.mismatches || report.MissingPCRCount() != len(c.missing) {
+			t.Errorf("[%s]: expected %d mismatches and %d missing PCRs, got %d and %d", c.name, c.mismatches, len(c.missing), report.MismatchCount(), report.MissingPCRCount())
+			continue
+		}
+		for i, index := range c.missing {
+			if report.MissingPCR(i) != index {
+				t.Errorf("[%s]: expected PCR %d to be missing, got %d", c.name, index, report.MissingPCR(i))
+			}
+		}
+		if valid := c.mismatches == 0 && len(c.missing) == 0; report.Valid != valid {
+			t.Errorf("[%s]: expected valid %v", c.name, valid)
+		}
+		if c.mismatches > 0 && report.Mismatch(0).Description != `Image \EFI\Linux\debian.efi` {
+			t.Errorf("[%s]: unexpected mismatch %+v", c.name, *report.Mismatch(0))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file handles the next states proposed by attesters.
+
+	Before an update of its boot chain, an attester predicts the
+	PCR values of its next boot, and sends them after a successful
+	attestation to the verifiers that ask for them. They are signed
+	with its AK along with the nonce of the attestation, so that
+	they come from the attester that was just trusted:
+
+		"ULTRABLUE NEXT STATE\x00" || nonce || SHA256(index || value || ...)
+
+	with the PCRs sorted by index, encoded as big endian uint32.
+
+	The verifier then stores them in its policy as a next state,
+	allowed for a number of boots that it chooses. Once a boot
+	matches it, the verifier can either promote its values to the
+	policy itself, or let it expire.
+*/
+
+package gomobile
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+)
+
+const nextStateLabel = "ULTRABLUE NEXT STATE\x00"
+
+/*
+	nextState is a state proposed by the attester, as stored
+	in the policies.
+*/
+type nextState struct {
+	PCRs  map[int]hexDigest `json:"pcrs"`  // Expected SHA256 values
+	Boots int               `json:"boots"` // Number of boots it's still allowed for
+}
+
+/*
+	nextStateMessage returns the message signed by the attester
+	to propose the SHA256 @pcrs, during the attestation with @nonce.
+*/
+func nextStateMessage(nonce []byte, pcrs map[int][]byte) []byte {
+	var indexes []int
+	var h = sha256.New()
+
+	for pcr := range pcrs {
+		indexes = append(indexes, pcr)
+	}
+	sort.Ints(indexes)
+	for _, pcr := range indexes {
+		binary.Write(h, binary.BigEndian, uint32(pcr))
+		h.Write(pcrs[pcr])
+	}
+	msg := append([]byte(nextStateLabel), nonce...)
+	return h.Sum(msg)
+}
+
+/*
+	stateReferences returns the allowed values of the PCRs
+	of @p, with the ones of its @i-th next state instead
+	of the allowed values of the PCRs it changes.
+*/
+func (p *policy) stateReferences(i int) map[pcrKey][][]byte {
+	var refs = p.references()
+
+	for index, value := range p.NextStates[i].PCRs {
+		refs[pcrKey{crypto.SHA256, index}] = [][]byte{value}
+	}
+	return refs
+}
+
+/*
+	encodePolicy encodes @p back to JSON.
+*/
+func encodePolicy(p *policy) (*EncodedPolicy, error) {
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return &EncodedPolicy{encoded}, nil
+}
+
+/*
+	AllowNextState verifies the next state @encodedstate, sent after
+	the successful attestation with @nonce by the attester whose
+	attestation key is @encodedap, and adds it to the JSON @policy
+	for @boots boots. Only the PCRs constrained by the policy
+	are kept, the current values of the others are allowed anyway.
+*/
+func AllowNextState(policy, encodedap, encodedstate, nonce []byte, boots int) (*EncodedPolicy, error) {
+	var ap attest.AttestationParameters
+	var state struct {
+		PCRs      map[int][]byte
+		Signature []byte
+	}
+
+	if !isPolicy(policy) {
+		return nil, errors.New("Only JSON policies can be updated")
+	}
+	if boots <= 0 {
+		return nil, errors.New("The next state must be allowed for at least one boot")
+	}
+	p, err := parsePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	if err = cbor.Unmarshal(encodedap, &ap); err != nil {
+		return nil, err
+	}
+	if err = cbor.Unmarshal(encodedstate, &state); err != nil {
+		return nil, err
+	}
+	if len(state.PCRs) == 0 {
+		return nil, errors.New("The attester didn't propose a next state")
+	}
+
+	akpub, err := attest.ParseAKPublic(attest.TPMVersion20, ap.Public)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := akpub.Public.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The attestation key isn't an RSA key")
+	}
+	digest := sha256.Sum256(nextStateMessage(nonce, state.PCRs))
+	if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], state.Signature); err != nil {
+		return nil, errors.New("Invalid next state signature")
+	}
+
+	var next = nextState{PCRs: make(map[int]hexDigest), Boots: boots}
+	for index, value := range state.PCRs {
+		if _, ok := p.PCRs["SHA256"][index]; ok {
+			next.PCRs[index] = value
+		}
+	}
+	if len(next.PCRs) == 0 {
+		return nil, errors.New("The next state doesn't change any PCR of the policy")
+	}
+	p.NextStates = append(p.NextStates, &next)
+	return encodePolicy(p)
+}
+
+/*
+	ConsumeNextState updates the JSON @policy once a boot matched
+	its @i-th next state, as told by VerificationReport.NextState.
+	If @promote is set, the values of the next state are allowed
+	along with the previous values of its PCRs, and the next state
+	is removed: the attester may still boot its previous entry, e.g.
+	if the update is rolled back, and the other next states may have
+	been proposed for other entries. The verifier drops the values
+	that are no longer needed by editing the policy. Otherwise, the
+	next state is allowed for one boot less, and is removed once
+	it's expired.
+*/
+func ConsumeNextState(policy []byte, i int, promote bool) (*EncodedPolicy, error) {
+	p, err := parsePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(p.NextStates) {
+		return nil, errors.New("No such next state")
+	}
+	state := p.NextStates[i]
+	if promote {
+		for index, value := range state.PCRs {
+			if !containsDigest(p.PCRs["SHA256"][index], value) {
+				p.PCRs["SHA256"][index] = append(p.PCRs["SHA256"][index], value)
+			}
+		}
+	}
+	if promote || state.Boots <= 1 {
+		p.NextStates = append(p.NextStates[:i], p.NextStates[i + 1:]...)
+	} else {
+		state.Boots--
+	}
+	return encodePolicy(p)
+}
@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+/*
+	signNextState returns the next state @pcrs,
+	signed by @key for the attestation with @nonce.
+*/
+func signNextState(t *testing.T, key *rsa.PrivateKey, pcrs map[int][]byte, nonce []byte) []byte {
+	encoded, err := cbor.Marshal(struct {
+		PCRs      map[int][]byte
+		Signature []byte
+	}{pcrs, signAK(t, key, nextStateMessage(nonce, pcrs))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestAllowNextState(t *testing.T) {
+	var nonce = []byte("nonce")
+	var value = func(b byte) []byte { return bytes.Repeat([]byte{b}, sha256.Size) }
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ap := encodeAK(t, key)
+	policy := []byte(fmt.Sprintf(`{"pcrs": {"SHA256": {"4": ["%x"], "8": ["%x"]}}}`, value(4), value(8)))
+	next := map[int][]byte{4: value(5), 9: value(9)}
+
+	var cases = []struct {
+		policy []byte
+		state  []byte
+		nonce  []byte
+		boots  int
+		err    string
+		name   string
+	}{
+		{policy, signNextState(t, key, next, nonce), nonce, 2, "", "Valid next state"},
+		{policy, signNextState(t, other, next, nonce), nonce, 2, "Invalid next state signature", "Signed by another key"},
+		{policy, signNextState(t, key, next, []byte("previous")), nonce, 2, "Invalid next state signature", "Wrong nonce"},
+		{policy, signNextState(t, key, map[int][]byte{9: value(9)}, nonce), nonce, 2, "doesn't change any PCR", "Unconstrained PCR"},
+		{policy, signNextState(t, key, map[int][]byte{}, nonce), nonce, 2, "didn't propose", "Empty next state"},
+		{policy, signNextState(t, key, next, nonce), nonce, 0, "at least one boot", "No boot"},
+		{policy, signNextState(t, key, next, nonce), nonce, -1, "at least one boot", "Negative boots"},
+		{nil, signNextState(t, key, next, nonce), nonce, 2, "Only JSON policies", "GetPCRs reference"},
+	}
+
+	for _, c := range cases {
+		encoded, err := AllowNextState(c.policy, ap, c.state, c.nonce, c.boots)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("[%s]: expected error %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		p, err := parsePolicy(encoded.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p.NextStates) != 1 || p.NextStates[0].Boots != c.boots || len(p.NextStates[0].PCRs) != 1 || !bytes.Equal(p.NextStates[0].PCRs[4], value(5)) {
+			t.Errorf("[%s]: unexpected next states %+v", c.name, p.NextStates)
+		}
+	}
+}
+
+func TestConsumeNextState(t *testing.T) {
+	var value = func(b byte) []byte { return bytes.Repeat([]byte{b}, sha256.Size) }
+	policy := []byte(fmt.Sprintf(`{
+		"pcrs": {"SHA256": {"4": ["%x"], "8": ["%x"]}},
+		"next_states": [{"pcrs": {"4": "%x"}, "boots": 2}, {"pcrs": {"4": "%x", "8": "%x"}, "boots": 1}]
+	}`, value(4), value(8), value(5), value(6), value(9)))
+
+	var cases = []struct {
+		state   int
+		promote bool
+		pcr4    [][]byte
+		boots   []int
+		name    string
+	}{
+		{0, false, [][]byte{value(4)}, []int{1, 1}, "Counted boot"},
+		{1, false, [][]byte{value(4)}, []int{2}, "Expired next state"},
+		{0, true, [][]byte{value(4), value(5)}, []int{1}, "Promoted next state"},
+		{1, true, [][]byte{value(4), value(6)}, []int{2}, "Promoted next state of many PCRs"},
+	}
+
+	for _, c := range cases {
+		encoded, err := ConsumeNextState(policy, c.state, c.promote)
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		p, err := parsePolicy(encoded.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(p.PCRs["SHA256"][4]) != fmt.Sprint(digestsOf(c.pcr4)) {
+			t.Errorf("[%s]: expected PCR 4 values %x, got %x", c.name, c.pcr4, p.PCRs["SHA256"][4])
+		}
+		var boots []int
+		for _, state := range p.NextStates {
+			boots = append(boots, state.Boots)
+		}
+		if fmt.Sprint(boots) != fmt.Sprint(c.boots) {
+			t.Errorf("[%s]: expected next states allowed for %v boots, got %v", c.name, c.boots, boots)
+		}
+		if c.promote && c.state == 1 && len(p.PCRs["SHA256"][8]) != 2 {
+			t.Errorf("[%s]: all the PCRs of the next state must be promoted", c.name)
+		}
+	}
+
+	for _, i := range []int{-1, 2} {
+		if _, err := ConsumeNextState(policy, i, false); err == nil {
+			t.Errorf("Next state %d doesn't exist", i)
+		}
+	}
+}
+
+func TestVerifyNextState(t *testing.T) {
+	var nonce = []byte("nonce")
+	var value = func(b byte) []byte { return bytes.Repeat([]byte{b}, sha256.Size) }
+	ap, pp, pcrs := attestation(t, testEvents, nonce)
+	pcr0, pcr4 := pcrValue(pcrs, crypto.SHA256, 0), pcrValue(pcrs, crypto.SHA256, 4)
+
+	var cases = []struct {
+		policy    string
+		valid     bool
+		nextState int
+		name      string
+	}{
+		{fmt.Sprintf(`{"pcrs": {"SHA256": {"0": ["%x"], "4": ["%x"]}}, "next_states": [{"pcrs": {"4": "%x"}, "boots": 1}]}`, pcr0, pcr4, value(1)), true, -1, "Current state"},
+		{fmt.Sprintf(`{"pcrs": {"SHA256": {"0": ["%x"], "4": ["%x"]}}, "next_states": [{"pcrs": {"4": "%x"}, "boots": 1}, {"pcrs": {"4": "%x"}, "boots": 1}]}`, pcr0, value(4), value(1), pcr4), true, 1, "Next state"},
+		{fmt.Sprintf(`{"pcrs": {"SHA256": {"0": ["%x"], "4": ["%x"]}}, "next_states": [{"pcrs": {"4": "%x"}, "boots": 1}]}`, value(0), value(4), pcr4), false, -1, "Next state with another PCR mismatching"},
+		{fmt.Sprintf(`{"pcrs": {"SHA256": {"0": ["%x"], "4": ["%x"]}}, "next_states": [{"pcrs": {"4": "%x"}, "boots": 1}]}`, pcr0, value(4), value(1)), false, -1, "Unknown state"},
+	}
+
+	for _, c := range cases {
+		report, err := Verify(ap, pp, nonce, []byte(c.policy))
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		if report.Valid != c.valid || report.NextState != c.nextState {
+			t.Errorf("[%s]: expected valid %v and next state %d, got %v and %d (%v)", c.name, c.valid, c.nextState, report.Valid, report.NextState, report.policyErrors)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file evaluates the attestation policies of the verifiers.
+
+	Instead of requiring the PCRs to keep their enrollment values,
+	a policy states what an attester may boot, so that it can be
+	updated without being enrolled again. Policies are JSON
+	documents, e.g.:
+
+	{
+		"pcrs": {"SHA256": {"0": ["<hex>"], "2": ["<hex>", "<hex>"]}},
+		"secure_boot": true,
+		"dbx": {"min_version": 217, "revoked": ["<hex>"]},
+		"authorities": ["CN=Microsoft Corporation UEFI CA 2011,O=Microsoft Corporation,L=Redmond,ST=Washington,C=US"],
+		"boot_loaders": ["<hex>"],
+		"kernels": ["<hex>", "<hex>"],
+		"firmware": {"min": "1.14.0", "max": "1.20"},
+		"next_states": [{"pcrs": {"4": "<hex>", "9": "<hex>"}, "boots": 3}]
+	}
+
+	All the rules are optional. Except for "pcrs" and "next_states",
+	they are checked against the events of the event log, which must
+	have been replayed successfully. "next_states" are proposed by the
+	attester before an update, see nextstate.go.
+*/
+
+package gomobile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-attestation/attest"
+)
+
+/*
+	hexDigest is a digest written in hexadecimal in policies.
+*/
+type hexDigest []byte
+
+func (d *hexDigest) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("Invalid digest %q: %v", text, err)
+	}
+	*d = b
+	return nil
+}
+
+func (d hexDigest) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(d)), nil
+}
+
+func digestsOf(b [][]byte) []hexDigest {
+	var digests = make([]hexDigest, len(b))
+	for i := range b {
+		digests[i] = b[i]
+	}
+	return digests
+}
+
+func containsDigest(digests []hexDigest, d []byte) bool {
+	for _, digest := range digests {
+		if bytes.Equal(digest, d) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	policy is an attestation policy, as described above.
+*/
+type policy struct {
+	// Allowed values of PCRs, by bank and index
+	PCRs map[string]map[int][]hexDigest `json:"pcrs,omitempty"`
+	// Secure Boot must be enabled
+	SecureBoot bool `json:"secure_boot,omitempty"`
+	DBX        *struct {
+		// Minimum number of entries of the dbx, as fwupd counts its version
+		MinVersion int `json:"min_version,omitempty"`
+		// Digests that must be in the dbx
+		Revoked []hexDigest `json:"revoked,omitempty"`
+	} `json:"dbx,omitempty"`
+	// Subjects of the certificates allowed to verify the loaded images
+	Authorities []string `json:"authorities,omitempty"`
+	// Authenticode SHA256 digests of the allowed boot loaders, i.e. the
+	// boot applications of PCR4 but the kernel, see kernelIndex
+	BootLoaders []hexDigest `json:"boot_loaders,omitempty"`
+	// Authenticode SHA256 digests of the allowed kernels or UKIs
+	Kernels []hexDigest `json:"kernels,omitempty"`
+	// Range of the firmware version, from the EV_S_CRTM_VERSION event
+	Firmware *struct {
+		Min string `json:"min,omitempty"`
+		Max string `json:"max,omitempty"`
+	} `json:"firmware,omitempty"`
+	// SHA256 PCR values proposed by the attester for its next boots
+	NextStates []*nextState `json:"next_states,omitempty"`
+}
+
+/*
+	Policies are returned encoded to JSON, as gobind
+	can't return complex types.
+*/
+type EncodedPolicy struct {
+	Data []byte
+}
+
+/*
+	parsePolicy decodes and checks the JSON policy @data.
+*/
+func parsePolicy(data []byte) (*policy, error) {
+	var p policy
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("Invalid policy: %v", err)
+	}
+	for bank, pcrs := range p.PCRs {
+		if _, ok := pcrBanks[bank]; !ok {
+			return nil, errors.New("Invalid policy: unsupported PCR bank " + bank)
+		}
+		for index := range pcrs {
+			if index < 0 || index >= PCR_COUNT {
+				return nil, fmt.Errorf("Invalid policy: invalid PCR index %d", index)
+			}
+		}
+	}
+	for _, state := range p.NextStates {
+		for index := range state.PCRs {
+			if _, ok := p.PCRs["SHA256"][index]; !ok {
+				return nil, fmt.Errorf("Invalid policy: next state of PCR %d, which isn't constrained", index)
+			}
+		}
+	}
+	return &p, nil
+}
+
+/*
+	isPolicy returns whether @data is a JSON policy, rather
+	than reference PCRs encoded by GetPCRs to CBOR.
+*/
+func isPolicy(data []byte) bool {
+	return len(bytes.TrimSpace(data)) > 0 && bytes.TrimSpace(data)[0] == '{'
+}
+
+/*
+	references returns the allowed values of the PCRs of @p.
+*/
+func (p *policy) references() map[pcrKey][][]byte {
+	var refs = make(map[pcrKey][][]byte)
+
+	for bank, pcrs := range p.PCRs {
+		for index, allowed := range pcrs {
+			k := pcrKey{pcrBanks[bank], index}
+			for _, digest := range allowed {
+				refs[k] = append(refs[k], digest)
+			}
+		}
+	}
+	return refs
+}
+
+/*
+	needsEvents returns whether @p has rules
+	checked against the event log.
+*/
+func (p *policy) needsEvents() bool {
+	return p.SecureBoot || p.DBX != nil || p.Authorities != nil || p.BootLoaders != nil || p.Kernels != nil || p.Firmware != nil
+}
+
+/*
+	compareVersions compares the dotted versions @a and @b
+	numerically, component by component, as strcmp does.
+*/
+func compareVersions(a, b string) int {
+	split := func(v string) []string {
+		return strings.FieldsFunc(v, func(r rune) bool { return r < '0' || r > '9' })
+	}
+	va, vb := split(a), split(b)
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var na, nb int
+		if i < len(va) {
+			na, _ = strconv.Atoi(va[i])
+		}
+		if i < len(vb) {
+			nb, _ = strconv.Atoi(vb[i])
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+/*
+	bootApplication is a boot application measured in PCR4.
+*/
+type bootApplication struct {
+	digest []byte // SHA256 Authenticode digest
+	path   string // File path, empty if loaded from memory or a firmware volume
+	uki    bool   // The UKI sections have been measured after it, see kernelIndex
+}
+
+/*
+	bootApplications returns the boot applications
+	measured in PCR4 by @events.
+*/
+func bootApplications(events []attest.Event) []bootApplication {
+	var apps []bootApplication
+
+	for _, e := range events {
+		switch {
+		case e.Index == 4 && e.Type == evEFIBootServicesApplication:
+			path, _ := parseImageLoad(e.Data)
+			apps = append(apps, bootApplication{digest: e.Digest, path: path})
+		case e.Index == 11 && e.Type == evIPL && decodeString(e.Data) == ".linux" && len(apps) > 0:
+			apps[len(apps) - 1].uki = true
+		}
+	}
+	return apps
+}
+
+/*
+	isKernelPath returns whether @path is the one of a
+	kernel image, or of a UKI installed by kernel-install.
+*/
+func isKernelPath(path string) bool {
+	path = strings.ToLower(strings.ReplaceAll(path, "/", `\`))
+	name := path[strings.LastIndex(path, `\`) + 1:]
+	for _, prefix := range []string{"vmlinuz", "vmlinux", "bzimage", "linux"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(path, `\efi\linux\`)
+}
+
+/*
+	kernelIndex returns the index of the kernel in @apps, and
+	whether the applications after it are parts of it.
+
+	systemd-stub measures the sections of a UKI in PCR11, so the
+	UKI is the application measured before its .linux section, and
+	the kernel it then loads from memory, if measured, isn't a boot
+	loader. Otherwise, the kernel is identified by its file name,
+	as boot loaders and chainloaded ones are loaded in any order.
+	If no application looks like a kernel, it's the last one.
+*/
+func kernelIndex(apps []bootApplication) (int, bool) {
+	for i, app := range apps {
+		if app.uki {
+			return i, true
+		}
+	}
+	for i := len(apps) - 1; i >= 0; i-- {
+		if isKernelPath(apps[i].path) {
+			return i, false
+		}
+	}
+	return len(apps) - 1, false
+}
+
+/*
+	checkSecureBoot evaluates the rules of @p that apply to the
+	Secure Boot @state, and returns the rules that are violated.
+*/
+func (p *policy) checkSecureBoot(state *attest.SecurebootState) []string {
+	var errs []string
+
+	if p.SecureBoot && !state.Enabled {
+		errs = append(errs, "Secure Boot is disabled")
+	}
+	if p.DBX != nil {
+		version := len(state.ForbiddenHashes) + len(state.ForbiddenKeys)
+		if version < p.DBX.MinVersion {
+			errs = append(errs, fmt.Sprintf("The dbx version %d is older than %d", version, p.DBX.MinVersion))
+		}
+		for _, digest := range p.DBX.Revoked {
+			if !containsDigest(digestsOf(state.ForbiddenHashes), digest) {
+				errs = append(errs, fmt.Sprintf("The dbx doesn't revoke %x", []byte(digest)))
+			}
+		}
+	}
+	if p.Authorities != nil {
+		var allowed = make(map[string]bool)
+		for _, subject := range p.Authorities {
+			allowed[subject] = true
+		}
+		for _, cert := range append(state.PreSeparatorAuthority, state.PostSeparatorAuthority...) {
+			if !allowed[cert.Subject.String()] {
+				errs = append(errs, "Authority " + cert.Subject.String() + " isn't allowed")
+			}
+		}
+	}
+	return errs
+}
+
+/*
+	checkEvents evaluates the rules of @p that apply to
+	@events, the SHA256 events of the event log, and
+	returns the rules that are violated.
+*/
+func (p *policy) checkEvents(events []attest.Event) []string {
+	var errs []string
+
+	if p.SecureBoot || p.DBX != nil || p.Authorities != nil {
+		state, err := attest.ParseSecurebootState(events)
+		if err != nil {
+			errs = append(errs, "The Secure Boot state can't be determined: " + err.Error())
+		} else {
+			errs = append(errs, p.checkSecureBoot(state)...)
+		}
+	}
+
+	apps := bootApplications(events)
+	if (p.Kernels != nil || p.BootLoaders != nil) && len(apps) == 0 {
+		errs = append(errs, "No boot application has been measured in PCR4")
+	}
+	kernel, uki := kernelIndex(apps)
+	for i, app := range apps {
+		switch {
+		case i == kernel && p.Kernels != nil:
+			if !containsDigest(p.Kernels, app.digest) {
+				errs = append(errs, fmt.Sprintf("Kernel %x isn't allowed", app.digest))
+			}
+		case i > kernel && uki && app.path == "":
+			// Loaded by systemd-stub from the UKI
+		case i != kernel && p.BootLoaders != nil:
+			if !containsDigest(p.BootLoaders, app.digest) {
+				errs = append(errs, fmt.Sprintf("Boot loader %x isn't allowed", app.digest))
+			}
+		}
+	}
+
+	if p.Firmware != nil {
+		var version string
+		for _, e := range events {
+			if e.Index == 0 && e.Type == evSCRTMVersion {
+				version = decodeString(e.Data)
+			}
+		}
+		switch {
+		case version == "":
+			errs = append(errs, "The firmware version hasn't been measured")
+		case p.Firmware.Min != "" && compareVersions(version, p.Firmware.Min) < 0:
+			errs = append(errs, fmt.Sprintf("The firmware version %s is older than %s", version, p.Firmware.Min))
+		case p.Firmware.Max != "" && compareVersions(version, p.Firmware.Max) > 0:
+			errs = append(errs, fmt.Sprintf("The firmware version %s is newer than %s", version, p.Firmware.Max))
+		}
+	}
+	return errs
+}
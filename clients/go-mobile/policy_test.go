@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"github.com/google/go-attestation/attest"
+)
+
+func TestCompareVersions(t *testing.T) {
+	var cases = []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.14.0", "1.14.0", 0},
+		{"1.14", "1.14.0", 0},
+		{"1.9", "1.14", -1},
+		{"1.20", "1.14.2", 1},
+		{"2", "1.99.99", 1},
+		{"F.40", "F.41", -1},
+		{"", "0", 0},
+	}
+
+	for _, c := range cases {
+		if r := compareVersions(c.a, c.b); r != c.expected {
+			t.Errorf("compareVersions(%q, %q): expected %d, got %d", c.a, c.b, c.expected, r)
+		}
+	}
+}
+
+/*
+	appEvent returns the event of the boot
+	application loaded from @path.
+*/
+func appEvent(path string) attest.Event {
+	data := imageLoadData(path)
+	digest := sha256.Sum256(data)
+	return attest.Event{Index: 4, Type: evEFIBootServicesApplication, Data: data, Digest: digest[:]}
+}
+
+func TestKernelRules(t *testing.T) {
+	var (
+		shim     = appEvent(`\EFI\debian\shimx64.efi`)
+		grub     = appEvent(`\EFI\debian\grubx64.efi`)
+		kernel   = appEvent(`\vmlinuz-6.1.0-13-amd64`)
+		sdboot   = appEvent(`\EFI\systemd\systemd-bootx64.efi`)
+		uki      = appEvent(`\EFI\Linux\debian-6.1.0-13-amd64.efi`)
+		otherUKI = appEvent(`\EFI\boot\bootx64.efi`)
+		stub     = appEvent("")
+		ubuntu   = appEvent(`\EFI\ubuntu\grubx64.efi`)
+		linux    = attest.Event{Index: 11, Type: evIPL, Data: []byte(".linux\x00")}
+	)
+	allow := func(loaders []attest.Event, kernel attest.Event) *policy {
+		var p policy
+		for _, e := range loaders {
+			p.BootLoaders = append(p.BootLoaders, e.Digest)
+		}
+		p.Kernels = []hexDigest{kernel.Digest}
+		return &p
+	}
+
+	var cases = []struct {
+		events []attest.Event
+		policy *policy
+		errors []string
+		name   string
+	}{
+		{[]attest.Event{shim, grub, kernel}, allow([]attest.Event{shim, grub}, kernel), nil, "GRUB"},
+		{[]attest.Event{shim, grub, kernel}, allow([]attest.Event{shim, grub}, grub), []string{"Kernel"}, "GRUB with another kernel"},
+		{[]attest.Event{sdboot, uki, linux}, allow([]attest.Event{sdboot}, uki), nil, "systemd-boot and UKI"},
+		{[]attest.Event{sdboot, uki, linux, stub}, allow([]attest.Event{sdboot}, uki), nil, "UKI measuring its kernel"},
+		{[]attest.Event{shim, otherUKI, linux, stub}, allow([]attest.Event{shim}, otherUKI), nil, "UKI booted by shim"},
+		{[]attest.Event{sdboot, uki, linux, grub}, allow([]attest.Event{sdboot}, uki), []string{"Boot loader"}, "Application loaded from disk by a UKI"},
+		{[]attest.Event{shim, ubuntu, shim, grub, kernel}, allow([]attest.Event{shim, ubuntu, grub}, kernel), nil, "Chainloaded GRUB"},
+		{[]attest.Event{shim, grub, kernel, stub}, allow([]attest.Event{shim, grub, stub}, kernel), nil, "Application loaded after the kernel"},
+		{[]attest.Event{shim, grub}, allow([]attest.Event{shim}, grub), nil, "Unknown kernel name"},
+		{nil, allow(nil, kernel), []string{"No boot application"}, "No boot application"},
+	}
+
+	for _, c := range cases {
+		errs := c.policy.checkEvents(c.events)
+		if len(errs) != len(c.errors) {
+			t.Errorf("[%s]: expected %d errors, got %v", c.name, len(c.errors), errs)
+			continue
+		}
+		for i, e := range c.errors {
+			if !strings.HasPrefix(errs[i], e) {
+				t.Errorf("[%s]: expected %q, got %q", c.name, e, errs[i])
+			}
+		}
+	}
+}
+
+func TestFirmwareRule(t *testing.T) {
+	version := func(v string) []attest.Event {
+		return []attest.Event{{Index: 0, Type: evSCRTMVersion, Data: utf16Bytes(v)}}
+	}
+	var cases = []struct {
+		events []attest.Event
+		rule   string
+		err    string
+	}{
+		{version("1.16.2"), `{"min": "1.14.0", "max": "1.20"}`, ""},
+		{version("1.14"), `{"min": "1.14.0"}`, ""},
+		{version("1.9.1"), `{"min": "1.14.0"}`, "older than 1.14.0"},
+		{version("1.21"), `{"min": "1.14.0", "max": "1.20"}`, "newer than 1.20"},
+		{version("1.21"), `{"min": "1.14.0"}`, ""},
+		{nil, `{"min": "1.14.0"}`, "hasn't been measured"},
+	}
+
+	for _, c := range cases {
+		p, err := parsePolicy([]byte(`{"firmware": ` + c.rule + `}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := p.checkEvents(c.events)
+		if (c.err == "") != (len(errs) == 0) || (c.err != "" && !strings.Contains(errs[0], c.err)) {
+			t.Errorf("%s: expected %q, got %v", c.rule, c.err, errs)
+		}
+	}
+}
+
+func TestSecureBootRules(t *testing.T) {
+	var revoked = bytes.Repeat([]byte{1}, sha256.Size)
+	var microsoft = x509.Certificate{Subject: pkix.Name{CommonName: "Microsoft Corporation UEFI CA 2011"}}
+	var debian = x509.Certificate{Subject: pkix.Name{CommonName: "Debian Secure Boot CA"}}
+	var state = attest.SecurebootState{
+		Enabled:                true,
+		ForbiddenHashes:        [][]byte{revoked, revoked[1:]},
+		ForbiddenKeys:          []x509.Certificate{debian},
+		PreSeparatorAuthority:  []x509.Certificate{microsoft},
+		PostSeparatorAuthority: []x509.Certificate{debian},
+	}
+	var disabled = state
+	disabled.Enabled = false
+
+	var cases = []struct {
+		rules  string
+		state  *attest.SecurebootState
+		errors []string
+	}{
+		{`"secure_boot": true`, &state, nil},
+		{`"secure_boot": true`, &disabled, []string{"Secure Boot is disabled"}},
+		{`"secure_boot": false`, &disabled, nil},
+		{`"dbx": {"min_version": 3}`, &state, nil},
+		{`"dbx": {"min_version": 4}`, &state, []string{"The dbx version 3 is older than 4"}},
+		{fmt.Sprintf(`"dbx": {"revoked": ["%x"]}`, revoked), &state, nil},
+		{fmt.Sprintf(`"dbx": {"revoked": ["%x"]}`, revoked[2:]), &state, []string{"The dbx doesn't revoke"}},
+		{fmt.Sprintf(`"authorities": [%q, %q]`, microsoft.Subject.String(), debian.Subject.String()), &state, nil},
+		{fmt.Sprintf(`"authorities": [%q]`, microsoft.Subject.String()), &state, []string{"Authority CN=Debian Secure Boot CA isn't allowed"}},
+		{`"authorities": []`, &state, []string{"Authority", "Authority"}},
+	}
+
+	for _, c := range cases {
+		p, err := parsePolicy([]byte("{" + c.rules + "}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := p.checkSecureBoot(c.state)
+		if len(errs) != len(c.errors) {
+			t.Errorf("%s: expected %d errors, got %v", c.rules, len(c.errors), errs)
+			continue
+		}
+		for i, e := range c.errors {
+			if !strings.HasPrefix(errs[i], e) {
+				t.Errorf("%s: expected %q, got %q", c.rules, e, errs[i])
+			}
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	var cases = []struct {
+		policy string
+		valid  bool
+	}{
+		{`{"pcrs": {"SHA1": {"0": ["00"]}, "SHA256": {"23": []}}}`, true},
+		{`{"pcrs": {"SHA256": {"4": ["00"]}}, "next_states": [{"pcrs": {"4": "01"}, "boots": 1}]}`, true},
+		{`{"pcrs": {"SHA256": {"4": ["00"]}}, "next_states": [{"pcrs": {"7": "01"}, "boots": 1}]}`, false},
+		{`{"pcrs": {"SHA256": {"-1": []}}}`, false},
+		{`{"pcrs": {"SHA256": {"4": ["0g"]}}}`, false},
+		{`{"secure_boot": true, "kernel": []}`, false},
+	}
+
+	for _, c := range cases {
+		if _, err := parsePolicy([]byte(c.policy)); (err == nil) != c.valid {
+			t.Errorf("%s: expected valid %v, got %v", c.policy, c.valid, err)
+		}
+	}
+}
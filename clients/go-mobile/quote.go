@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file verifies the quotes of the attesters. Quotes can cover
+	a selection of the PCRs of the SHA1, SHA256 or SHA384 banks, as
+	requested by the verifier, while go-attestation only verifies
+	quotes of all the PCRs.
+
+	Whatever the bank, the TPM digests the quoted PCR values with the
+	hash of the AK signing scheme. Verifying a quote doesn't need the
+	event log: SHA384 PCRs are verified, and compared with the policy,
+	even though go-attestation can't replay their event log.
+*/
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+)
+
+/*
+	verifyQuote asserts that @quote is signed by @ak, contains
+	@nonce, and is over the values of the @pcrs it selects.
+	It returns the indexes of the quoted PCRs.
+*/
+func verifyQuote(ak *attest.AKPublic, quote attest.Quote, pcrs []attest.PCR, nonce []byte) (map[int]bool, error) {
+	pub, ok := ak.Public.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported AK type: %T", ak.Public)
+	}
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(quote.Signature))
+	if err != nil {
+		return nil, err
+	}
+	if sig.RSA == nil {
+		return nil, errors.New("The quote isn't signed with RSA")
+	}
+	h := ak.Hash.New()
+	h.Write(quote.Quote)
+	if err = rsa.VerifyPKCS1v15(pub, ak.Hash, h.Sum(nil), sig.RSA.Signature); err != nil {
+		return nil, fmt.Errorf("Invalid quote signature: %v", err)
+	}
+
+	att, err := tpm2.DecodeAttestationData(quote.Quote)
+	if err != nil {
+		return nil, err
+	}
+	if att.Type != tpm2.TagAttestQuote || att.AttestedQuoteInfo == nil {
+		return nil, errors.New("The attestation data isn't a quote")
+	}
+	if !bytes.Equal(att.ExtraData, nonce) {
+		return nil, errors.New("The quote doesn't contain the anti replay nonce")
+	}
+	hash, err := att.AttestedQuoteInfo.PCRSelection.Hash.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if bankName(hash) == "" {
+		return nil, fmt.Errorf("Unsupported PCR bank: %v", hash)
+	}
+	sigHash, err := sig.RSA.HashAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	var values = make(map[int][]byte)
+	for _, pcr := range pcrs {
+		if pcr.DigestAlg == hash {
+			values[pcr.Index] = pcr.Digest
+		}
+	}
+	var quoted = make(map[int]bool)
+	var digest = sigHash.New()
+	for _, index := range att.AttestedQuoteInfo.PCRSelection.PCRs {
+		value, ok := values[index]
+		if !ok {
+			return nil, fmt.Errorf("The quote is over PCR %d which wasn't provided", index)
+		}
+		digest.Write(value)
+		quoted[index] = true
+	}
+	if !bytes.Equal(digest.Sum(nil), att.AttestedQuoteInfo.PCRDigest) {
+		return nil, errors.New("The quote digest doesn't match the PCRs provided")
+	}
+	return quoted, nil
+}
+
+/*
+	verifyQuotes asserts that every PCR of @pcrs is
+	covered by one of @quotes, as with verifyQuote.
+*/
+func verifyQuotes(ak *attest.AKPublic, quotes []attest.Quote, pcrs []attest.PCR, nonce []byte) error {
+	var covered = make(map[crypto.Hash]map[int]bool)
+
+	if len(quotes) == 0 {
+		return errors.New("The attester didn't send any quote")
+	}
+	for i, quote := range quotes {
+		quoted, err := verifyQuote(ak, quote, pcrs, nonce)
+		if err != nil {
+			return fmt.Errorf("Quote %d: %v", i, err)
+		}
+		att, _ := tpm2.DecodeAttestationData(quote.Quote)
+		hash, _ := att.AttestedQuoteInfo.PCRSelection.Hash.Hash()
+		if covered[hash] == nil {
+			covered[hash] = make(map[int]bool)
+		}
+		for index := range quoted {
+			covered[hash][index] = true
+		}
+	}
+	for _, pcr := range pcrs {
+		if !covered[pcr.DigestAlg][pcr.Index] {
+			return fmt.Errorf("PCR %d (%v) isn't covered by a quote", pcr.Index, pcr.DigestAlg)
+		}
+	}
+	return nil
+}
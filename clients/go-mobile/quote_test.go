@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"testing"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+)
+
+/*
+	signQuote returns a quote of the @pcrs of the @bank, whose values
+	are digested with @digestHash, signed by @key with RSASSA-SHA256.
+*/
+func signQuote(t *testing.T, key *rsa.PrivateKey, bank tpm2.Algorithm, pcrs []attest.PCR, digestHash crypto.Hash, nonce []byte) attest.Quote {
+	var sel = tpm2.PCRSelection{Hash: bank}
+	var digest = digestHash.New()
+	for _, pcr := range pcrs {
+		sel.PCRs = append(sel.PCRs, pcr.Index)
+		digest.Write(pcr.Digest)
+	}
+	quoted, err := tpm2.AttestationData{
+		Magic:             0xff544347,
+		Type:              tpm2.TagAttestQuote,
+		QualifiedSigner:   tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: make([]byte, sha256.Size)}},
+		ExtraData:         nonce,
+		AttestedQuoteInfo: &tpm2.QuoteInfo{PCRSelection: sel, PCRDigest: digest.Sum(nil)},
+	}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attest.Quote{Version: attest.TPMVersion20, Quote: quoted, Signature: tpmSignAK(t, key, quoted)}
+}
+
+func TestVerifyQuote(t *testing.T) {
+	var nonce = []byte("nonce")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ak = &attest.AKPublic{Public: &key.PublicKey, Hash: crypto.SHA256}
+	var sha1PCRs = []attest.PCR{
+		{Index: 0, Digest: bytes.Repeat([]byte{0}, sha1.Size), DigestAlg: crypto.SHA1},
+		{Index: 7, Digest: bytes.Repeat([]byte{7}, sha1.Size), DigestAlg: crypto.SHA1},
+	}
+	var sha384PCRs = []attest.PCR{
+		{Index: 0, Digest: bytes.Repeat([]byte{0}, sha512.Size384), DigestAlg: crypto.SHA384},
+		{Index: 7, Digest: bytes.Repeat([]byte{7}, sha512.Size384), DigestAlg: crypto.SHA384},
+	}
+
+	var cases = []struct {
+		quote attest.Quote
+		pcrs  []attest.PCR
+		nonce []byte
+		valid bool
+		name  string
+	}{
+		{signQuote(t, key, tpm2.AlgSHA1, sha1PCRs, crypto.SHA256, nonce), sha1PCRs, nonce, true, "SHA1 bank digested with the signing scheme hash"},
+		{signQuote(t, key, tpm2.AlgSHA1, sha1PCRs, crypto.SHA1, nonce), sha1PCRs, nonce, false, "SHA1 bank digested with the bank hash"},
+		{signQuote(t, key, tpm2.AlgSHA1, sha1PCRs, crypto.SHA256, nonce), sha1PCRs, []byte("other"), false, "Wrong nonce"},
+		{signQuote(t, key, tpm2.AlgSHA1, sha1PCRs, crypto.SHA256, nonce), sha1PCRs[:1], nonce, false, "Quoted PCR not provided"},
+		{signQuote(t, key, tpm2.AlgSHA384, sha384PCRs, crypto.SHA256, nonce), sha384PCRs, nonce, true, "SHA384 bank"},
+	}
+
+	for _, c := range cases {
+		quoted, err := verifyQuote(ak, c.quote, c.pcrs, c.nonce)
+		if (err == nil) != c.valid {
+			t.Errorf("[%s]: expected valid: %t, got error: %v", c.name, c.valid, err)
+			continue
+		}
+		if c.valid && (len(quoted) != 2 || !quoted[0] || !quoted[7]) {
+			t.Errorf("[%s]: unexpected quoted PCRs: %v", c.name, quoted)
+		}
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := signQuote(t, other, tpm2.AlgSHA1, sha1PCRs, crypto.SHA256, nonce)
+	if _, err = verifyQuote(ak, forged, sha1PCRs, nonce); err == nil {
+		t.Error("A quote signed by another key must be rejected")
+	}
+	if err = verifyQuotes(ak, []attest.Quote{signQuote(t, key, tpm2.AlgSHA1, sha1PCRs[:1], crypto.SHA256, nonce)}, sha1PCRs, nonce); err == nil {
+		t.Error("A PCR not covered by any quote must be rejected")
+	}
+}
@@ -0,0 +1,208 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file extracts the Secure Boot state of an attester
+	from the PCR7 events of its event log: whether Secure Boot
+	is enabled, the content of its signature databases, and the
+	authorities that verified the loaded images.
+
+	Firmwares only measure an authority the first time it verifies
+	an image, so the images verified by an authority that already
+	verified a previous one have no authority of their own.
+*/
+
+package gomobile
+
+import (
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/go-attestation/attest"
+)
+
+/*
+	SignatureDatabase describes one of the Secure Boot
+	signature databases: PK, KEK, db or dbx.
+*/
+type SignatureDatabase struct {
+	Name      string
+	HashCount int // Number of hashes, of allowed or revoked images
+	subjects  []string
+}
+
+/*
+	CertificateCount returns the number of
+	certificates in the database.
+*/
+func (d *SignatureDatabase) CertificateCount() int {
+	return len(d.subjects)
+}
+
+/*
+	Certificate returns the subject of the @i-th certificate
+	of the database, or "" if @i is out of range.
+*/
+func (d *SignatureDatabase) Certificate(i int) string {
+	if i < 0 || i >= len(d.subjects) {
+		return ""
+	}
+	return d.subjects[i]
+}
+
+/*
+	ImageAuthority describes a boot application
+	and the authority that verified it.
+*/
+type ImageAuthority struct {
+	Image     string // e.g. "Image \EFI\BOOT\BOOTX64.EFI"
+	Digest    []byte // Authenticode SHA256 digest
+	Authority string // Subject of the certificate, or hash of the image in db, "" if not measured
+}
+
+/*
+	SecureBootReport is the Secure Boot state of
+	an attester, as returned by GetSecureBootState.
+*/
+type SecureBootReport struct {
+	Enabled               bool
+	DMAProtectionDisabled bool
+	databases             []*SignatureDatabase
+	images                []*ImageAuthority
+}
+
+/*
+	Database returns the signature database @name,
+	"PK", "KEK", "db" or "dbx", or nil if it's unknown.
+*/
+func (r *SecureBootReport) Database(name string) *SignatureDatabase {
+	for _, db := range r.databases {
+		if db.Name == name {
+			return db
+		}
+	}
+	return nil
+}
+
+/*
+	ImageCount returns the number of boot
+	applications loaded by the firmware.
+*/
+func (r *SecureBootReport) ImageCount() int {
+	return len(r.images)
+}
+
+/*
+	Image returns the @i-th loaded boot application,
+	or nil if @i is out of range.
+*/
+func (r *SecureBootReport) Image(i int) *ImageAuthority {
+	if i < 0 || i >= len(r.images) {
+		return nil
+	}
+	return r.images[i]
+}
+
+func newSignatureDatabase(name string, certs []x509.Certificate, hashes [][]byte) *SignatureDatabase {
+	var db = SignatureDatabase{Name: name, HashCount: len(hashes)}
+	for _, cert := range certs {
+		db.subjects = append(db.subjects, cert.Subject.String())
+	}
+	return &db
+}
+
+/*
+	describeAuthority returns the subject of the certificate, or
+	the image hash, of the authority whose variable value is @value:
+	an EFI_SIGNATURE_DATA from db, or a bare certificate from shim.
+*/
+func describeAuthority(value []byte) string {
+	var candidates = [][]byte{value}
+	if len(value) > 16 {
+		candidates = [][]byte{value[16:], value}
+	}
+	for _, data := range candidates {
+		if cert, err := x509.ParseCertificate(data); err == nil {
+			return cert.Subject.String()
+		}
+	}
+	if len(value) == 16 + 32 {
+		return fmt.Sprintf("SHA256 %x", value[16:])
+	}
+	return "Unknown authority"
+}
+
+/*
+	imageAuthorities returns the boot applications loaded
+	by @events, with the authority measured before each.
+*/
+func imageAuthorities(events []attest.Event) []*ImageAuthority {
+	var images []*ImageAuthority
+	var authority string
+
+	for _, e := range events {
+		switch {
+		case e.Index == 7 && e.Type == evEFIVariableAuthority:
+			_, name, value, err := parseVariable(e.Data)
+			if err != nil {
+				authority = "Invalid authority"
+			} else {
+				authority = describeAuthority(value) + " (" + name + ")"
+			}
+		case e.Index == 4 && e.Type == evEFIBootServicesApplication:
+			images = append(images, &ImageAuthority{
+				Image:     describeEvent(uint32(e.Type), e.Data),
+				Digest:    e.Digest,
+				Authority: authority,
+			})
+			authority = ""
+		}
+	}
+	return images
+}
+
+/*
+	newSecureBootReport returns the report of the Secure Boot
+	@state, parsed from the verified @events.
+*/
+func newSecureBootReport(state *attest.SecurebootState, events []attest.Event) *SecureBootReport {
+	return &SecureBootReport{
+		Enabled:               state.Enabled,
+		DMAProtectionDisabled: state.DMAProtectionDisabled,
+		databases: []*SignatureDatabase{
+			newSignatureDatabase("PK", state.PlatformKeys, state.PlatformKeyHashes),
+			newSignatureDatabase("KEK", state.ExchangeKeys, state.ExchangeKeyHashes),
+			newSignatureDatabase("db", state.PermittedKeys, state.PermittedHashes),
+			newSignatureDatabase("dbx", state.ForbiddenKeys, state.ForbiddenHashes),
+		},
+		images: imageAuthorities(events),
+	}
+}
+
+/*
+	GetSecureBootState returns the Secure Boot state of the
+	attester, from the event log of the attestation data @encodedpp.
+	The event log is replayed against the SHA256 PCRs, which must
+	have been checked against the quotes before, e.g. with Verify.
+*/
+func GetSecureBootState(encodedpp []byte) (*SecureBootReport, error) {
+	var pp attest.PlatformParameters
+
+	if err := cbor.Unmarshal(encodedpp, &pp); err != nil {
+		return nil, err
+	}
+	el, err := attest.ParseEventLog(pp.EventLog)
+	if err != nil {
+		return nil, err
+	}
+	events, err := verifiedEvents(el, pp.PCRs)
+	if err != nil {
+		return nil, err
+	}
+	state, err := attest.ParseSecurebootState(events)
+	if err != nil {
+		return nil, err
+	}
+	return newSecureBootReport(state, events), nil
+}
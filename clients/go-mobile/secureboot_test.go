@@ -0,0 +1,217 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	stdx509 "crypto/x509"
+	stdpkix "crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-attestation/attest"
+)
+
+// EFI GUIDs, in their binary encoding
+var (
+	efiGlobalVariable  = efiGUID(0x8be4df61, 0x93ca, 0x11d2, 0xaa0d00e098032b8c)
+	efiImageSecurityDB = efiGUID(0xd719b2cb, 0x3d3a, 0x4596, 0xa3bcdad00e67656f)
+	efiCertSHA256      = efiGUID(0xc1c41626, 0x504c, 0x4092, 0xaca941f936934328)
+	efiCertX509        = efiGUID(0xa5c059a1, 0x94e4, 0x4aa7, 0x87b5ab155c2bf072)
+)
+
+func efiGUID(a uint32, b, c uint16, d uint64) [16]byte {
+	var guid [16]byte
+	binary.LittleEndian.PutUint32(guid[:], a)
+	binary.LittleEndian.PutUint16(guid[4:], b)
+	binary.LittleEndian.PutUint16(guid[6:], c)
+	binary.BigEndian.PutUint64(guid[8:], d)
+	return guid
+}
+
+/*
+	signatureList returns the EFI_SIGNATURE_LIST of @entries,
+	of the signature type @typ, with a zero owner GUID.
+*/
+func signatureList(typ [16]byte, entries ...[]byte) []byte {
+	var list = append([]byte{}, typ[:]...)
+	var size = 16 + len(entries[0])
+	list = binary.LittleEndian.AppendUint32(list, uint32(28 + len(entries) * size))
+	list = binary.LittleEndian.AppendUint32(list, 0)
+	list = binary.LittleEndian.AppendUint32(list, uint32(size))
+	for _, e := range entries {
+		list = append(list, make([]byte, 16)...)
+		list = append(list, e...)
+	}
+	return list
+}
+
+/*
+	secureBootCA returns a self signed
+	certificate of common name @name.
+*/
+func secureBootCA(t *testing.T, name string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := issue(t, &stdx509.Certificate{Subject: stdpkix.Name{CommonName: name}}, key, nil, nil)
+	return der
+}
+
+/*
+	secureBootEvents returns the PCR7 and PCR4 events of a boot
+	with Secure Boot @enabled, verifying shim with @ca from db,
+	then GRUB and the kernel with @shimCA, embedded in shim.
+*/
+func secureBootEvents(enabled bool, ca, shimCA []byte, revoked [][]byte) []testEvent {
+	var state byte
+	if enabled {
+		state = 1
+	}
+	var variable = func(name string, guid [16]byte, value []byte) testEvent {
+		return testEvent{pcr: 7, typ: evEFIVariableDriverConfig, data: variableData(guid, name, value)}
+	}
+	var authority = func(name string, value []byte) testEvent {
+		return testEvent{pcr: 7, typ: evEFIVariableAuthority, data: variableData(efiImageSecurityDB, name, value)}
+	}
+	var app = func(path string) testEvent {
+		return testEvent{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(path)}
+	}
+
+	return []testEvent{
+		variable("SecureBoot", efiGlobalVariable, []byte{state}),
+		variable("PK", efiGlobalVariable, signatureList(efiCertX509, ca)),
+		variable("KEK", efiGlobalVariable, signatureList(efiCertX509, ca)),
+		variable("db", efiImageSecurityDB, signatureList(efiCertX509, ca)),
+		variable("dbx", efiImageSecurityDB, signatureList(efiCertSHA256, revoked...)),
+		{pcr: 7, typ: evEFIAction, data: []byte("DMA Protection Disabled")},
+		{pcr: 7, typ: evSeparator, data: []byte{0, 0, 0, 0}},
+		authority("db", append(make([]byte, 16), ca...)),
+		app(`\EFI\debian\shimx64.efi`),
+		authority("Shim", shimCA),
+		app(`\EFI\debian\grubx64.efi`),
+		app(`\vmlinuz-6.1.0-13-amd64`),
+	}
+}
+
+func TestDescribeAuthority(t *testing.T) {
+	var ca = secureBootCA(t, "Debian Secure Boot CA")
+	var hash = bytes.Repeat([]byte{1}, sha256.Size)
+
+	var cases = []struct {
+		value    []byte
+		expected string
+	}{
+		{append(make([]byte, 16), ca...), "CN=Debian Secure Boot CA"},
+		{ca, "CN=Debian Secure Boot CA"},
+		{append(make([]byte, 16), hash...), fmt.Sprintf("SHA256 %x", hash)},
+		{hash, "Unknown authority"},
+		{nil, "Unknown authority"},
+	}
+
+	for _, c := range cases {
+		if d := describeAuthority(c.value); d != c.expected {
+			t.Errorf("Expected %q, got %q", c.expected, d)
+		}
+	}
+}
+
+func TestGetSecureBootState(t *testing.T) {
+	var ca = secureBootCA(t, "Test UEFI CA")
+	var shimCA = secureBootCA(t, "Debian Secure Boot CA")
+	var revoked = [][]byte{bytes.Repeat([]byte{1}, sha256.Size), bytes.Repeat([]byte{2}, sha256.Size)}
+
+	log, pcrs := buildEventLog(t, secureBootEvents(true, ca, shimCA, revoked))
+	report, err := GetSecureBootState(encodePlatform(t, log, pcrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Enabled || !report.DMAProtectionDisabled {
+		t.Errorf("Unexpected state: %+v", *report)
+	}
+
+	var databases = []struct {
+		name   string
+		certs  []string
+		hashes int
+	}{
+		{"PK", []string{"CN=Test UEFI CA"}, 0},
+		{"KEK", []string{"CN=Test UEFI CA"}, 0},
+		{"db", []string{"CN=Test UEFI CA"}, 0},
+		{"dbx", nil, 2},
+	}
+	for _, expected := range databases {
+		db := report.Database(expected.name)
+		if db == nil || db.HashCount != expected.hashes || db.CertificateCount() != len(expected.certs) {
+			t.Errorf("%s: unexpected database %+v", expected.name, db)
+			continue
+		}
+		for i, subject := range expected.certs {
+			if db.Certificate(i) != subject {
+				t.Errorf("%s: expected certificate %q, got %q", expected.name, subject, db.Certificate(i))
+			}
+		}
+		if db.Certificate(len(expected.certs)) != "" {
+			t.Errorf("%s: out of range certificate", expected.name)
+		}
+	}
+	if report.Database("MokList") != nil {
+		t.Errorf("Unknown databases must be nil")
+	}
+
+	var images = []ImageAuthority{
+		{Image: `Image \EFI\debian\shimx64.efi`, Authority: "CN=Test UEFI CA (db)"},
+		{Image: `Image \EFI\debian\grubx64.efi`, Authority: "CN=Debian Secure Boot CA (Shim)"},
+		{Image: `Image \vmlinuz-6.1.0-13-amd64`, Authority: ""},
+	}
+	if report.ImageCount() != len(images) || report.Image(len(images)) != nil {
+		t.Fatalf("Expected %d images, got %d", len(images), report.ImageCount())
+	}
+	for i, expected := range images {
+		image := report.Image(i)
+		if image.Image != expected.Image || image.Authority != expected.Authority || len(image.Digest) != sha256.Size {
+			t.Errorf("Image %d: expected %+v, got %+v", i, expected, *image)
+		}
+	}
+
+	log, pcrs = buildEventLog(t, secureBootEvents(false, ca, shimCA, revoked))
+	if report, err = GetSecureBootState(encodePlatform(t, log, pcrs)); err != nil || report.Enabled {
+		t.Errorf("Secure Boot must be reported disabled: %v", err)
+	}
+
+	// An event that doesn't replay to the PCRs sent can't be trusted
+	log, pcrs = buildEventLog(t, secureBootEvents(true, ca, shimCA, revoked))
+	pcrs = append(pcrs[:0:0], pcrs...)
+	for i := range pcrs {
+		if pcrs[i].DigestAlg == crypto.SHA256 && pcrs[i].Index == 7 {
+			pcrs[i].Digest = make([]byte, sha256.Size)
+		}
+	}
+	if _, err = GetSecureBootState(encodePlatform(t, log, pcrs)); err == nil {
+		t.Errorf("An event log that doesn't replay must be refused")
+	}
+}
+
+func TestImageAuthorities(t *testing.T) {
+	var authority = attest.Event{Index: 7, Type: evEFIVariableAuthority, Data: variableData(efiImageSecurityDB, "db", append(make([]byte, 16), bytes.Repeat([]byte{1}, sha256.Size)...))}
+	var invalid = attest.Event{Index: 7, Type: evEFIVariableAuthority, Data: []byte{1}}
+	var app = appEvent(`\EFI\BOOT\BOOTX64.EFI`)
+
+	images := imageAuthorities([]attest.Event{authority, app, app, invalid, app})
+	var expected = []string{fmt.Sprintf("SHA256 %x (db)", bytes.Repeat([]byte{1}, sha256.Size)), "", "Invalid authority"}
+	if len(images) != len(expected) {
+		t.Fatalf("Expected %d images, got %d", len(expected), len(images))
+	}
+	for i, e := range expected {
+		if images[i].Authority != e || images[i].Image != `Image \EFI\BOOT\BOOTX64.EFI` {
+			t.Errorf("Image %d: expected authority %q, got %+v", i, e, *images[i])
+		}
+	}
+}
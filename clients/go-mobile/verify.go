@@ -0,0 +1,401 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	This file gathers the checks of an attestation into a single
+	report, telling the verifier not only whether the attester is
+	trusted, but also which PCRs changed and which events were
+	measured in them.
+
+	gobind can't return slices, so the PCRs of the report
+	and their events are reached through index accessors.
+*/
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+)
+
+// Status of a PCR in a VerificationReport.
+const (
+	PCR_MATCH     = "MATCH"     // The PCR has its reference value
+	PCR_MISMATCH  = "MISMATCH"  // The PCR differs from its reference value
+	PCR_MISSING   = "MISSING"   // The PCR has a reference value, but wasn't sent
+	PCR_UNCHECKED = "UNCHECKED" // The PCR has no reference value
+)
+
+/*
+	EventReport describes an event of the event
+	log, as measured in a PCR.
+*/
+type EventReport struct {
+	Sequence int    // Position of the event in the event log
+	Type     string // e.g. "EV_EFI_BOOT_SERVICES_APPLICATION"
+	Digest   []byte // Digest extended in the PCR bank, if the log contains it
+	Data     []byte
+}
+
+/*
+	PCRReport compares a PCR sent by the attester
+	with its reference value.
+*/
+type PCRReport struct {
+	Index    int
+	Bank     string // "SHA1", "SHA256" or "SHA384"
+	Status   string // One of the PCR_* constants
+	Expected []byte // Reference value, the first one if the policy allows many, empty if UNCHECKED
+	Actual   []byte // Value sent by the attester, empty if MISSING
+	events   []*EventReport
+}
+
+/*
+	EventCount returns the number of events that explain the
+	value of a mismatching PCR, i.e. the events measured in it.
+*/
+func (p *PCRReport) EventCount() int {
+	return len(p.events)
+}
+
+/*
+	Event returns the @i-th event measured in the PCR, or nil
+	if @i is out of range. The events can only be trusted if
+	the event log has been replayed successfully.
+*/
+func (p *PCRReport) Event(i int) *EventReport {
+	if i < 0 || i >= len(p.events) {
+		return nil
+	}
+	return p.events[i]
+}
+
+/*
+	VerificationReport is the result of Verify. The attester is
+	trusted only if Valid is true. The other fields tell
+	which checks failed, and why.
+*/
+type VerificationReport struct {
+	Valid         bool // The quotes, the event log and the policy are valid
+	QuotesValid   bool
+	QuotesError   string
+	EventLogValid bool // The event log replays to the SHA1 and SHA256 PCRs, it's ignored without any
+	EventLogError string
+	PolicyValid   bool
+	NextState     int  // Index of the next state of the policy the PCRs match, -1 if they match the policy itself
+	pcrs          []*PCRReport
+	policyErrors  []string
+}
+
+/*
+	PCRCount returns the number of PCRs in the report,
+	in the ones sent by the attester and the reference ones.
+*/
+func (r *VerificationReport) PCRCount() int {
+	return len(r.pcrs)
+}
+
+/*
+	PCR returns the @i-th PCR of the report, sorted by bank
+	then index, or nil if @i is out of range.
+*/
+func (r *VerificationReport) PCR(i int) *PCRReport {
+	if i < 0 || i >= len(r.pcrs) {
+		return nil
+	}
+	return r.pcrs[i]
+}
+
+/*
+	PolicyErrorCount returns the number of
+	policy rules the attester violates.
+*/
+func (r *VerificationReport) PolicyErrorCount() int {
+	return len(r.policyErrors)
+}
+
+/*
+	PolicyError returns the @i-th violated policy
+	rule, or "" if @i is out of range.
+*/
+func (r *VerificationReport) PolicyError(i int) string {
+	if i < 0 || i >= len(r.policyErrors) {
+		return ""
+	}
+	return r.policyErrors[i]
+}
+
+// PCR banks, by name
+var pcrBanks = map[string]crypto.Hash{
+	"SHA1":   crypto.SHA1,
+	"SHA256": crypto.SHA256,
+	"SHA384": crypto.SHA384,
+}
+
+/*
+	pcrKey identifies a PCR across banks.
+*/
+type pcrKey struct {
+	hash  crypto.Hash
+	index int
+}
+
+/*
+	bankName returns the name of the PCR bank of @hash, as used
+	by the attester in the quote requests, or "" if unsupported.
+*/
+func bankName(hash crypto.Hash) string {
+	switch hash {
+	case crypto.SHA1:
+		return "SHA1"
+	case crypto.SHA256:
+		return "SHA256"
+	case crypto.SHA384:
+		return "SHA384"
+	}
+	return ""
+}
+
+/*
+	pcrEvents returns the events of @el measured in the
+	PCR @index, with their digest for @hash.
+*/
+func pcrEvents(el *attest.EventLog, index int, hash crypto.Hash) []*EventReport {
+	var alg attest.HashAlg
+	var events []*EventReport
+
+	switch hash {
+	case crypto.SHA1:
+		alg = attest.HashSHA1
+	case crypto.SHA256:
+		alg = attest.HashSHA256
+	default:
+		return nil
+	}
+	for i, e := range el.Events(alg) {
+		if e.Index == index {
+			events = append(events, &EventReport{i, e.Type.String(), e.Digest, e.Data})
+		}
+	}
+	return events
+}
+
+/*
+	comparePCRs compares @pcrs, sent by the attester, with
+	their @reference values. The events of @el, if any,
+	explain the mismatching PCRs.
+*/
+func comparePCRs(pcrs []attest.PCR, reference map[pcrKey][][]byte, el *attest.EventLog) []*PCRReport {
+	var reports = make(map[pcrKey]*PCRReport)
+
+	for k, allowed := range reference {
+		reports[k] = &PCRReport{Index: k.index, Bank: bankName(k.hash), Status: PCR_MISSING}
+		if len(allowed) > 0 {
+			reports[k].Expected = allowed[0]
+		}
+	}
+	for _, pcr := range pcrs {
+		k := pcrKey{pcr.DigestAlg, pcr.Index}
+		report, ok := reports[k]
+		if !ok {
+			report = &PCRReport{Index: pcr.Index, Bank: bankName(pcr.DigestAlg), Status: PCR_UNCHECKED}
+			reports[k] = report
+		} else {
+			report.Status = PCR_MISMATCH
+			for _, value := range reference[k] {
+				if bytes.Equal(value, pcr.Digest) {
+					report.Status = PCR_MATCH
+				}
+			}
+			if report.Status == PCR_MISMATCH && el != nil {
+				report.events = pcrEvents(el, pcr.Index, pcr.DigestAlg)
+			}
+		}
+		report.Actual = pcr.Digest
+	}
+
+	var sorted []*PCRReport
+	for _, report := range reports {
+		sorted = append(sorted, report)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Bank != sorted[j].Bank {
+			return sorted[i].Bank < sorted[j].Bank
+		}
+		return sorted[i].Index < sorted[j].Index
+	})
+	return sorted
+}
+
+/*
+	pcrsMatch returns whether all the PCRs of
+	@reports with a reference value match it.
+*/
+func pcrsMatch(reports []*PCRReport) bool {
+	for _, pcr := range reports {
+		if pcr.Status == PCR_MISMATCH || pcr.Status == PCR_MISSING {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	decodeReference decodes @data, either an attestation policy
+	or, for verifiers enrolled before policies were supported, the
+	reference PCRs encoded by GetPCRs. It returns the reference
+	values of the PCRs, and the policy, which is nil in the latter case.
+*/
+func decodeReference(data []byte) (map[pcrKey][][]byte, *policy, error) {
+	var pcrs []attest.PCR
+	var reference = make(map[pcrKey][][]byte)
+
+	if isPolicy(data) {
+		p, err := parsePolicy(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p.references(), p, nil
+	}
+	if len(data) > 0 {
+		if err := cbor.Unmarshal(data, &pcrs); err != nil {
+			return nil, nil, errors.New("Invalid reference PCRs: " + err.Error())
+		}
+	}
+	for _, pcr := range pcrs {
+		reference[pcrKey{pcr.DigestAlg, pcr.Index}] = [][]byte{pcr.Digest}
+	}
+	return reference, nil, nil
+}
+
+/*
+	replayablePCRs returns the PCRs of @pcrs whose event log
+	go-attestation can replay, i.e. the SHA1 and SHA256 ones.
+*/
+func replayablePCRs(pcrs []attest.PCR) []attest.PCR {
+	var replayable []attest.PCR
+
+	for _, pcr := range pcrs {
+		if pcr.DigestAlg == crypto.SHA1 || pcr.DigestAlg == crypto.SHA256 {
+			replayable = append(replayable, pcr)
+		}
+	}
+	return replayable
+}
+
+/*
+	verifiedEvents returns the events of @el that could be replayed
+	against the SHA256 PCRs of @pcrs, with their SHA256 digests.
+*/
+func verifiedEvents(el *attest.EventLog, pcrs []attest.PCR) ([]attest.Event, error) {
+	var sha256 []attest.PCR
+
+	for _, pcr := range pcrs {
+		if pcr.DigestAlg == crypto.SHA256 {
+			sha256 = append(sha256, pcr)
+		}
+	}
+	if len(sha256) == 0 {
+		return nil, errors.New("The attester didn't send SHA256 PCRs")
+	}
+	return el.Verify(sha256)
+}
+
+/*
+	Verify checks the attestation data @encodedpp sent by the
+	attester whose attestation key is @encodedap, as
+	CheckQuotesSignature and ReplayEventLog do, and evaluates
+	@policy: either a JSON attestation policy, as described in
+	policy.go, or the reference PCRs encoded by GetPCRs on
+	enrollment. The report is invalid if @policy has neither
+	reference values nor event rules, e.g. if it's empty: all
+	the PCRs are then UNCHECKED, and nothing is trusted.
+	The PCRs may also match a next state of the policy, which
+	should then be consumed with ConsumeNextState.
+
+	An error is only returned when the parameters can't be decoded:
+	the failed checks are described by the report.
+*/
+func Verify(encodedap, encodedpp, nonce, policy []byte) (*VerificationReport, error) {
+	var ap attest.AttestationParameters
+	var pp attest.PlatformParameters
+	var report VerificationReport
+
+	if err := cbor.Unmarshal(encodedap, &ap); err != nil {
+		return nil, err
+	}
+	if err := cbor.Unmarshal(encodedpp, &pp); err != nil {
+		return nil, err
+	}
+	reference, p, err := decodeReference(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	akpub, err := attest.ParseAKPublic(attest.TPMVersion20, ap.Public)
+	if err == nil {
+		err = verifyQuotes(akpub, pp.Quotes, pp.PCRs, nonce)
+	}
+	if err != nil {
+		report.QuotesError = err.Error()
+	}
+	report.QuotesValid = err == nil
+
+	// When only SHA384 PCRs have been quoted, the event log
+	// can't be replayed, thus isn't used, nor needs to be valid.
+	var el *attest.EventLog
+	if pcrs := replayablePCRs(pp.PCRs); len(pcrs) > 0 {
+		el, err = attest.ParseEventLog(pp.EventLog)
+		if err == nil {
+			_, err = el.Verify(pcrs)
+		} else {
+			el = nil
+		}
+	} else {
+		err = nil
+	}
+	if err != nil {
+		report.EventLogError = err.Error()
+	}
+	report.EventLogValid = err == nil
+
+	report.pcrs = comparePCRs(pp.PCRs, reference, el)
+	report.NextState = -1
+	if p != nil && !pcrsMatch(report.pcrs) {
+		for i := range p.NextStates {
+			if pcrs := comparePCRs(pp.PCRs, p.stateReferences(i), el); pcrsMatch(pcrs) {
+				report.pcrs, report.NextState = pcrs, i
+				break
+			}
+		}
+	}
+	for _, pcr := range report.pcrs {
+		switch pcr.Status {
+		case PCR_MISMATCH:
+			report.policyErrors = append(report.policyErrors, fmt.Sprintf("PCR %d (%s) doesn't have an allowed value", pcr.Index, pcr.Bank))
+		case PCR_MISSING:
+			report.policyErrors = append(report.policyErrors, fmt.Sprintf("PCR %d (%s) is missing", pcr.Index, pcr.Bank))
+		}
+	}
+	if len(reference) == 0 && (p == nil || !p.needsEvents()) {
+		report.policyErrors = append(report.policyErrors, "The policy has no reference value to check the attester against")
+	}
+	if p != nil && p.needsEvents() {
+		if el == nil {
+			report.policyErrors = append(report.policyErrors, "The policy can't be checked without an event log")
+		} else if events, err := verifiedEvents(el, pp.PCRs); err != nil {
+			report.policyErrors = append(report.policyErrors, "The policy can't be checked: " + err.Error())
+		} else {
+			report.policyErrors = append(report.policyErrors, p.checkEvents(events)...)
+		}
+	}
+	report.PolicyValid = len(report.policyErrors) == 0
+	report.Valid = report.QuotesValid && report.EventLogValid && report.PolicyValid
+	return &report, nil
+}
@@ -0,0 +1,336 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package gomobile
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+/*
+	encodeAK returns the attestation parameters of
+	the attestation key @key, encoded to CBOR.
+*/
+func encodeAK(t *testing.T, key *rsa.PrivateKey) []byte {
+	public, err := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:       &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits:    2048,
+			ModulusRaw: key.N.Bytes(),
+		},
+	}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap, err := cbor.Marshal(attest.AttestationParameters{Public: public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ap
+}
+
+/*
+	signAK returns the signature of @data by @key with the
+	RSASSA-SHA256 scheme of the AKs encoded by encodeAK.
+*/
+func signAK(t *testing.T, key *rsa.PrivateKey, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+/*
+	tpmSignAK is signAK, encoded as the TPMT_SIGNATURE
+	returned by the TPM.
+*/
+func tpmSignAK(t *testing.T, key *rsa.PrivateKey, data []byte) []byte {
+	sig, err := tpmutil.Pack(tpm2.AlgRSASSA, tpm2.AlgSHA256, tpmutil.U16Bytes(signAK(t, key, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+/*
+	attestation returns the encoded attestation key and attestation
+	data of an attester whose event log has @events, quoted
+	with @nonce. The PCR values are returned too.
+*/
+func attestation(t *testing.T, events []testEvent, nonce []byte) ([]byte, []byte, []attest.PCR) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attestationWithKey(t, key, events, nonce)
+}
+
+/*
+	attestationWithKey is attestation, for the attestation key @key.
+*/
+func attestationWithKey(t *testing.T, key *rsa.PrivateKey, events []testEvent, nonce []byte) ([]byte, []byte, []attest.PCR) {
+	ap := encodeAK(t, key)
+	log, pcrs := buildEventLog(t, events)
+	var banks = map[crypto.Hash][]attest.PCR{}
+	for _, pcr := range pcrs {
+		banks[pcr.DigestAlg] = append(banks[pcr.DigestAlg], pcr)
+	}
+	pp, err := cbor.Marshal(attest.PlatformParameters{
+		TPMVersion: attest.TPMVersion20,
+		Quotes: []attest.Quote{
+			signQuote(t, key, tpm2.AlgSHA1, banks[crypto.SHA1], crypto.SHA256, nonce),
+			signQuote(t, key, tpm2.AlgSHA256, banks[crypto.SHA256], crypto.SHA256, nonce),
+		},
+		PCRs:     pcrs,
+		EventLog: log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ap, pp, pcrs
+}
+
+/*
+	pcrValue returns the value of the PCR @index
+	of the bank @hash in @pcrs.
+*/
+func pcrValue(pcrs []attest.PCR, hash crypto.Hash, index int) []byte {
+	for _, pcr := range pcrs {
+		if pcr.DigestAlg == hash && pcr.Index == index {
+			return pcr.Digest
+		}
+	}
+	return nil
+}
+
+var testEvents = []testEvent{
+	{pcr: 0, typ: evSCRTMVersion, data: utf16Bytes("1.16.2")},
+	{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\debian\shimx64.efi`)},
+	{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\debian\grubx64.efi`)},
+	{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\vmlinuz-6.1.0-13-amd64`)},
+	{pcr: 8, typ: evIPL, data: []byte("grub_cmd: linux /vmlinuz-6.1.0-13-amd64\x00")},
+}
+
+func TestComparePCRs(t *testing.T) {
+	var value = func(b byte) []byte { return bytes.Repeat([]byte{b}, sha256.Size) }
+	log, _ := buildEventLog(t, testEvents)
+	el, err := attest.ParseEventLog(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pcrs = []attest.PCR{
+		{Index: 0, Digest: value(0), DigestAlg: crypto.SHA256},
+		{Index: 4, Digest: value(4), DigestAlg: crypto.SHA256},
+		{Index: 7, Digest: value(7), DigestAlg: crypto.SHA256},
+		{Index: 8, Digest: value(8), DigestAlg: crypto.SHA256},
+		{Index: 4, Digest: value(4)[:20], DigestAlg: crypto.SHA1},
+	}
+	var reference = map[pcrKey][][]byte{
+		{crypto.SHA256, 0}: {value(0)},
+		{crypto.SHA256, 4}: {value(1), value(4)},
+		{crypto.SHA256, 8}: {value(1)},
+		{crypto.SHA256, 9}: {value(9)},
+	}
+
+	var expected = []struct {
+		bank     string
+		index    int
+		status   string
+		expected []byte
+		events   int
+	}{
+		{"SHA1", 4, PCR_UNCHECKED, nil, 0},
+		{"SHA256", 0, PCR_MATCH, value(0), 0},
+		{"SHA256", 4, PCR_MATCH, value(1), 0},
+		{"SHA256", 7, PCR_UNCHECKED, nil, 0},
+		{"SHA256", 8, PCR_MISMATCH, value(1), 1},
+		{"SHA256", 9, PCR_MISSING, value(9), 0},
+	}
+	reports := comparePCRs(pcrs, reference, el)
+	if len(reports) != len(expected) {
+		t.Fatalf("Expected %d PCRs, got %d", len(expected), len(reports))
+	}
+	for i, e := range expected {
+		r := reports[i]
+		if r.Bank != e.bank || r.Index != e.index || r.Status != e.status || !bytes.Equal(r.Expected, e.expected) || r.EventCount() != e.events {
+			t.Errorf("PCR %d: expected %+v, got %+v with %d events", i, e, *r, r.EventCount())
+		}
+	}
+	if reports[4].Event(0).Type != "EV_IPL" || reports[4].Event(1) != nil {
+		t.Errorf("The mismatching PCR must be explained by its events")
+	}
+	if reports[5].Actual != nil {
+		t.Errorf("A missing PCR has no actual value")
+	}
+	if pcrsMatch(reports) || !pcrsMatch(reports[:4]) {
+		t.Errorf("Only mismatching and missing PCRs must fail")
+	}
+
+	if reports := comparePCRs(pcrs, reference, nil); reports[4].EventCount() != 0 {
+		t.Errorf("PCRs can't be explained without an event log")
+	}
+}
+
+func TestDecodeReference(t *testing.T) {
+	var value = bytes.Repeat([]byte{4}, sha256.Size)
+	var pcrs = []attest.PCR{
+		{Index: 4, Digest: value, DigestAlg: crypto.SHA256},
+		{Index: 4, Digest: value[:20], DigestAlg: crypto.SHA1},
+	}
+	legacy, err := GetPCRs(encodePlatform(t, nil, pcrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := []byte(fmt.Sprintf(`  {"pcrs": {"SHA256": {"4": ["%x", "%x"]}}, "secure_boot": true}`, value, value[1:]))
+
+	var cases = []struct {
+		data      []byte
+		reference map[pcrKey][][]byte
+		isPolicy  bool
+		err       bool
+		name      string
+	}{
+		{legacy.Data, map[pcrKey][][]byte{{crypto.SHA256, 4}: {value}, {crypto.SHA1, 4}: {value[:20]}}, false, false, "GetPCRs reference"},
+		{policy, map[pcrKey][][]byte{{crypto.SHA256, 4}: {value, value[1:]}}, true, false, "Policy"},
+		{nil, map[pcrKey][][]byte{}, false, false, "Empty reference"},
+		{[]byte{0xff, 0x00}, nil, false, true, "Invalid CBOR"},
+		{[]byte(`{"pcrs": {"SHA512": {}}}`), nil, false, true, "Unsupported bank"},
+		{[]byte(`{"pcrs": {"SHA256": {"24": []}}}`), nil, false, true, "Invalid index"},
+		{[]byte(`{"kernel": []}`), nil, false, true, "Unknown rule"},
+	}
+
+	for _, c := range cases {
+		reference, p, err := decodeReference(c.data)
+		if c.err {
+			if err == nil {
+				t.Errorf("[%s]: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		if (p != nil) != c.isPolicy {
+			t.Errorf("[%s]: expected a policy: %v", c.name, c.isPolicy)
+		}
+		if fmt.Sprint(reference) != fmt.Sprint(c.reference) {
+			t.Errorf("[%s]: expected %v, got %v", c.name, c.reference, reference)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var nonce = []byte("nonce")
+	ap, pp, pcrs := attestation(t, testEvents, nonce)
+	legacy, err := GetPCRs(pp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := func(rules string) []byte {
+		return []byte(fmt.Sprintf(`{"pcrs": {"SHA256": {"0": ["%x"]}}%s}`, pcrValue(pcrs, crypto.SHA256, 0), rules))
+	}
+
+	var cases = []struct {
+		policy []byte
+		nonce  []byte
+		valid  bool
+		errors []string
+		name   string
+	}{
+		{legacy.Data, nonce, true, nil, "GetPCRs reference"},
+		{policy(""), nonce, true, nil, "Policy"},
+		{policy(`, "firmware": {"min": "1.16"}`), nonce, true, nil, "Policy with event rules"},
+		{[]byte(`{"firmware": {"min": "1.16"}}`), nonce, true, nil, "Policy with event rules only"},
+		{legacy.Data, []byte("replayed"), false, nil, "Wrong nonce"},
+		{policy(`, "firmware": {"min": "1.17"}`), nonce, false, []string{"older than 1.17"}, "Violated rule"},
+		{[]byte(`{"pcrs": {"SHA256": {"4": ["00"]}}}`), nonce, false, []string{"PCR 4 (SHA256) doesn't have an allowed value"}, "Mismatching PCR"},
+		{[]byte(`{"pcrs": {"SHA256": {"9": ["00"]}}}`), nonce, false, []string{"PCR 9 (SHA256) is missing"}, "Missing PCR"},
+		{nil, nonce, false, []string{"no reference value"}, "No policy"},
+		{[]byte(`{}`), nonce, false, []string{"no reference value"}, "Empty policy"},
+	}
+
+	for _, c := range cases {
+		report, err := Verify(ap, pp, c.nonce, c.policy)
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		if report.Valid != c.valid || !report.EventLogValid || report.QuotesValid != bytes.Equal(c.nonce, nonce) {
+			t.Errorf("[%s]: unexpected report %+v", c.name, *report)
+		}
+		if report.PolicyErrorCount() != len(c.errors) {
+			t.Errorf("[%s]: expected %d policy errors, got %v", c.name, len(c.errors), report.policyErrors)
+			continue
+		}
+		for i, e := range c.errors {
+			if !strings.Contains(report.PolicyError(i), e) {
+				t.Errorf("[%s]: expected error %q, got %q", c.name, e, report.PolicyError(i))
+			}
+		}
+	}
+
+	if _, err := Verify(ap, pp, nonce, []byte("{")); err == nil {
+		t.Errorf("An invalid policy must be refused")
+	}
+}
+
+func TestVerifySHA384(t *testing.T) {
+	var nonce = []byte("nonce")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pcrs = []attest.PCR{
+		{Index: 0, Digest: bytes.Repeat([]byte{0}, sha512.Size384), DigestAlg: crypto.SHA384},
+		{Index: 7, Digest: bytes.Repeat([]byte{7}, sha512.Size384), DigestAlg: crypto.SHA384},
+	}
+	// The event log can't be replayed against SHA384 PCRs, so it isn't parsed
+	pp, err := cbor.Marshal(attest.PlatformParameters{
+		TPMVersion: attest.TPMVersion20,
+		Quotes:     []attest.Quote{signQuote(t, key, tpm2.AlgSHA384, pcrs, crypto.SHA256, nonce)},
+		PCRs:       pcrs,
+		EventLog:   []byte("not an event log"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap := encodeAK(t, key)
+
+	report, err := Verify(ap, pp, nonce, []byte(fmt.Sprintf(`{"pcrs": {"SHA384": {"7": ["%x"]}}}`, pcrs[1].Digest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid || !report.QuotesValid || !report.EventLogValid {
+		t.Errorf("Unexpected report %+v", *report)
+	}
+
+	report, err = Verify(ap, pp, nonce, []byte(`{"secure_boot": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid || report.PolicyErrorCount() != 1 || !strings.Contains(report.PolicyError(0), "without an event log") {
+		t.Errorf("Event rules must fail without a replayable event log, got %+v", *report)
+	}
+	if err = ReplayEventLog(pp); err == nil {
+		t.Error("The event log can't be replayed against SHA384 PCRs")
+	}
+}
@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement the `authorize-pcrs` command,
+	which signs a new PCR policy for the enrollment keys sealed with
+	-seal-authorize (see the ultrablue package for authorized policies).
+
+	The authorize key is generated by the `authorize-key` command, and
+	must be kept off the machine, e.g. on the administrator workstation
+	or a removable drive: it is only given to `authorize-pcrs` and to
+	the enrollment with -seal-authorize, and is refused when stored in
+	the keys directory.
+
+	The PCR values are read from the TPM, unless they are given in a JSON
+	file mapping PCR indexes to hex encoded SHA256 values, e.g. the values
+	predicted for the next boot after an update by the `predict` command:
+
+		{"4": "3d45...", "7": "b5a1..."}
+
+	The `revoke-pcrs` command removes a PCR policy authorized before,
+	e.g. once the previous boot chain is no longer used, by the digest
+	of its PCR values. Without digest, it lists the authorized ones.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"ultrablue-server/ultrablue"
+)
+
+/*
+	isInDir returns whether @path is @dir or is below it,
+	once their symbolic links are resolved.
+*/
+func isInDir(path, dir string) (bool, error) {
+	realpath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	realdir, err := filepath.EvalSymlinks(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if realpath, err = filepath.Abs(realpath); err != nil {
+		return false, err
+	}
+	if realdir, err = filepath.Abs(realdir); err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(realdir, realpath)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator)), nil
+}
+
+/*
+	loadAuthorizeKey reads the authorize key at @path, refusing the
+	ones stored in the keys directory @keyspath: it is installed in
+	the initramfs, which isn't encrypted.
+*/
+func loadAuthorizeKey(path, keyspath string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("The authorize key must be given with -key")
+	}
+	inKeysDir, err := isInDir(path, keyspath)
+	if err != nil {
+		return nil, err
+	}
+	if inKeysDir {
+		return nil, fmt.Errorf("The authorize key must be kept off the machine, not in %s", keyspath)
+	}
+	return ultrablue.LoadAuthorizeKey(path)
+}
+
+/*
+	generateAuthorizeKey runs the `authorize-key` command
+	with the given command line @args.
+*/
+func generateAuthorizeKey(args []string) error {
+	var fs = flag.NewFlagSet("authorize-key", flag.ExitOnError)
+	var output = fs.String("o", "", "File to store the new authorize key in")
+	fs.Parse(args)
+
+	if *output == "" {
+		return errors.New("The file to store the authorize key in must be given with -o")
+	}
+	if _, err := ultrablue.GenerateAuthorizeKey(*output); err != nil {
+		return err
+	}
+	logrus.Info("Authorize key stored in ", *output, ", keep it off the attester")
+	return nil
+}
+
+/*
+	authorizePCRs runs the `authorize-pcrs` command with the
+	given command line @args.
+*/
+func authorizePCRs(args []string) error {
+	var fs = flag.NewFlagSet("authorize-pcrs", flag.ExitOnError)
+	var keyspath = fs.String("keys-path", ultrablue.DEFAULT_KEYS_PATH, "Directory holding the sealed enrollment keys and their authorizations")
+	var keyfile = fs.String("key", "", "Authorize key, kept off the machine")
+	var pcrlist = fs.String("pcrs", "", "SHA256 PCRs of the policy to authorize (e.g. \"4,7\")")
+	var valuesfile = fs.String("values", "", "JSON file of the expected PCR values, the current ones are used for missing PCRs")
+	fs.Parse(args)
+
+	pcrs, err := ultrablue.ParsePCRs(*pcrlist)
+	if err != nil {
+		return err
+	}
+	key, err := loadAuthorizeKey(*keyfile, *keyspath)
+	if err != nil {
+		return err
+	}
+
+	var values = make(map[int][]byte)
+	if *valuesfile != "" {
+		if values, err = ultrablue.ReadPCRValues(*valuesfile); err != nil {
+			return err
+		}
+	}
+	var missing []int
+	for _, pcr := range pcrs {
+		if _, ok := values[pcr]; !ok {
+			missing = append(missing, pcr)
+		}
+	}
+	if len(missing) > 0 {
+		logrus.Infof("Reading the current values of PCRs %v", missing)
+		current, err := ultrablue.ReadPCRs(missing)
+		if err != nil {
+			return err
+		}
+		for pcr, value := range current {
+			values[pcr] = value
+		}
+	}
+
+	auth, err := ultrablue.AuthorizePCRs(key, pcrs, values)
+	if err != nil {
+		return err
+	}
+	if err = ultrablue.StoreAuthorization(filepath.Join(*keyspath, ultrablue.AUTHORIZATIONS_FILE), auth); err != nil {
+		return err
+	}
+	logrus.Infof("PCR policy %x authorized", auth.Digest)
+	return nil
+}
+
+/*
+	revokePCRs runs the `revoke-pcrs` command with the
+	given command line @args.
+*/
+func revokePCRs(args []string) error {
+	var fs = flag.NewFlagSet("revoke-pcrs", flag.ExitOnError)
+	var keyspath = fs.String("keys-path", ultrablue.DEFAULT_KEYS_PATH, "Directory holding the sealed enrollment keys and their authorizations")
+	var digest = fs.String("digest", "", "Hex encoded digest of the PCR values to revoke, as printed by authorize-pcrs, lists the authorized ones if empty")
+	fs.Parse(args)
+
+	path := filepath.Join(*keyspath, ultrablue.AUTHORIZATIONS_FILE)
+	if *digest == "" {
+		auths, err := ultrablue.LoadAuthorizations(path)
+		if err != nil {
+			return err
+		}
+		for _, auth := range auths {
+			fmt.Printf("%x PCRs %v\n", auth.Digest, auth.PCRs)
+		}
+		return nil
+	}
+	decoded, err := hex.DecodeString(*digest)
+	if err != nil {
+		return err
+	}
+	n, err := ultrablue.RevokeAuthorization(path, decoded)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("No PCR policy %s is authorized", *digest)
+	}
+	logrus.Infof("PCR policy %s revoked", *digest)
+	return nil
+}
@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsInDir(t *testing.T) {
+	var root = t.TempDir()
+	var keys = filepath.Join(root, "keys")
+	var other = filepath.Join(root, "keys-other")
+
+	for _, dir := range []string{keys, other} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{filepath.Join(keys, "..key"), filepath.Join(other, "key")} {
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(keys, "..key"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(keys, filepath.Join(root, "keys-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		path, dir string
+		inDir     bool
+		name      string
+	}{
+		{filepath.Join(keys, "..key"), keys, true, "Name starting with dots"},
+		{filepath.Join(other, "key"), keys, false, "Directory sharing a prefix"},
+		{filepath.Join(root, "link"), keys, true, "Symbolic link to the directory"},
+		{filepath.Join(keys, "..key"), filepath.Join(root, "keys-link"), true, "Symbolic link directory"},
+		{filepath.Join(other, "key"), filepath.Join(root, "missing"), false, "Missing directory"},
+	}
+
+	for _, c := range cases {
+		inDir, err := isInDir(c.path, c.dir)
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		if inDir != c.inDir {
+			t.Errorf("[%s]: expected %t, got %t", c.name, c.inDir, inDir)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	ultrablue-clevis is the helper of the clevis-encrypt-ultrablue and
+	clevis-decrypt-ultrablue pins (see the clevis/ directory).
+
+	It wraps and unwraps the JWK generated by the pin with a key that
+	is derived from both the enrollment key sealed in the TPM, and the
+	secret released by the verifier on attestation success: both
+	operations thus require the enrolled phone to accept an attestation.
+	Unlike ultrablue-server, it doesn't extend PCR 9 with the secret:
+	the pin runs after boot, and the PCRs other keys are sealed to
+	must keep their values.
+
+	Usage:
+		ultrablue-clevis wrap -uuid UUID [-with-pin] [-mtu MTU] < JWK > BLOB
+		ultrablue-clevis unwrap -uuid UUID [-with-pin] [-mtu MTU] < BLOB > JWK
+*/
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-ble/ble"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+	"ultrablue-server/ultrablue"
+)
+
+const CLEVIS_KEY_LABEL = "clevis"
+
+/*
+	readPIN reads the PIN from the controlling terminal, as
+	stdin already carries the data to wrap or unwrap.
+*/
+func readPIN(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	fmt.Fprintln(tty, prompt)
+	return term.ReadPassword(int(tty.Fd()))
+}
+
+/*
+	wrap encrypts @jwk with AES/GCM under @key, authenticating the
+	verifier @uuid along with it, and returns the IV prefixed
+	ciphertext, base64url encoded.
+*/
+func wrap(key []byte, uuid string, jwk []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aesgcm.NonceSize())
+	if _, err = rand.Read(iv); err != nil {
+		return "", err
+	}
+	data := aesgcm.Seal(iv, iv, jwk, []byte(uuid))
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+/*
+	unwrap is the reverse operation of wrap.
+*/
+func unwrap(key []byte, uuid string, blob string) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(blob))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aesgcm.NonceSize() {
+		return nil, errors.New("The wrapped key is too short")
+	}
+	return aesgcm.Open(nil, data[:aesgcm.NonceSize()], data[aesgcm.NonceSize():], []byte(uuid))
+}
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "wrap" && os.Args[1] != "unwrap") {
+		fmt.Fprintln(os.Stderr, "Usage: ultrablue-clevis wrap|unwrap -uuid UUID [-with-pin] [-mtu MTU] < INPUT > OUTPUT")
+		os.Exit(2)
+	}
+	cmd := os.Args[1]
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	uuid := flags.String("uuid", "", "UUID of the verifier that must accept the attestation")
+	withpin := flags.Bool("with-pin", false, "The enrollment key is sealed with a PIN")
+	mtu := flags.Int("mtu", 500, "Set a custom MTU, which is basically the max size of the BLE packets")
+	loglevel := flags.Int("loglevel", 0, "Indicates the level of logging, 0 is the minimum, 3 is the maximum")
+	flags.Parse(os.Args[2:])
+
+	// Same levels as ultrablue-server, see its initLogger function.
+	var levels = []logrus.Level{logrus.ErrorLevel, logrus.InfoLevel, logrus.DebugLevel, logrus.TraceLevel}
+	if *loglevel > 0 && *loglevel < len(levels) {
+		logrus.SetLevel(levels[*loglevel])
+	} else {
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+	if *uuid == "" {
+		logrus.Fatal("The verifier UUID is required")
+	}
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	ctx := ble.WithSigHandler(context.WithCancel(context.Background()))
+	result, err := ultrablue.Run(ctx, ultrablue.Config{
+		WithPIN:     *withpin,
+		MTU:         *mtu,
+		Verifier:    *uuid,
+		NoPCRExtend: true,
+		ReadPIN:     readPIN,
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if len(result.Secret) == 0 {
+		logrus.Fatal("The verifier didn't send any secret, it must be enrolled with -pcr-extend")
+	}
+	key := ultrablue.DeriveKey(result.Key, result.Secret, CLEVIS_KEY_LABEL)
+
+	switch cmd {
+	case "wrap":
+		blob, err := wrap(key, *uuid, input)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Print(blob)
+	case "unwrap":
+		jwk, err := unwrap(key, *uuid, string(input))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		os.Stdout.Write(jwk)
+	}
+}
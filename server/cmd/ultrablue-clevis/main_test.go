@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrapUnwrap(t *testing.T) {
+	var key = bytes.Repeat([]byte{0x42}, 32)
+	var uuid = "c6d4f0a9-1d2e-4a43-9b3b-8f3c8a6c6a10"
+	var jwk = []byte(`{"alg":"A256GCM","k":"w2lXnv4R3mV0bK1wZ5B0ZnR3d2FzdGhlcmVhbGtleQ","kty":"oct"}`)
+
+	blob, err := wrap(key, uuid, jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := unwrap(key, uuid, blob+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, jwk) {
+		t.Errorf("Expected: %s, got: %s", jwk, unwrapped)
+	}
+	if _, err = unwrap(key, "00000000-0000-0000-0000-000000000000", blob); err == nil {
+		t.Error("The JWK has been unwrapped for another verifier")
+	}
+	if _, err = unwrap(bytes.Repeat([]byte{0x17}, 32), uuid, blob); err == nil {
+		t.Error("The JWK has been unwrapped with another key")
+	}
+	if _, err = unwrap(key, uuid, "AAAA"); err == nil {
+		t.Error("A truncated blob has been unwrapped")
+	}
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file show the progress of the attestation
+	and the PIN prompts to the user. At boot, the console is hidden
+	under the Plymouth splash screen, so they go through Plymouth when
+	its daemon is running, and to the console otherwise.
+
+	When started by systemd, there is no terminal to read the PIN
+	from: it is asked for with systemd-ask-password, whose agents
+	forward the prompt to Plymouth, the console or a user session.
+
+	Messages are written on stderr, as stdout carries the unlock key
+	when running as the LUKS2 token helper.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+/*
+	display shows messages and PIN prompts to the user.
+*/
+type display struct {
+	plymouth    bool   // The Plymouth daemon is running
+	askPassword string // Path of systemd-ask-password, when started by systemd
+	message     string // Message currently displayed by Plymouth
+}
+
+/*
+	newDisplay returns a display using Plymouth
+	if its daemon is running.
+*/
+func newDisplay() *display {
+	var d = display{plymouth: exec.Command("plymouth", "--ping").Run() == nil}
+
+	// Set by systemd for the processes of its units
+	if os.Getenv("INVOCATION_ID") != "" {
+		d.askPassword, _ = exec.LookPath("systemd-ask-password")
+	}
+	return &d
+}
+
+/*
+	show displays @text, replacing the previous message.
+*/
+func (d *display) show(text string) {
+	if d.plymouth {
+		if d.message != "" {
+			exec.Command("plymouth", "hide-message", "--text=" + d.message).Run()
+		}
+		err := exec.Command("plymouth", "display-message", "--text=" + text).Run()
+		if err == nil {
+			d.message = text
+			return
+		}
+		logrus.Debug("Failed to display a message with Plymouth: ", err)
+	}
+	fmt.Fprintln(os.Stderr, text)
+}
+
+/*
+	readPIN displays @prompt and reads a PIN, with
+	systemd-ask-password when started by systemd, with
+	Plymouth if available, from the terminal otherwise.
+*/
+func (d *display) readPIN(prompt string) ([]byte, error) {
+	if d.askPassword != "" {
+		pin, err := exec.Command(d.askPassword, "--id=ultrablue", prompt).Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to ask for the PIN with systemd-ask-password: %v", err)
+		}
+		return []byte(strings.TrimRight(string(pin), "\n")), nil
+	}
+	if d.plymouth {
+		pin, err := exec.Command("plymouth", "ask-for-password", "--prompt=" + prompt).Output()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to ask for the PIN with Plymouth: %v", err)
+		}
+		return []byte(strings.TrimRight(string(pin), "\n")), nil
+	}
+	fmt.Fprintln(os.Stderr, prompt)
+	return term.ReadPassword(syscall.Stdin)
+}
@@ -22,7 +22,17 @@ depends() {
 install() {
     inst_multiple -o \
         /usr/bin/ultrablue-server \
-        "${systemdsystemunitdir}"/ultrablue-server.service
+        /etc/ultrablue/*
 
-    $SYSTEMCTL -q --root "$initdir" enable ultrablue-server.service
+    # When the LUKS2 token plugin is available, systemd-cryptsetup runs the
+    # attestation itself. Otherwise, fall back to the standalone service,
+    # that extends the PCR the disk encryption is bound to.
+    if inst_libdir_file "cryptsetup/libcryptsetup-token-ultrablue.so"; then
+        inst_multiple -o \
+            "${systemdsystemunitdir}"/systemd-cryptsetup@.service.d/ultrablue.conf
+    else
+        inst_multiple -o \
+            "${systemdsystemunitdir}"/ultrablue-server.service
+        $SYSTEMCTL -q --root "$initdir" enable ultrablue-server.service
+    fi
 }
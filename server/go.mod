@@ -5,23 +5,23 @@ go 1.18
 require (
 	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/go-ble/ble v0.0.0-20220207185428-60d1eecf2633
+	github.com/google/certificate-transparency-go v1.1.1
 	github.com/google/go-attestation v0.4.3
 	github.com/google/go-tpm v0.3.3
 	github.com/google/uuid v1.1.1
+	github.com/pkg/errors v0.8.1
 	github.com/sirupsen/logrus v1.5.0
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
 
 require (
-	github.com/google/certificate-transparency-go v1.1.1 // indirect
 	github.com/google/go-tspi v0.2.1-0.20190423175329-115dea689aad // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/mattn/go-colorable v0.1.6 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
 	github.com/mgutz/logxi v0.0.0-20161027140823-aebf8a7d67ab // indirect
-	github.com/pkg/errors v0.8.1 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/crypto v0.0.0-20210314154223-e6e6c4f2bb5b // indirect
 	golang.org/x/sys v0.0.0-20211204120058-94396e421777 // indirect
@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement the server side of the `ultrablue`
+	LUKS2 token type.
+
+	A LUKS2 keyslot is bound to a verifier at enroll time: its passphrase
+	is derived from both the enrollment key (sealed in the TPM) and the
+	secret the verifier sends back on attestation success, so that neither
+	the computer nor the phone alone is able to unlock the disk.
+	A token referencing the verifier is stored in the LUKS2 header, next to
+	the keyslot.
+
+	At boot time, the libcryptsetup plugin (see the luks2/ directory) runs
+	the server in token helper mode (-luks-token): the token JSON is read on
+	the standard input, an attestation is performed, and on success the
+	passphrase is written on the standard output.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"ultrablue-server/ultrablue"
+)
+
+const LUKS2_TOKEN_TYPE = "ultrablue"
+
+// LUKS2Token is the JSON object stored in the LUKS2 header tokens area.
+// The type and keyslots fields are mandatory for all LUKS2 tokens,
+// the other ones are specific to ultrablue.
+type LUKS2Token struct {
+	Type      string   `json:"type"`
+	Keyslots  []string `json:"keyslots"`
+	UUID      string   `json:"ultrablue-uuid"`       // Verifier allowed to unlock the keyslot
+	PCRExtend int      `json:"ultrablue-pcr-extend"` // PCR extended with the verifier secret on success, informative only
+	PIN       bool     `json:"ultrablue-pin"`        // Whether the enrollment key is sealed with a PIN
+}
+
+/*
+	deriveUnlockKey returns the LUKS2 keyslot passphrase for the
+	given enrollment @key and verifier @secret, hex-encoded so that
+	it can also be typed or passed around as a regular passphrase.
+*/
+func deriveUnlockKey(key, secret []byte) []byte {
+	return []byte(hex.EncodeToString(ultrablue.DeriveKey(key, secret, LUKS2_TOKEN_TYPE)))
+}
+
+/*
+	readLUKS2Token reads the token JSON from @r, optionally followed
+	by a newline and the PIN that unseals the enrollment key.
+*/
+func readLUKS2Token(r io.Reader) (*LUKS2Token, []byte, error) {
+	var token LUKS2Token
+
+	br := bufio.NewReader(r)
+	line, err := br.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if err = json.Unmarshal(line, &token); err != nil {
+		return nil, nil, err
+	}
+	if token.Type != LUKS2_TOKEN_TYPE {
+		return nil, nil, errors.New("Invalid token type: " + token.Type)
+	}
+	if token.UUID == "" {
+		return nil, nil, errors.New("The token doesn't reference any verifier")
+	}
+	pin, err := io.ReadAll(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &token, pin, nil
+}
+
+/*
+	luksKeyslots returns the sorted list of the keyslots currently
+	in use in the LUKS2 header of @device.
+*/
+func luksKeyslots(device string) ([]string, error) {
+	var metadata struct {
+		Keyslots map[string]json.RawMessage `json:"keyslots"`
+	}
+
+	out, err := exec.Command("cryptsetup", "luksDump", "--dump-json-metadata", device).Output()
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(out, &metadata); err != nil {
+		return nil, err
+	}
+	var slots []string
+	for slot := range metadata.Keyslots {
+		slots = append(slots, slot)
+	}
+	sort.Strings(slots)
+	return slots, nil
+}
+
+/*
+	luksEnroll adds a new keyslot to the LUKS2 @device, unlockable with
+	the @passphrase, and stores an ultrablue token referencing
+	the verifier @uuid next to it.
+	cryptsetup will prompt for an existing passphrase of the device.
+*/
+func luksEnroll(device, uuid string, passphrase []byte) error {
+	before, err := luksKeyslots(device)
+	if err != nil {
+		return err
+	}
+
+	keyfile, err := os.CreateTemp("", "ultrablue-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keyfile.Name())
+	defer keyfile.Close()
+	if _, err = keyfile.Write(passphrase); err != nil {
+		return err
+	}
+
+	fmt.Println("Enter an existing passphrase of", device)
+	cmd := exec.Command("cryptsetup", "luksAddKey", device, keyfile.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = cmd.Run(); err != nil {
+		return err
+	}
+
+	after, err := luksKeyslots(device)
+	if err != nil {
+		return err
+	}
+	var used = make(map[string]bool)
+	for _, slot := range before {
+		used[slot] = true
+	}
+	var keyslots []string
+	for _, slot := range after {
+		if !used[slot] {
+			keyslots = append(keyslots, slot)
+		}
+	}
+	if len(keyslots) != 1 {
+		return errors.New("Failed to find the newly added keyslot")
+	}
+
+	token, err := json.Marshal(LUKS2Token{
+		Type:      LUKS2_TOKEN_TYPE,
+		Keyslots:  keyslots,
+		UUID:      uuid,
+		PCRExtend: ultrablue.PCR_EXTENSION_INDEX,
+		PIN:       *withpin,
+	})
+	if err != nil {
+		return err
+	}
+	cmd = exec.Command("cryptsetup", "token", "import", device, "--json-file", "-")
+	cmd.Stdin, cmd.Stderr = strings.NewReader(string(token)), os.Stderr
+	if err = cmd.Run(); err != nil {
+		return err
+	}
+	logrus.Infof("Keyslot %s of %s bound to verifier %s", keyslots[0], device, uuid)
+	return nil
+}
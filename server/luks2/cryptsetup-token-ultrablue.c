@@ -0,0 +1,220 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	libcryptsetup external token plugin for the `ultrablue` LUKS2 token type.
+
+	The plugin does not speak Bluetooth nor talk to the TPM itself: it spawns
+	ultrablue-server in token helper mode, writes the token JSON (followed by
+	the PIN, if any) on its standard input, and reads the unlock key back on
+	its standard output once the phone accepted the attestation.
+
+	The plugin is loaded by the host process (e.g. systemd-cryptsetup), so it
+	must not change its global state: the standard input of the helper is a
+	socket rather than a pipe, so that writing to it once the helper exited
+	fails with EPIPE instead of raising SIGPIPE.
+
+	See `man cryptsetup` (LUKS2 tokens) and libcryptsetup.h for the plugin
+	interface.
+*/
+
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/socket.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+#include <json-c/json.h>
+#include <libcryptsetup.h>
+
+#define ULTRABLUE_TOKEN_VERSION "1.0"
+#define ULTRABLUE_SERVER "/usr/bin/ultrablue-server"
+#define ULTRABLUE_KEY_MAX 256
+
+const char *cryptsetup_token_version(void)
+{
+	return ULTRABLUE_TOKEN_VERSION;
+}
+
+static int send_all(int fd, const char *buf, size_t len)
+{
+	while (len > 0) {
+		ssize_t n = send(fd, buf, len, MSG_NOSIGNAL);
+		if (n < 0) {
+			if (errno == EINTR)
+				continue;
+			return -errno;
+		}
+		buf += n;
+		len -= n;
+	}
+	return 0;
+}
+
+/*
+	run_helper runs ultrablue-server in token helper mode, feeding it the
+	token @json and the optional @pin, and stores its output in @key.
+	Returns the number of bytes read on success, a negative errno otherwise.
+*/
+static int run_helper(struct crypt_device *cd, const char *json, const char *pin, size_t pin_size, char *key, size_t key_size)
+{
+	int in[2], out[2];
+	int status, r = 0;
+	size_t len = 0;
+	pid_t pid;
+
+	if (socketpair(AF_UNIX, SOCK_STREAM, 0, in) < 0)
+		return -errno;
+	if (pipe(out) < 0) {
+		r = -errno;
+		close(in[0]);
+		close(in[1]);
+		return r;
+	}
+
+	pid = fork();
+	if (pid < 0) {
+		r = -errno;
+		close(in[0]); close(in[1]);
+		close(out[0]); close(out[1]);
+		return r;
+	}
+	if (pid == 0) {
+		dup2(in[0], STDIN_FILENO);
+		dup2(out[1], STDOUT_FILENO);
+		close(in[0]); close(in[1]);
+		close(out[0]); close(out[1]);
+		execl(ULTRABLUE_SERVER, ULTRABLUE_SERVER, "-luks-token", (char *)NULL);
+		_exit(127);
+	}
+	close(in[0]);
+	close(out[1]);
+
+	/* The helper may exit early, e.g. on an invalid token. */
+	r = send_all(in[1], json, strlen(json));
+	if (r == 0)
+		r = send_all(in[1], "\n", 1);
+	if (r == 0 && pin && pin_size > 0)
+		r = send_all(in[1], pin, pin_size);
+	close(in[1]);
+
+	while (r == 0 && len < key_size) {
+		ssize_t n = read(out[0], key + len, key_size - len);
+		if (n < 0 && errno == EINTR)
+			continue;
+		if (n < 0)
+			r = -errno;
+		if (n <= 0)
+			break;
+		len += n;
+	}
+	close(out[0]);
+
+	if (waitpid(pid, &status, 0) < 0)
+		return -errno;
+	if (r < 0)
+		return r;
+	if (!WIFEXITED(status) || WEXITSTATUS(status) != 0 || len == 0) {
+		crypt_log(cd, CRYPT_LOG_ERROR, "Ultrablue attestation failed.\n");
+		return -EACCES;
+	}
+	return len;
+}
+
+static json_object *token_field(json_object *jobj, const char *name, json_type type)
+{
+	json_object *val;
+
+	if (!json_object_object_get_ex(jobj, name, &val) || !json_object_is_type(val, type))
+		return NULL;
+	return val;
+}
+
+int cryptsetup_token_open_pin(struct crypt_device *cd, int token, const char *pin, size_t pin_size, char **buffer, size_t *buffer_len, void *usrptr)
+{
+	json_object *jobj, *jpin;
+	const char *json;
+	char *key;
+	int r;
+
+	(void)usrptr;
+
+	r = crypt_token_json_get(cd, token, &json);
+	if (r < 0)
+		return r;
+
+	jobj = json_tokener_parse(json);
+	if (!jobj)
+		return -EINVAL;
+	jpin = token_field(jobj, "ultrablue-pin", json_type_boolean);
+	if (jpin && json_object_get_boolean(jpin) && !pin) {
+		json_object_put(jobj);
+		return -ENOANO; /* Let the caller ask for the PIN */
+	}
+	json_object_put(jobj);
+
+	key = calloc(1, ULTRABLUE_KEY_MAX);
+	if (!key)
+		return -ENOMEM;
+	r = run_helper(cd, json, pin, pin_size, key, ULTRABLUE_KEY_MAX);
+	if (r < 0) {
+		free(key);
+		return r;
+	}
+	*buffer = key;
+	*buffer_len = r;
+	return 0;
+}
+
+int cryptsetup_token_open(struct crypt_device *cd, int token, char **buffer, size_t *buffer_len, void *usrptr)
+{
+	return cryptsetup_token_open_pin(cd, token, NULL, 0, buffer, buffer_len, usrptr);
+}
+
+void cryptsetup_token_buffer_free(void *buffer, size_t buffer_len)
+{
+	if (!buffer)
+		return;
+	explicit_bzero(buffer, buffer_len);
+	free(buffer);
+}
+
+int cryptsetup_token_validate(struct crypt_device *cd, const char *json)
+{
+	json_object *jobj, *jpcr;
+	int r = 0;
+
+	jobj = json_tokener_parse(json);
+	if (!jobj)
+		return -EINVAL;
+	if (!token_field(jobj, "ultrablue-uuid", json_type_string)) {
+		crypt_log(cd, CRYPT_LOG_DEBUG, "Missing or invalid ultrablue-uuid field.\n");
+		r = -EINVAL;
+	}
+	/* The helper checks that it extends this PCR on success. */
+	jpcr = token_field(jobj, "ultrablue-pcr-extend", json_type_int);
+	if (!jpcr || json_object_get_int(jpcr) < 0 || json_object_get_int(jpcr) > 23) {
+		crypt_log(cd, CRYPT_LOG_DEBUG, "Missing or invalid ultrablue-pcr-extend field.\n");
+		r = -EINVAL;
+	}
+	json_object_put(jobj);
+	return r;
+}
+
+void cryptsetup_token_dump(struct crypt_device *cd, const char *json)
+{
+	json_object *jobj, *val;
+
+	jobj = json_tokener_parse(json);
+	if (!jobj)
+		return;
+	if ((val = token_field(jobj, "ultrablue-uuid", json_type_string)))
+		crypt_log(cd, CRYPT_LOG_NORMAL, "\tVerifier:   %s\n", json_object_get_string(val));
+	if ((val = token_field(jobj, "ultrablue-pcr-extend", json_type_int)))
+		crypt_log(cd, CRYPT_LOG_NORMAL, "\tPCR extend: %d\n", json_object_get_int(val));
+	if ((val = token_field(jobj, "ultrablue-pin", json_type_boolean)))
+		crypt_log(cd, CRYPT_LOG_NORMAL, "\tPIN:        %s\n", json_object_get_boolean(val) ? "true" : "false");
+	json_object_put(jobj);
+}
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadLUKS2Token(t *testing.T) {
+	var cases = []struct {
+		input string
+		valid bool
+		pin   string
+		name  string
+	}{
+		{`{"type":"ultrablue","keyslots":["1"],"ultrablue-uuid":"c6d4f0a9-1d2e-4a43-9b3b-8f3c8a6c6a10","ultrablue-pcr-extend":9}`, true, "", "Token without PIN"},
+		{`{"type":"ultrablue","keyslots":["1"],"ultrablue-uuid":"c6d4f0a9-1d2e-4a43-9b3b-8f3c8a6c6a10","ultrablue-pcr-extend":9,"ultrablue-pin":true}` + "\n1234", true, "1234", "Token followed by a PIN"},
+		{`{"type":"systemd-tpm2","keyslots":["1"],"ultrablue-uuid":"c6d4f0a9-1d2e-4a43-9b3b-8f3c8a6c6a10"}`, false, "", "Invalid token type"},
+		{`{"type":"ultrablue","keyslots":["1"],"ultrablue-pcr-extend":9}`, false, "", "Missing verifier UUID"},
+		{`{"type":"ultrablue",`, false, "", "Invalid JSON"},
+	}
+
+	for _, c := range cases {
+		token, pin, err := readLUKS2Token(strings.NewReader(c.input))
+		if (err == nil) != c.valid {
+			t.Errorf("[%s]: expected valid: %t, got error: %v", c.name, c.valid, err)
+			continue
+		}
+		if c.valid && string(pin) != c.pin {
+			t.Errorf("[%s]: expected PIN %q, got %q", c.name, c.pin, pin)
+		}
+		if c.valid && token.UUID == "" {
+			t.Errorf("[%s]: the verifier UUID has not been parsed", c.name)
+		}
+	}
+}
+
+func TestDeriveUnlockKey(t *testing.T) {
+	var key = bytes.Repeat([]byte{0x42}, 32)
+	var secret = bytes.Repeat([]byte{0x17}, 16)
+
+	k1 := deriveUnlockKey(key, secret)
+	if len(k1) != 64 {
+		t.Errorf("Expected a 64 characters passphrase, got %d", len(k1))
+	}
+	if !bytes.Equal(k1, deriveUnlockKey(key, secret)) {
+		t.Error("The passphrase derivation is not deterministic")
+	}
+	if bytes.Equal(k1, deriveUnlockKey(key, secret[1:])) || bytes.Equal(k1, deriveUnlockKey(key[1:], secret)) {
+		t.Error("The passphrase doesn't depend on both the enrollment key and the verifier secret")
+	}
+}
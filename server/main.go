@@ -6,28 +6,39 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
 
 	"github.com/go-ble/ble"
-	"github.com/go-ble/ble/linux"
 	"github.com/sirupsen/logrus"
+	"ultrablue-server/ultrablue"
 )
 
 // Command line arguments - Global variables
 var (
+	akrotation   = flag.Duration("ak-rotation", ultrablue.DEFAULT_AK_ROTATION, "Replace the attestation key once older than this duration, so that the verifier certifies a new one")
+	authkey      = flag.String("authorize-key", "", "With -seal-authorize, the authorize key signing the current PCR values on enrollment, kept off the machine")
+	daemon       = flag.Bool("daemon", false, "Keep serving the enrolled verifiers after boot, for on-demand attestations that don't extend PCRs")
 	enroll       = flag.Bool("enroll", false, "Must be set for a first time attestation (known as the enrollment)")
+	hcitimeout   = flag.Duration("hci-timeout", ultrablue.DEFAULT_HCI_TIMEOUT, "Maximum time to wait for the Bluetooth adapter to be ready")
+	imalog       = flag.Bool("ima-log", false, "Send the IMA runtime measurement log to the verifiers that ask for it, to attest the system after boot")
 	loglevel     = flag.Int("loglevel", 1, "Indicates the level of logging, 0 is the minimum, 3 is the maximum")
+	luksdevice   = flag.String("luks-device", "", "On enrollment, bind a new keyslot of the given LUKS2 device to the verifier (implies -pcr-extend)")
+	lukstoken    = flag.Bool("luks-token", false, "Run as the LUKS2 token helper: read the token on stdin and write the unlock key on stdout")
 	mtu          = flag.Int("mtu", 500, "Set a custom MTU, which is basically the max size of the BLE packets")
+	ratelimit    = flag.Duration("rate-limit", ultrablue.DEFAULT_RATE_LIMIT, "In daemon mode, minimum delay between two attestations of a verifier")
+	pinretries   = flag.Int("pin-retries", ultrablue.DEFAULT_PIN_RETRIES, "Number of times the PIN is asked for when a wrong one is entered")
 	pcrextend    = flag.Bool("pcr-extend", false, "Extend the 9th PCR with the verifier secret on attestation success")
+	sealauth     = flag.Bool("seal-authorize", false, "With -seal-pcrs, seal to PCR policies signed by the authorize key, so that they can be updated with authorize-pcrs")
+	sealpcrs     = flag.String("seal-pcrs", "", "On enrollment, also seal the encryption key to the current values of the given SHA256 PCRs (e.g. \"7\")")
 	withpin      = flag.Bool("with-pin", false, "Use a PIN to seal the encryption key to the TPM (default is sealing to the SRK without password)")
 )
 
-// Encryption key used at enroll time. It needs to be globally available
-// to be accessible from the protocol functions
-var enrollkey []byte
-
-const ULTRABLUE_KEYS_PATH = "/etc/ultrablue/"
+// Progress and PIN prompts display, set once the flags are parsed
+var ui *display
 
 /*
 	initLogger sets the level of logging
@@ -53,100 +64,152 @@ func initLogger(loglevel int) {
 }
 
 /*
-	ARCHITECTURE OVERVIEW
-
-	Ultrablue is a client-server application that operates over
-	Bluetooth Low Energy (BLE). This tool acts as the server.
-
-	BLE is a client-driven transport layer, in the sense that
-	the server exposes characteristics and it is up to the client to read or
-	write them whenever it wants.
-
-	Ultrablue implements an inversion of control through several components,
-	abstracting the BLE layer and allowing the server to drive the exchange.
-	Each of those components, briefly described here, is implemented in a
-	dedicated file named after the functionality.
-
-	- The characteristic: Bluetooth Low Energy sends/receives data through
-	  characteristics. When a characteristic is advertised by a device, clients
-	  are able to see it and can read/write on it if allowed by the advertising
-	  device. When a client performs a read/write operation, the characteristic
-	  will process it through handlers.
-	  Ultrablue only exposes one characteristic, enabled both for reading and
-	  writing.
-
-	- The state: The state is a data structure that holds information about the
-	  currently running read/write operation on the characteristic for a
-	  connection.
-	  It has a go channel, that abstracts the characteristic handlers and makes
-	  possible to read/write full messages to the channel without dealing with BLE
-	  internals (chunking, size prefix...).
-	  The state is created on the first client interaction with the characteristic,
-	  and lives as long as the client connection does.
-	  When the state is created, it also runs a protocol instance that operates
-	  on the above-mentioned channel and runs in a dedicated goroutine.
-
-	- The session: It wraps the state channel and keeps information on how to
-	  read/write data into it, e.g. if messages must be encrypted/decrypted.
-	  A StartEncryption method is available so that the caller can make the session
-	  encrypted whenever they want.
-	  The session also exposes two functions to communicate with clients: SendMsg
-	  and recvMsg. These functions make use of the abstractions provided by lower
-	  layers to operate on the characteristic (through the go channel of the
-	  state); upper layers should never need to call the lower layers directly.
-
-	- The protocol: It implements the actual remote attestation routine. It is
-	  split in several steps, each implemented in its own function. Thanks to
-	  previous abstractions, the server doesn't care of the transport layer and
-	  only relies on the session and its exported methods/functions to communicate
-	  with clients.
-
-	Note: The server only accepts one simulteanous client.
+	fatal reports @err to the service manager, so that the
+	unit status tells why it failed, and exits.
 */
+func fatal(err error) {
+	ultrablue.Notify("STATUS=" + err.Error())
+	if ui != nil {
+		ui.show("Attestation failed: " + err.Error())
+	}
+	logrus.Fatal(err)
+}
 
+/*
+	The attester itself is implemented in the ultrablue package,
+	see its documentation for an overview of the architecture.
+	This command only maps the command line arguments to its
+	configuration, and handles the integrations that need the
+	attestation result (e.g. LUKS2).
+*/
 func main() {
 	flag.Parse()
 	initLogger(*loglevel)
 
-	logrus.Info("Opening the default HCI device")
-	device, err := linux.NewDevice()
+	if flag.Arg(0) == "authorize-pcrs" {
+		if err := authorizePCRs(flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "revoke-pcrs" {
+		if err := revokePCRs(flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "authorize-key" {
+		if err := generateAuthorizeKey(flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "predict" {
+		if err := predict(flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "status" {
+		if err := status(flag.Args()[1:]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	ui = newDisplay()
+	pcrs, err := ultrablue.ParsePCRs(*sealpcrs)
 	if err != nil {
-		logrus.Fatal(err)
+		fatal(err)
+	}
+	if *sealauth && len(pcrs) == 0 {
+		fatal(errors.New("-seal-authorize requires the PCRs of the policy to be given with -seal-pcrs"))
+	}
+	if *sealauth && (!*enroll || *authkey == "") {
+		fatal(errors.New("-seal-authorize is an enrollment option, that requires the authorize key to be given with -authorize-key"))
+	}
+	if *daemon && (*enroll || *pcrextend || *luksdevice != "" || *lukstoken) {
+		fatal(errors.New("-daemon can't be used with -enroll, -pcr-extend, -luks-device or -luks-token"))
 	}
-	ble.SetDefaultDevice(device)
-	defer device.Stop()
 
-	if *enroll {
-		logrus.Info("Generating symmetric key")
-		if enrollkey, err = TPM2_GetRandom(32); err != nil {
-			logrus.Fatal(err)
+	var authorizeKey *ecdsa.PrivateKey
+	if *sealauth {
+		if authorizeKey, err = loadAuthorizeKey(*authkey, ultrablue.DEFAULT_KEYS_PATH); err != nil {
+			fatal(err)
 		}
 	}
 
-	logrus.Info("Registering ultrablue service and characteristic")
-	ultrablueSvc := ble.NewService(ultrablueSvcUUID)
-	ultrablueSvc.AddCharacteristic(UltrablueChr(*mtu))
-	if err := ble.AddService(ultrablueSvc); err != nil {
-		logrus.Fatal(err)
+	var cfg = ultrablue.Config{
+		Enroll:        *enroll,
+		PCRExtend:     *pcrextend || *luksdevice != "",
+		WithPIN:       *withpin,
+		PINRetries:    *pinretries,
+		SealPCRs:      pcrs,
+		SealAuthorize: *sealauth,
+		AuthorizeKey:  authorizeKey,
+		MTU:           *mtu,
+		HCITimeout:    *hcitimeout,
+		AKRotation:    *akrotation,
+		IMALog:        *imalog,
+		Daemon:        *daemon,
+		RateLimit:     *ratelimit,
+		ReadPIN:       ui.readPIN,
+		OnStatus:      ui.show,
+		OnEnroll: func(data string) {
+			logrus.Info("Generating enrollment QR code")
+			qrcode, err := generateQRCode(data)
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Print(qrcode)
+		},
 	}
 
-	logrus.Info("Start advertising")
-	ctx := ble.WithSigHandler(context.WithCancel(context.Background()))
-	go ble.AdvertiseNameAndServices(ctx, "Ultrablue server", ultrablueSvc.UUID)
-
-	if *enroll {
-		logrus.Info("Generating enrollment QR code")
-		addr := device.Address().String()
-		json := fmt.Sprintf(`{"addr":"%s","key":"%x"}`, addr, enrollkey)
-		qrcode, err := generateQRCode(json)
+	if *lukstoken {
+		token, pin, err := readLUKS2Token(os.Stdin)
 		if err != nil {
-			logrus.Fatal(err)
+			fatal(err)
+		}
+		cfg.Verifier = token.UUID
+		cfg.WithPIN = token.PIN
+		// The PIN comes from the token plugin: asking for it
+		// again would only increment the lockout counter.
+		cfg.PINRetries = 1
+		cfg.ReadPIN = func(string) ([]byte, error) {
+			return pin, nil
 		}
-		fmt.Print(qrcode)
 	}
 
-	select {
-	case <-ctx.Done():
-		logrus.Fatal(ctx.Err())
+	ctx := ble.WithSigHandler(context.WithCancel(context.Background()))
+	result, err := ultrablue.Run(ctx, cfg)
+	if *daemon && errors.Is(err, context.Canceled) {
+		logrus.Info("Stopping")
+		return
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if *enroll && *luksdevice != "" {
+		if len(result.Secret) == 0 {
+			fatal(errors.New("The verifier didn't send any secret to bind the LUKS2 keyslot to"))
+		}
+		logrus.Info("Binding a LUKS2 keyslot to the verifier")
+		passphrase := deriveUnlockKey(result.Key, result.Secret)
+		if err = luksEnroll(*luksdevice, result.UUID.String(), passphrase); err != nil {
+			fatal(err)
+		}
+	}
+	if *lukstoken {
+		if len(result.Secret) == 0 {
+			fatal(errors.New("The verifier didn't send any secret to unlock the LUKS2 keyslot"))
+		}
+		if _, err = os.Stdout.Write(deriveUnlockKey(result.Key, result.Secret)); err != nil {
+			fatal(err)
+		}
 	}
+	// The attester is only ready once the outcome has been handled,
+	// so that the units ordered after a Type=notify one wait for it
+	ultrablue.Notify("READY=1\nSTATUS=Attested to verifier " + result.UUID.String())
+	ui.show("Attestation success")
 }
@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement the `predict` command, which
+	predicts the PCR values of the next boot once an update of the
+	boot chain has been installed (see predict.go in the ultrablue
+	package). E.g. after a kernel update, with GRUB:
+
+		ultrablue-server predict \
+			-file /vmlinuz-6.1.0-13-amd64=/boot/vmlinuz-6.1.0-13-amd64 \
+			-string "grub_cmd: linux /vmlinuz-6.1.0-12-amd64 root=...=grub_cmd: linux /vmlinuz-6.1.0-13-amd64 root=..."
+
+	or with an UKI loaded by systemd-boot:
+
+		ultrablue-server predict -kernel /efi/EFI/Linux/debian-6.1.0-13-amd64.efi
+
+	The prediction is stored in the keys directory, and sent to the
+	verifiers that ask for it. It can also be given to authorize-pcrs.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"ultrablue-server/ultrablue"
+)
+
+const defaultEventLog = "/sys/kernel/security/tpm0/binary_bios_measurements"
+
+/*
+	mappingFlag is a repeatable flag of the form KEY=VALUE.
+*/
+type mappingFlag map[string]string
+
+func (m mappingFlag) String() string {
+	return fmt.Sprint(map[string]string(m))
+}
+
+func (m mappingFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("%q isn't of the form KEY=VALUE", s)
+	}
+	m[key] = value
+	return nil
+}
+
+/*
+	readFiles returns the content of the files @paths,
+	by key of the mapping.
+*/
+func readFiles(paths mappingFlag) (map[string][]byte, error) {
+	var files = make(map[string][]byte)
+
+	for key, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files[key] = data
+	}
+	return files, nil
+}
+
+/*
+	predict runs the `predict` command with the
+	given command line @args.
+*/
+func predict(args []string) error {
+	var fs = flag.NewFlagSet("predict", flag.ExitOnError)
+	var images, files, strs = make(mappingFlag), make(mappingFlag), make(mappingFlag)
+	var keyspath = fs.String("keys-path", ultrablue.DEFAULT_KEYS_PATH, "Directory to store the prediction in, for the verifiers")
+	var eventlog = fs.String("eventlog", defaultEventLog, "Event log of the current boot")
+	var kernel = fs.String("kernel", "", "New kernel or UKI, replacing the current one")
+	var cmdline = fs.String("cmdline", "", "New kernel command line measured by GRUB")
+	var dbx = fs.String("dbx", "", "New content of the dbx variable, without its authentication header")
+	var phases = fs.String("phases", "enter-initrd", "Comma separated systemd-pcrphase phases measured in PCR11 before the attestation")
+	var output = fs.String("o", "", "Also write the prediction to this file")
+	fs.Var(images, "image", "New boot application, as ESPPATH=FILE (e.g. \\EFI\\debian\\shimx64.efi=/usr/lib/shim/shimx64.efi.signed), can be repeated")
+	fs.Var(files, "file", "New file measured by GRUB, as PATH=FILE, can be repeated")
+	fs.Var(strs, "string", "New string measured by GRUB, as OLD=NEW, can be repeated")
+	fs.Parse(args)
+
+	el, err := os.ReadFile(*eventlog)
+	if err != nil {
+		return err
+	}
+	current, err := ultrablue.ReadPCRs(ultrablue.PREDICTED_PCRS)
+	if err != nil {
+		return err
+	}
+	// The current event log must replay to the current PCRs for
+	// the prediction to be meaningful
+	replayed, err := ultrablue.PredictPCRs(el, &ultrablue.Prediction{})
+	if err != nil {
+		return err
+	}
+	for _, pcr := range ultrablue.PREDICTED_PCRS {
+		if !bytes.Equal(replayed[pcr], current[pcr]) {
+			logrus.Warnf("PCR %d doesn't match the event log, it may have been extended since boot", pcr)
+		}
+	}
+
+	var p = ultrablue.Prediction{Strings: strs}
+	if p.Images, err = readFiles(images); err != nil {
+		return err
+	}
+	if p.Files, err = readFiles(files); err != nil {
+		return err
+	}
+	if *kernel != "" {
+		if p.Kernel, err = os.ReadFile(*kernel); err != nil {
+			return err
+		}
+	}
+	if *dbx != "" {
+		if p.DBX, err = os.ReadFile(*dbx); err != nil {
+			return err
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "cmdline" {
+			p.Cmdline = cmdline
+		}
+	})
+	if *phases != "" {
+		p.Phases = strings.Split(*phases, ",")
+	}
+
+	predicted, err := ultrablue.PredictPCRs(el, &p)
+	if err != nil {
+		return err
+	}
+	for _, pcr := range ultrablue.PREDICTED_PCRS {
+		if value, ok := predicted[pcr]; ok {
+			logrus.Infof("PCR %d: %x", pcr, value)
+		} else {
+			logrus.Warnf("PCR %d isn't predicted: the updated images may be verified by other Secure Boot authorities, and the verifiers keep allowing its current values only", pcr)
+		}
+	}
+	if *output != "" {
+		if err = ultrablue.WritePCRValues(*output, predicted); err != nil {
+			return err
+		}
+	}
+	if _, err = os.Stat(*keyspath); errors.Is(err, os.ErrNotExist) {
+		logrus.Warn("No keys directory, the prediction won't be sent to the verifiers")
+		return nil
+	}
+	return ultrablue.WritePCRValues(filepath.Join(*keyspath, ultrablue.NEXT_STATE_FILE), predicted)
+}
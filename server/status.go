@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement the `status` command, which
+	checks what the attestation depends on, so that a broken setup is
+	noticed before the boot relies on it: the TPM, its SRK, EKs and
+	dictionary attack protection, the Bluetooth adapter, and the keys
+	directory along with the enrollment keys of the verifiers.
+
+	Each check is logged like the rest of the server, at the info
+	level on success and at the error level on failure, with the
+	name of the check as the "check" field. The command fails if
+	any of them does.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"ultrablue-server/ultrablue"
+)
+
+/*
+	checker logs the outcome of the status checks,
+	and remembers whether one of them failed.
+*/
+type checker struct {
+	failed bool
+}
+
+/*
+	report logs the outcome of the check @name, described
+	by @detail on success, and by @err on failure.
+*/
+func (c *checker) report(name, detail string, err error) {
+	var log = logrus.WithField("check", name)
+
+	if err != nil {
+		c.failed = true
+		log.Error(err)
+		return
+	}
+	log.Info(detail)
+}
+
+/*
+	daStatus describes the state of the TPM dictionary attack
+	protection, which locks the PINs out after too many failures.
+*/
+func daStatus() (string, error) {
+	state, err := ultrablue.ReadDAState()
+	if err != nil {
+		return "", err
+	}
+	if err = state.Err(); err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("%d wrong PINs allowed before lockout (%d/%d failures)", state.Remaining(), state.Counter, state.MaxTries)
+	if state.Interval > 0 {
+		detail += fmt.Sprintf(", one failure forgiven every %v", state.Interval)
+	}
+	return detail, nil
+}
+
+/*
+	status runs the `status` command with the
+	given command line @args.
+*/
+func status(args []string) error {
+	var fs = flag.NewFlagSet("status", flag.ExitOnError)
+	var keyspath = fs.String("keys-path", ultrablue.DEFAULT_KEYS_PATH, "Directory holding the sealed enrollment keys")
+	var c checker
+	fs.Parse(args)
+
+	detail, err := ultrablue.TPMStatus()
+	c.report("TPM", detail, err)
+	detail, err = ultrablue.SRKStatus()
+	c.report("SRK", detail, err)
+	detail, err = ultrablue.EKStatus()
+	c.report("EKs", detail, err)
+	detail, err = daStatus()
+	c.report("TPM dictionary attack protection", detail, err)
+	detail, err = ultrablue.AdapterStatus()
+	c.report("Bluetooth adapter", detail, err)
+	detail, err = ultrablue.KeysDirStatus(*keyspath)
+	c.report("Keys directory", detail, err)
+
+	verifiers, err := ultrablue.EnrolledVerifiers(*keyspath)
+	if err == nil && len(verifiers) == 0 {
+		err = errors.New("No verifier is enrolled")
+	}
+	if err != nil {
+		c.report("Verifiers", "", err)
+	}
+	for _, verifier := range verifiers {
+		detail, err = ultrablue.VerifierStatus(*keyspath, verifier)
+		c.report("Verifier " + verifier, detail, err)
+	}
+
+	if c.failed {
+		return errors.New("Some of the status checks failed")
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file handle the attestation key (AK).
+
+	Creating an RSA AK takes several seconds on most TPMs, so the AK
+	is created on enrollment and its blob, only loadable by the TPM
+	that created it, is stored next to the enrollment key of the
+	verifier. The verifier certifies it by activating its credential
+	with the EK, then records it: on the next attestations, it sends
+	an empty credential to skip the activation of an AK it already knows.
+
+	The AK is replaced once older than the rotation interval. The
+	verifier doesn't know the new AK, and activates its credential again.
+*/
+
+package ultrablue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/sirupsen/logrus"
+)
+
+const DEFAULT_AK_ROTATION = 30 * 24 * time.Hour
+
+/*
+	akPath returns the path of the AK blob
+	of the verifier @uuid.
+*/
+func (a *attester) akPath(uuid string) string {
+	return filepath.Join(a.cfg.KeysPath, uuid + ".ak")
+}
+
+/*
+	storedAK returns the stored AK blob of the verifier @uuid, or
+	nil if a new AK must be created: on enrollment, when there is
+	none, and when it's older than the rotation interval.
+*/
+func (a *attester) storedAK(uuid string) ([]byte, error) {
+	var rotation = a.cfg.AKRotation
+	if rotation == 0 {
+		rotation = DEFAULT_AK_ROTATION
+	}
+
+	info, err := os.Stat(a.akPath(uuid))
+	switch {
+	case a.cfg.Enroll || errors.Is(err, os.ErrNotExist):
+		logrus.Info("Generating AK")
+	case err != nil:
+		return nil, err
+	case time.Since(info.ModTime()) > rotation:
+		logrus.Info("Generating AK: the current one is older than ", rotation)
+	default:
+		return os.ReadFile(a.akPath(uuid))
+	}
+	return nil, nil
+}
+
+/*
+	loadAK returns the AK of the verifier @uuid, and whether it
+	has just been created, as decided by storedAK.
+*/
+func (a *attester) loadAK(uuid string, tpm *attest.TPM) (*attest.AK, bool, error) {
+	blob, err := a.storedAK(uuid)
+	if err != nil {
+		return nil, false, err
+	}
+	if blob != nil {
+		logrus.Info("Loading AK")
+		ak, err := tpm.LoadAK(blob)
+		if err == nil {
+			return ak, false, nil
+		}
+		logrus.Warn("Failed to load the AK, generating a new one: ", err)
+	}
+	ak, err := tpm.NewAK(nil)
+	return ak, true, err
+}
+
+/*
+	storeAK stores the AK blob @blob as the AK of
+	the verifier @uuid, replacing the previous one.
+*/
+func (a *attester) storeAK(uuid string, blob []byte) error {
+	tmp := a.akPath(uuid) + ".tmp"
+	if err := os.WriteFile(tmp, blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.akPath(uuid))
+}
@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStoreAK(t *testing.T) {
+	a := &attester{cfg: Config{KeysPath: t.TempDir()}}
+
+	for _, blob := range [][]byte{[]byte("first AK"), []byte("rotated AK")} {
+		if err := a.storeAK("verifier", blob); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := os.ReadFile(a.akPath("verifier"))
+		if err != nil || !bytes.Equal(stored, blob) {
+			t.Errorf("Expected the AK %q to be stored, got: %q, %v", blob, stored, err)
+		}
+		info, err := os.Stat(a.akPath("verifier"))
+		if err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("The AK must only be accessible by its owner, got: %v, %v", info.Mode(), err)
+		}
+		if _, err = os.Stat(a.akPath("verifier") + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("The temporary AK file must be renamed, got: %v", err)
+		}
+	}
+}
+
+func TestStoredAK(t *testing.T) {
+	a := &attester{cfg: Config{KeysPath: t.TempDir(), AKRotation: time.Hour}}
+	var blob = []byte("AK blob")
+
+	if stored, err := a.storedAK("verifier"); err != nil || stored != nil {
+		t.Errorf("A new AK must be created when none is stored, got: %q, %v", stored, err)
+	}
+	if err := a.storeAK("verifier", blob); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := a.storedAK("verifier"); err != nil || !bytes.Equal(stored, blob) {
+		t.Errorf("A fresh AK must be loaded, got: %q, %v", stored, err)
+	}
+
+	enroll := &attester{cfg: Config{KeysPath: a.cfg.KeysPath, Enroll: true}}
+	if stored, err := enroll.storedAK("verifier"); err != nil || stored != nil {
+		t.Errorf("A new AK must be created on enrollment, got: %q, %v", stored, err)
+	}
+
+	expired := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(a.akPath("verifier"), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := a.storedAK("verifier"); err != nil || stored != nil {
+		t.Errorf("A new AK must be created when the stored one expired, got: %q, %v", stored, err)
+	}
+	a.cfg.AKRotation = 0
+	if stored, err := a.storedAK("verifier"); err != nil || !bytes.Equal(stored, blob) {
+		t.Errorf("The AK must be kept for %v by default, got: %q, %v", DEFAULT_AK_ROTATION, stored, err)
+	}
+
+	if err := os.Mkdir(a.akPath("unreadable"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.storedAK("unreadable"); err == nil {
+		t.Error("An unreadable AK must be reported")
+	}
+}
@@ -0,0 +1,227 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	Package ultrablue implements the attester side of the Ultrablue
+	remote attestation protocol. It is used by the ultrablue-server
+	command, and by other integrations that need to gate access to a
+	secret behind a successful attestation (LUKS2 token, clevis pin).
+
+	ARCHITECTURE OVERVIEW
+
+	Ultrablue is a client-server application that operates over
+	Bluetooth Low Energy (BLE). This package acts as the server.
+
+	BLE is a client-driven transport layer, in the sense that
+	the server exposes characteristics and it is up to the client to read or
+	write them whenever it wants.
+
+	Ultrablue implements an inversion of control through several components,
+	abstracting the BLE layer and allowing the server to drive the exchange.
+	Each of those components, briefly described here, is implemented in a
+	dedicated file named after the functionality.
+
+	- The characteristic: Bluetooth Low Energy sends/receives data through
+	  characteristics. When a characteristic is advertised by a device, clients
+	  are able to see it and can read/write on it if allowed by the advertising
+	  device. When a client performs a read/write operation, the characteristic
+	  will process it through handlers.
+	  Ultrablue only exposes one characteristic, enabled both for reading and
+	  writing.
+
+	- The state: The state is a data structure that holds information about the
+	  currently running read/write operation on the characteristic for a
+	  connection.
+	  It has a go channel, that abstracts the characteristic handlers and makes
+	  possible to read/write full messages to the channel without dealing with BLE
+	  internals (chunking, size prefix...).
+	  The state is created on the first client interaction with the characteristic,
+	  and lives as long as the client connection does.
+	  When the state is created, it also runs a protocol instance that operates
+	  on the above-mentioned channel and runs in a dedicated goroutine.
+
+	- The session: It wraps the state channel and keeps information on how to
+	  read/write data into it, e.g. if messages must be encrypted/decrypted.
+	  A StartEncryption method is available so that the caller can make the session
+	  encrypted whenever they want.
+	  The session also exposes two functions to communicate with clients: SendMsg
+	  and recvMsg. These functions make use of the abstractions provided by lower
+	  layers to operate on the characteristic (through the go channel of the
+	  state); upper layers should never need to call the lower layers directly.
+
+	- The protocol: It implements the actual remote attestation routine. It is
+	  split in several steps, each implemented in its own function. Thanks to
+	  previous abstractions, the server doesn't care of the transport layer and
+	  only relies on the session and its exported methods/functions to communicate
+	  with clients.
+
+	- The attester: It holds the configuration of a run, opens the
+	  Bluetooth device, advertises the ultrablue service and waits for
+	  a protocol instance to complete.
+
+	Note: The server only accepts one simulteanous client.
+*/
+package ultrablue
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const DEFAULT_KEYS_PATH = "/etc/ultrablue/"
+
+// Status displayed while advertising, for the user to pick up their phone
+const waitingStatus = "Waiting for the phone: open the Ultrablue app to attest this computer"
+
+// Config holds the parameters of an attester run.
+type Config struct {
+	Enroll        bool          // Register a new verifier instead of attesting to an enrolled one
+	PCRExtend     bool          // On enrollment, ask the verifier for a secret to send back on attestation success
+	WithPIN       bool          // Seal the enrollment key to a PIN in addition to the SRK
+	PINRetries    int           // Number of times the PIN is asked for when a wrong one is entered, DEFAULT_PIN_RETRIES if 0
+	SealPCRs      []int         // On enrollment, also seal the enrollment key to the current values of these PCRs
+	SealAuthorize bool          // Seal to PCR policies signed by the authorize key rather than to fixed SealPCRs values
+	MTU           int           // Max size of the BLE packets
+	HCITimeout    time.Duration // Deadline for the HCI device to be ready, DEFAULT_HCI_TIMEOUT if 0
+	KeysPath      string        // Directory holding the sealed enrollment keys, DEFAULT_KEYS_PATH if empty
+	Verifier      string        // If set, the UUID of the only verifier allowed to attest
+	AKRotation    time.Duration // Age after which the AK is replaced, DEFAULT_AK_ROTATION if 0
+	IMALog        bool          // Send the IMA runtime measurement log to the verifiers that ask for it
+	Daemon        bool          // Keep serving the enrolled verifiers after an attestation, without extending PCRs
+	NoPCRExtend   bool          // Don't extend PCR_EXTENSION_INDEX with the secret sent back by the verifier, e.g. when it only derives keys
+	RateLimit     time.Duration // In daemon mode, minimum delay between two attestations of a verifier, DEFAULT_RATE_LIMIT if 0
+
+	// AuthorizeKey signs the current values of the SealPCRs on
+	// enrollment with SealAuthorize. It must be kept off the machine:
+	// only its public key is stored, in the seal policy.
+	AuthorizeKey *ecdsa.PrivateKey
+
+	// ReadPIN is called to get the PIN when the enrollment key
+	// is sealed with one.
+	ReadPIN func(prompt string) ([]byte, error)
+
+	// OnStatus is called with each step of the attestation, e.g.
+	// to tell the user to pick up their phone.
+	OnStatus func(status string)
+
+	// OnEnroll is called in enroll mode once the service is advertised,
+	// with the data the verifier needs to connect, usually displayed as
+	// a QR code.
+	OnEnroll func(data string)
+}
+
+// Result is the outcome of a successful attestation.
+type Result struct {
+	UUID   uuid.UUID // Verifier UUID
+	Key    []byte    // Enrollment key shared with the verifier
+	Secret []byte    // Secret sent back by the verifier, if any
+}
+
+/*
+	An attester holds the state of a Run that is shared
+	between connections.
+*/
+type attester struct {
+	cfg       Config
+	enrollkey []byte
+	done      chan outcome
+	limiter   *rateLimiter // In daemon mode only
+	watchdog  *watchdog    // nil if the service manager watchdog is disabled
+}
+
+type outcome struct {
+	result *Result
+	err    error
+}
+
+/*
+	DeriveKey returns a key bound to both the enrollment @key, sealed
+	on the attester, and the @secret only released by the verifier on
+	attestation success. @label separates the keys derived for different
+	usages.
+*/
+func DeriveKey(key, secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+/*
+	Run opens the default HCI device, advertises the ultrablue service,
+	and blocks until a verifier completes the protocol, or @ctx is done.
+	Failures happening before the verifier sends its response are logged,
+	and the attester waits for the verifier to retry.
+	In daemon mode, it serves until @ctx is done, and returns its error.
+*/
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	var a = &attester{
+		cfg:      cfg,
+		done:     make(chan outcome, 1),
+		watchdog: newWatchdog(watchdogInterval()),
+	}
+	var err error
+
+	if a.cfg.KeysPath == "" {
+		a.cfg.KeysPath = DEFAULT_KEYS_PATH
+	}
+	if cfg.Daemon {
+		if cfg.Enroll {
+			return nil, errors.New("Verifiers can't be enrolled in daemon mode")
+		}
+		a.limiter = newRateLimiter(cfg.RateLimit)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a.watchdog.run(ctx)
+
+	a.setStatus("Waiting for the Bluetooth adapter")
+	device, err := openDevice(ctx, cfg.HCITimeout)
+	if err != nil {
+		return nil, err
+	}
+	ble.SetDefaultDevice(device)
+	defer device.Stop()
+
+	if cfg.Enroll {
+		logrus.Info("Generating symmetric key")
+		if a.enrollkey, err = TPM2_GetRandom(32); err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.Info("Registering ultrablue service and characteristic")
+	ultrablueSvc := ble.NewService(ultrablueSvcUUID)
+	ultrablueSvc.AddCharacteristic(UltrablueChr(cfg.MTU, a.ultrablueProtocol))
+	if err := ble.AddService(ultrablueSvc); err != nil {
+		return nil, err
+	}
+
+	a.setStatus(waitingStatus)
+	go ble.AdvertiseNameAndServices(ctx, "Ultrablue server", ultrablueSvc.UUID)
+
+	if cfg.Enroll && cfg.OnEnroll != nil {
+		addr := device.Address().String()
+		cfg.OnEnroll(fmt.Sprintf(`{"addr":"%s","key":"%x"}`, addr, a.enrollkey))
+	}
+
+	if cfg.Daemon {
+		return nil, a.serve(ctx)
+	}
+	select {
+	case o := <-a.done:
+		return o.result, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,413 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement authorized PCR policies.
+
+	A key sealed to the current PCR values can't be unsealed anymore
+	once the firmware, the bootloader or the kernel is updated. Instead,
+	a key sealed with an authorized policy (TPM2_PolicyAuthorize) is bound
+	to a signing key, the authorize key: any PCR policy signed with it
+	satisfies the seal policy. Before updating the boot chain, the
+	administrator signs the expected PCR values with the `authorize-pcrs`
+	command of ultrablue-server, and the enrolled verifiers keep working
+	without being enrolled again.
+
+	The authorize key is an ECDSA P-256 key that must be kept off the
+	machine: whoever can read it can authorize any PCR values, and thus
+	unseal the enrollment keys. Only its public key is stored, in the
+	seal policy. The signed PCR policies, named authorizations, are
+	stored in a JSON file of the keys directory. At unseal time, the
+	one matching the current PCR values is used.
+*/
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const AUTHORIZATIONS_FILE = "authorizations.json"
+
+// TPM2 Library commands, section 6.5.2:
+// https://trustedcomputinggroup.org/wp-content/uploads/TCG_TPM2_r1p59_Part2_Structures_pub.pdf
+// Those command codes are not defined by go-tpm.
+const (
+	cmdPolicyAuthorize tpmutil.Command = 0x0000016A
+	cmdPolicyAuthValue tpmutil.Command = 0x0000016B
+	cmdVerifySignature tpmutil.Command = 0x00000177
+)
+
+// Authorization is a PCR policy signed with the authorize key.
+type Authorization struct {
+	PCRs      []int  // SHA256 PCRs the policy is bound to
+	Digest    []byte // Digest of the expected PCR values, as given to TPM2_PolicyPCR
+	Signature []byte // ASN.1 ECDSA signature of the PCR policy digest
+}
+
+/*
+	LoadAuthorizeKey reads the PEM encoded authorize key at @path.
+*/
+func LoadAuthorizeKey(path string) (*ecdsa.PrivateKey, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("%s is not a PEM encoded EC private key", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+/*
+	GenerateAuthorizeKey generates a new authorize key,
+	and stores it PEM encoded at @path, which must not exist.
+*/
+func GenerateAuthorizeKey(path string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+/*
+	parseAuthorizeKey decodes the DER encoded public authorize
+	key, as stored in a SealPolicy.
+*/
+func parseAuthorizeKey(der []byte) (*ecdsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		return nil, errors.New("The authorize key must be an ECDSA P-256 key")
+	}
+	return pub, nil
+}
+
+/*
+	authorizeKeyTemplate returns the TPM public area of the authorize
+	key, used both to load it in the TPM and to compute its name.
+*/
+func authorizeKeyTemplate(pub *ecdsa.PublicKey) tpm2.Public {
+	return tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagUserWithAuth,
+		ECCParameters: &tpm2.ECCParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgECDSA,
+				Hash: tpm2.AlgSHA256,
+			},
+			CurveID: tpm2.CurveNISTP256,
+			Point: tpm2.ECPoint{
+				XRaw: pub.X.FillBytes(make([]byte, 32)),
+				YRaw: pub.Y.FillBytes(make([]byte, 32)),
+			},
+		},
+	}
+}
+
+/*
+	PCRsDigest returns the digest of the SHA256 @values of the given
+	@pcrs, as computed by the TPM for TPM2_PolicyPCR.
+*/
+func PCRsDigest(pcrs []int, values map[int][]byte) ([]byte, error) {
+	h := sha256.New()
+	for _, pcr := range pcrs {
+		value, ok := values[pcr]
+		if !ok || len(value) != sha256.Size {
+			return nil, fmt.Errorf("Missing or invalid SHA256 value for PCR %d", pcr)
+		}
+		h.Write(value)
+	}
+	return h.Sum(nil), nil
+}
+
+/*
+	extendPolicy computes a new policy digest from @digest and the
+	given command code and parameters, as the TPM does in policy
+	sessions.
+*/
+func extendPolicy(digest []byte, cc tpmutil.Command, params ...[]byte) []byte {
+	h := sha256.New()
+	h.Write(digest)
+	binary.Write(h, binary.BigEndian, uint32(cc))
+	for _, p := range params {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+/*
+	pcrPolicyDigest returns the digest of a policy session after a
+	TPM2_PolicyPCR on the SHA256 @pcrs with the @pcrsDigest. It is
+	the digest the authorize key signs.
+*/
+func pcrPolicyDigest(pcrs []int, pcrsDigest []byte) []byte {
+	// TPML_PCR_SELECTION with a single SHA256 selection.
+	var sel = []byte{0, 0, 0, 1, 0, byte(tpm2.AlgSHA256), 3, 0, 0, 0}
+	for _, pcr := range pcrs {
+		sel[7 + pcr / 8] |= 1 << (pcr % 8)
+	}
+	return extendPolicy(make([]byte, sha256.Size), tpm2.CmdPolicyPCR, sel, pcrsDigest)
+}
+
+/*
+	authorizedPolicyDigest returns the policy digest a key is sealed
+	with when @policy.AuthorizeKey is set: a TPM2_PolicyAuthorize
+	with the authorize key and an empty policy reference, followed
+	by a TPM2_PolicyAuthValue if @policy.PIN is set.
+*/
+func authorizedPolicyDigest(policy SealPolicy) ([]byte, error) {
+	pub, err := parseAuthorizeKey(policy.AuthorizeKey)
+	if err != nil {
+		return nil, err
+	}
+	name, err := authorizeKeyTemplate(pub).Name()
+	if err != nil {
+		return nil, err
+	}
+	encodedName, err := name.Digest.Encode()
+	if err != nil {
+		return nil, err
+	}
+	digest := extendPolicy(make([]byte, sha256.Size), cmdPolicyAuthorize, encodedName)
+	// The digest is then extended with the policy reference,
+	// which is always empty.
+	digest = sha256Sum(digest)
+	if policy.PIN {
+		digest = extendPolicy(digest, cmdPolicyAuthValue)
+	}
+	return digest, nil
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+/*
+	AuthorizePCRs signs a PCR policy for the SHA256 @pcrs with the
+	authorize @key, so that keys sealed with it can be unsealed
+	when the PCRs have the given @values.
+*/
+func AuthorizePCRs(key *ecdsa.PrivateKey, pcrs []int, values map[int][]byte) (*Authorization, error) {
+	if len(pcrs) == 0 {
+		return nil, errors.New("An authorization must cover at least one PCR")
+	}
+	pcrsDigest, err := PCRsDigest(pcrs, values)
+	if err != nil {
+		return nil, err
+	}
+	// The policy reference is empty, thus the signed digest
+	// is H(approvedPolicy || policyRef) = H(approvedPolicy)
+	aHash := sha256Sum(pcrPolicyDigest(pcrs, pcrsDigest))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, aHash)
+	if err != nil {
+		return nil, err
+	}
+	return &Authorization{PCRs: pcrs, Digest: pcrsDigest, Signature: signature}, nil
+}
+
+/*
+	LoadAuthorizations returns the authorizations stored at @path.
+	A missing file means that no PCR policy was authorized yet.
+*/
+func LoadAuthorizations(path string) ([]Authorization, error) {
+	var auths []Authorization
+
+	encoded, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(encoded, &auths)
+	return auths, err
+}
+
+/*
+	StoreAuthorization adds @auth to the authorizations stored at
+	@path, unless the same PCR values are already authorized.
+*/
+func StoreAuthorization(path string, auth *Authorization) error {
+	auths, err := LoadAuthorizations(path)
+	if err != nil {
+		return err
+	}
+	for _, a := range auths {
+		if fmt.Sprint(a.PCRs) == fmt.Sprint(auth.PCRs) && bytes.Equal(a.Digest, auth.Digest) {
+			return nil
+		}
+	}
+	return writeAuthorizations(path, append(auths, *auth))
+}
+
+/*
+	RevokeAuthorization removes the authorizations of the PCR values
+	whose digest is @digest from the ones stored at @path, and returns
+	how many were removed.
+	The signed policies remain valid for the TPM though: anyone who
+	copied them can still unseal the keys when the PCRs have those
+	values. A compromised state requires a new authorize key, and the
+	verifiers to be enrolled again.
+*/
+func RevokeAuthorization(path string, digest []byte) (int, error) {
+	auths, err := LoadAuthorizations(path)
+	if err != nil {
+		return 0, err
+	}
+	var kept []Authorization
+	for _, a := range auths {
+		if !bytes.Equal(a.Digest, digest) {
+			kept = append(kept, a)
+		}
+	}
+	if len(kept) == len(auths) {
+		return 0, nil
+	}
+	return len(auths) - len(kept), writeAuthorizations(path, kept)
+}
+
+/*
+	writeAuthorizations atomically replaces the
+	authorizations stored at @path with @auths.
+*/
+func writeAuthorizations(path string, auths []Authorization) error {
+	if auths == nil {
+		auths = []Authorization{}
+	}
+	encoded, err := json.MarshalIndent(auths, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, encoded, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/*
+	ReadPCRs returns the current SHA256 values of the given @pcrs.
+*/
+func ReadPCRs(pcrs []int) (map[int][]byte, error) {
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+	return readPCRs(rwc, pcrs)
+}
+
+func readPCRs(rw io.ReadWriter, pcrs []int) (map[int][]byte, error) {
+	return readPCRBank(rw, tpm2.AlgSHA256, pcrs)
+}
+
+/*
+	readPCRBank returns the values of @pcrs in the @alg bank.
+*/
+func readPCRBank(rw io.ReadWriter, alg tpm2.Algorithm, pcrs []int) (map[int][]byte, error) {
+	var values = make(map[int][]byte)
+
+	// TPM2_PCR_Read returns at most 8 digests at once.
+	for i := 0; i < len(pcrs); i += 8 {
+		end := i + 8
+		if end > len(pcrs) {
+			end = len(pcrs)
+		}
+		read, err := tpm2.ReadPCRs(rw, tpm2.PCRSelection{Hash: alg, PCRs: pcrs[i:end]})
+		if err != nil {
+			return nil, err
+		}
+		for pcr, value := range read {
+			values[pcr] = value
+		}
+	}
+	for _, pcr := range pcrs {
+		if _, ok := values[pcr]; !ok {
+			return nil, fmt.Errorf("PCR %d is not available in the 0x%x bank", pcr, alg)
+		}
+	}
+	return values, nil
+}
+
+/*
+	matchAuthorization returns the first of @auths that matches the
+	current PCR values, or nil if there is none.
+*/
+func matchAuthorization(rw io.ReadWriter, auths []Authorization) (*Authorization, error) {
+	for i := range auths {
+		values, err := readPCRs(rw, auths[i].PCRs)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := PCRsDigest(auths[i].PCRs, values)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(digest, auths[i].Digest) {
+			return &auths[i], nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+	applyAuthorizedPolicy satisfies the authorized policy of @key on
+	the policy session @sessHandle: the PCR policy of @auth is run,
+	and then approved by the TPM after it checked its signature.
+*/
+func applyAuthorizedPolicy(rw io.ReadWriter, sessHandle tpmutil.Handle, key *ecdsa.PublicKey, auth *Authorization) error {
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: auth.PCRs}
+	if err := tpm2.PolicyPCR(rw, sessHandle, auth.Digest, sel); err != nil {
+		return err
+	}
+
+	// The key is loaded in the owner hierarchy, as the NULL
+	// hierarchy yields tickets TPM2_PolicyAuthorize rejects.
+	keyHandle, name, err := tpm2.LoadExternal(rw, authorizeKeyTemplate(key), tpm2.Private{Type: tpm2.AlgNull}, tpm2.HandleOwner)
+	if err != nil {
+		return err
+	}
+	defer tpm2.FlushContext(rw, keyHandle)
+
+	approved := pcrPolicyDigest(auth.PCRs, auth.Digest)
+	ticket, err := TPM2_VerifySignature(rw, keyHandle, sha256Sum(approved), auth.Signature)
+	if err != nil {
+		return err
+	}
+	return TPM2_PolicyAuthorize(rw, sessHandle, approved, nil, name, ticket)
+}
@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorizedPolicyDigest(t *testing.T) {
+	// Well-known digest of a policy only made of TPM2_PolicyAuthValue
+	// (or TPM2_PolicyPassword).
+	const authValue = "8fcd2169ab92694e0c633f1ab772842b8241bbc20288981fc7ac1eddc1fddb0e"
+	if got := hex.EncodeToString(extendPolicy(make([]byte, sha256.Size), cmdPolicyAuthValue)); got != authValue {
+		t.Fatalf("Unexpected TPM2_PolicyAuthValue digest: %s", got)
+	}
+
+	key, err := GenerateAuthorizeKey(filepath.Join(t.TempDir(), "authorize.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutPIN, err := authorizedPolicyDigest(SealPolicy{AuthorizeKey: der})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withPIN, err := authorizedPolicyDigest(SealPolicy{AuthorizeKey: der, PIN: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(extendPolicy(withoutPIN, cmdPolicyAuthValue), withPIN) {
+		t.Errorf("The PIN policy must extend the authorized policy")
+	}
+}
+
+func TestAuthorizePCRs(t *testing.T) {
+	var dir = t.TempDir()
+	var values = map[int][]byte{
+		4: bytes.Repeat([]byte{4}, sha256.Size),
+		7: bytes.Repeat([]byte{7}, sha256.Size),
+	}
+
+	key, err := GenerateAuthorizeKey(filepath.Join(dir, "authorize.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadAuthorizeKey(filepath.Join(dir, "authorize.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(key) {
+		t.Fatal("The stored authorize key differs from the generated one")
+	}
+
+	if _, err = AuthorizePCRs(key, []int{4, 7, 8}, values); err == nil {
+		t.Error("Authorizing a PCR without value must fail")
+	}
+	auth, err := AuthorizePCRs(key, []int{4, 7}, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aHash := sha256.Sum256(pcrPolicyDigest(auth.PCRs, auth.Digest))
+	if !ecdsa.VerifyASN1(&key.PublicKey, aHash[:], auth.Signature) {
+		t.Error("Invalid authorization signature")
+	}
+
+	path := filepath.Join(dir, AUTHORIZATIONS_FILE)
+	for i := 0; i < 2; i++ {
+		if err = StoreAuthorization(path, auth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auths, err := LoadAuthorizations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auths) != 1 || !bytes.Equal(auths[0].Digest, auth.Digest) {
+		t.Errorf("Expected the authorization to be stored once, got: %v", auths)
+	}
+
+	if n, err := RevokeAuthorization(path, []byte("unknown")); n != 0 || err != nil {
+		t.Errorf("Revoking unknown PCR values must be a no-op, got %d, %v", n, err)
+	}
+	if n, err := RevokeAuthorization(path, auth.Digest); n != 1 || err != nil {
+		t.Fatalf("Expected the authorization to be revoked, got %d, %v", n, err)
+	}
+	if auths, err = LoadAuthorizations(path); len(auths) != 0 || err != nil {
+		t.Errorf("Expected no authorization left, got %v, %v", auths, err)
+	}
+}
+
+func TestStoreKeyWithoutAuthorizeKey(t *testing.T) {
+	var dir = filepath.Join(t.TempDir(), "keys")
+	var a = attester{cfg: Config{KeysPath: dir, SealPCRs: []int{7}, SealAuthorize: true}}
+
+	if err := a.storeKey("8a6fa9ec-5b2d-4b7e-9d3a-0f3e4c2b1a90", make([]byte, 32)); err == nil {
+		t.Fatal("Sealing to authorized policies without authorize key must fail")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Nothing must be written in the keys directory, got: %v", err)
+	}
+}
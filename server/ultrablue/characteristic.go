@@ -21,7 +21,7 @@
 	There's no prefix in the following chunks.
 */
 
-package main
+package ultrablue
 
 import (
 	"errors"
@@ -119,8 +119,11 @@ func recvBLEPacket(out *[]byte, size *int, req ble.Request) error {
 	messages internally, and send / receive full messages in an internal channel
 	when some message is fully available.
 	This makes the server able to interact with the client easily through channels.
+	The @protocol function is started in its own goroutine for each new
+	connection, and operates on the other end of the channel, until
+	the connection's disconnected channel is closed.
 */
-func UltrablueChr(mtu int) *ble.Characteristic {
+func UltrablueChr(mtu int, protocol func(ch chan []byte, disconnected <-chan struct{})) *ble.Characteristic {
 	chr := ble.NewCharacteristic(ultrablueChrUUID)
 
 	if mtu < 20 || mtu > 500 {
@@ -132,7 +135,7 @@ func UltrablueChr(mtu int) *ble.Characteristic {
 	chr.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
 		logrus.Tracef("%s - HandleRead", ultrablueChrUUID.String())
 
-		var state = getConnectionState(req.Conn())
+		var state = getConnectionState(req.Conn(), protocol)
 
 		if state.operation != Write {
 			if err := state.StartOperation(Write); err != nil {
@@ -171,7 +174,7 @@ func UltrablueChr(mtu int) *ble.Characteristic {
 	chr.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
 		logrus.Tracef("%s - HandleWrite", ultrablueChrUUID.String())
 
-		var state = getConnectionState(req.Conn())
+		var state = getConnectionState(req.Conn(), protocol)
 
 		if state.operation != Read {
 			if err := state.StartOperation(Read); err != nil {
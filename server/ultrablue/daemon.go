@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement the daemon mode, in which
+	the attester keeps advertising after boot, so that the enrolled
+	verifiers can check the state of the running system at any time,
+	e.g. before the user enters credentials.
+
+	Each connection runs its own protocol instance, as in the one-shot
+	mode, and the daemon serves until it's stopped, like a socket
+	activated service would. As the state of the system only changes
+	on boot, PCRs are never extended, and each verifier is only
+	allowed to attest once per rate limit interval, which also
+	protects the TPM dictionary attack counter when unsealing
+	enrollment keys with a PIN.
+*/
+
+package ultrablue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const DEFAULT_RATE_LIMIT = time.Minute
+
+/*
+	rateLimiter tracks the last attestation
+	attempt of each verifier.
+*/
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newRateLimiter(interval time.Duration) *rateLimiter {
+	if interval == 0 {
+		interval = DEFAULT_RATE_LIMIT
+	}
+	return &rateLimiter{interval: interval, last: make(map[string]time.Time)}
+}
+
+/*
+	allow records an attestation attempt of the @verifier at @now,
+	and returns an error if its previous one is too recent. Failed
+	attempts count, as they may have used the TPM.
+*/
+func (rl *rateLimiter) allow(verifier string, now time.Time) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if last, ok := rl.last[verifier]; ok && now.Sub(last) < rl.interval {
+		wait := rl.interval - now.Sub(last)
+		return fmt.Errorf("The verifier %s must wait %v before attesting again", verifier, wait.Round(time.Second))
+	}
+	rl.last[verifier] = now
+	return nil
+}
+
+/*
+	serve reports the outcomes of the protocol
+	instances until @ctx is done.
+*/
+func (a *attester) serve(ctx context.Context) error {
+	logrus.Info("Serving the enrolled verifiers until stopped")
+	if err := Notify("READY=1"); err != nil {
+		logrus.Debug("Failed to notify the service manager: ", err)
+	}
+	for {
+		select {
+		case o := <-a.done:
+			if o.err != nil {
+				logrus.Error(o.err)
+			} else {
+				logrus.Info("Attested to verifier ", o.result.UUID)
+			}
+			a.setStatus(waitingStatus)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
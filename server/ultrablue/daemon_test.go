@@ -0,0 +1,30 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var rl = newRateLimiter(time.Minute)
+	var now = time.Now()
+
+	if err := rl.allow("a", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := rl.allow("b", now.Add(time.Second)); err != nil {
+		t.Errorf("The verifiers must be limited independently: %v", err)
+	}
+	if err := rl.allow("a", now.Add(30 * time.Second)); err == nil {
+		t.Error("A second attempt within the interval must be refused")
+	}
+	if err := rl.allow("a", now.Add(time.Minute)); err != nil {
+		t.Errorf("An attempt after the interval must be allowed: %v", err)
+	}
+	if newRateLimiter(0).interval != DEFAULT_RATE_LIMIT {
+		t.Error("The default interval isn't used")
+	}
+}
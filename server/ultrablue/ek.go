@@ -0,0 +1,370 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file handle the TPM endorsement keys (EK).
+
+	go-attestation only supports RSA EKs: it is still used for them, while
+	ECC NIST P-256 EKs, the only ones some TPMs are provisioned with, are
+	created and used for credential activation here.
+
+	The type of the EK sent to a verifier on enrollment is stored next
+	to its key, so that the same EK is used on attestation.
+*/
+
+package ultrablue
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EK_TYPE_RSA = "RSA" // RSA 2048
+	EK_TYPE_ECC = "ECC" // ECC NIST P-256
+)
+
+// Among EKs that are equally certified, the ones of the first types are
+// preferred. RSA comes first, as older verifiers only support it.
+var EK_PREFERENCE = []string{EK_TYPE_RSA, EK_TYPE_ECC}
+
+// TCG EK Credential Profile, section 2.2.1.4:
+// https://trustedcomputinggroup.org/wp-content/uploads/TCG_IWG_EKCredentialProfile_v2p4_r3.pdf
+const (
+	ECC_EK_CERT_INDEX  tpmutil.Handle = 0x01c0000a
+	ECC_EK_NONCE_INDEX tpmutil.Handle = 0x01c0000b
+)
+
+// TCG EK Credential Profile, annex B.3.4, template L-2.
+var ECC_EK_TEMPLATE = tpm2.Public {
+	Type: tpm2.AlgECC,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagAdminWithPolicy | tpm2.FlagRestricted | tpm2.FlagDecrypt,
+	// PolicySecret(TPM_RH_ENDORSEMENT)
+	AuthPolicy: []byte{
+		0x83, 0x71, 0x97, 0x67, 0x44, 0x84, 0xb3, 0xf8,
+		0x1a, 0x90, 0xcc, 0x8d, 0x46, 0xa5, 0xd7, 0x24,
+		0xfd, 0x52, 0xd7, 0x6e, 0x06, 0x52, 0x0b, 0x64,
+		0xf2, 0xa1, 0xda, 0x1b, 0x33, 0x14, 0x69, 0xaa,
+	},
+	ECCParameters: &tpm2.ECCParams {
+		Symmetric: &tpm2.SymScheme {
+			Alg: tpm2.AlgAES,
+			KeyBits: 128,
+			Mode: tpm2.AlgCFB,
+		},
+		CurveID: tpm2.CurveNISTP256,
+		Point: tpm2.ECPoint {
+			XRaw: make([]byte, 32),
+			YRaw: make([]byte, 32),
+		},
+	},
+}
+
+/*
+	An endorsementKey is an EK the attester is able to
+	activate credentials with.
+*/
+type endorsementKey struct {
+	attest.EK
+	Type string // EK_TYPE_RSA or EK_TYPE_ECC
+}
+
+/*
+	eccEKTemplate returns the template of the ECC EK, with
+	the nonce the TPM manufacturer may have provisioned.
+*/
+func eccEKTemplate(rw io.ReadWriter) tpm2.Public {
+	var template = ECC_EK_TEMPLATE
+	var params = *template.ECCParameters
+
+	if nonce, err := tpm2.NVReadEx(rw, ECC_EK_NONCE_INDEX, tpm2.HandleOwner, "", 0); err == nil {
+		params.Point.XRaw = make([]byte, 32)
+		copy(params.Point.XRaw, nonce)
+	}
+	template.ECCParameters = &params
+	return template
+}
+
+/*
+	createECCEK creates the ECC EK in the endorsement hierarchy,
+	and returns a handle to it along with its public key.
+	The handle must be flushed by the caller.
+*/
+func createECCEK(rw io.ReadWriter) (tpmutil.Handle, *ecdsa.PublicKey, error) {
+	handle, pub, err := tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", eccEKTemplate(rw))
+	if err != nil {
+		return 0, nil, err
+	}
+	ecpub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		tpm2.FlushContext(rw, handle)
+		return 0, nil, errors.New("The ECC EK is not an ECDSA key")
+	}
+	return handle, ecpub, nil
+}
+
+/*
+	readECCEK returns the ECC EK of the TPM, with its certificate if
+	it has been provisioned and matches the key.
+*/
+func readECCEK() (*endorsementKey, error) {
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	handle, pub, err := createECCEK(rwc)
+	if err != nil {
+		return nil, err
+	}
+	tpm2.FlushContext(rwc, handle)
+
+	var ek = endorsementKey{attest.EK{Public: pub}, EK_TYPE_ECC}
+	der, err := tpm2.NVReadEx(rwc, ECC_EK_CERT_INDEX, tpm2.HandleOwner, "", 0)
+	if err != nil {
+		logrus.Debugf("No ECC EK certificate: %v", err)
+		return &ek, nil
+	}
+	cert, err := attest.ParseEKCertificate(der)
+	if err != nil {
+		logrus.Warnf("Invalid ECC EK certificate: %v", err)
+		return &ek, nil
+	}
+	if !pub.Equal(cert.PublicKey) {
+		logrus.Warn("The ECC EK certificate doesn't match the ECC EK")
+		return &ek, nil
+	}
+	ek.Certificate = cert
+	return &ek, nil
+}
+
+/*
+	ekType returns the type of @pub, or an error
+	if it's not supported.
+*/
+func ekType(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return EK_TYPE_RSA, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return EK_TYPE_ECC, nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported EK type: %T", pub)
+}
+
+/*
+	endorsementKeys returns the EKs of the TPM, sorted by sortEKs:
+	the RSA one is found by go-attestation, and the ECC one here.
+	TPMs without one of them are fine, as long as the other is present.
+*/
+func endorsementKeys(tpm *attest.TPM) ([]endorsementKey, error) {
+	var eks []endorsementKey
+	var errs []string
+
+	rsaEKs, err := tpm.EKs()
+	if err != nil {
+		errs = append(errs, "RSA: " + err.Error())
+	}
+	for _, ek := range rsaEKs {
+		t, err := ekType(ek.Public)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		eks = append(eks, endorsementKey{ek, t})
+	}
+	ecc, err := readECCEK()
+	if err != nil {
+		errs = append(errs, "ECC: " + err.Error())
+	} else {
+		eks = append(eks, *ecc)
+	}
+	if len(eks) == 0 {
+		return nil, errors.New("No usable EK: " + strings.Join(errs, ", "))
+	}
+	for _, e := range errs {
+		logrus.Warn("Ignoring EK: ", e)
+	}
+	sortEKs(eks)
+	return eks, nil
+}
+
+/*
+	sortEKs sorts @eks by order of preference: certified EKs first,
+	as the verifier can check they belong to a genuine TPM, then
+	following EK_PREFERENCE.
+*/
+func sortEKs(eks []endorsementKey) {
+	rank := func(ek *endorsementKey) int {
+		var r = len(EK_PREFERENCE)
+		for i, t := range EK_PREFERENCE {
+			if t == ek.Type {
+				r = i
+			}
+		}
+		if ek.Certificate == nil {
+			r += len(EK_PREFERENCE) + 1
+		}
+		return r
+	}
+	sort.SliceStable(eks, func(i, j int) bool {
+		return rank(&eks[i]) < rank(&eks[j])
+	})
+}
+
+/*
+	data returns the description of @ek sent to verifiers.
+*/
+func (ek *endorsementKey) data() EKData {
+	var data = EKData{Type: ek.Type, Cert: make([]byte, 0)}
+
+	if ek.Certificate != nil {
+		data.Cert = ek.Certificate.Raw
+	}
+	switch pub := ek.Public.(type) {
+	case *rsa.PublicKey:
+		data.Pub = pub.N.Bytes()
+		data.Exp = pub.E
+	case *ecdsa.PublicKey:
+		data.Pub = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	}
+	return data
+}
+
+/*
+	newEnrollData returns the enrollment data describing @eks,
+	as sorted by sortEKs: the first one is the EK credentials
+	will be activated with.
+*/
+func newEnrollData(eks []endorsementKey, pcrextend bool) EnrollData {
+	var all = make([]EKData, len(eks))
+
+	for i := range eks {
+		all[i] = eks[i].data()
+	}
+	return EnrollData{
+		EKType:    all[0].Type,
+		EKCert:    all[0].Cert,
+		EKPub:     all[0].Pub,
+		EKExp:     all[0].Exp,
+		EKs:       all,
+		PCRExtend: pcrextend,
+	}
+}
+
+/*
+	activateCredential decrypts the credential @ec with @ak
+	and the EK of the type @ekType.
+*/
+func activateCredential(tpm *attest.TPM, ak *attest.AK, ekType string, ec attest.EncryptedCredential) ([]byte, error) {
+	switch ekType {
+	case EK_TYPE_RSA:
+		return ak.ActivateCredential(tpm, ec)
+	case EK_TYPE_ECC:
+		return activateECCCredential(ak, ec)
+	}
+	return nil, errors.New("Unsupported EK type: " + ekType)
+}
+
+/*
+	loadAKHandle loads @ak again from its blob in the @rw connection,
+	as go-attestation handles are bound to its own TPM connection.
+	The handle must be flushed by the caller.
+*/
+func loadAKHandle(rw io.ReadWriter, ak *attest.AK) (tpmutil.Handle, error) {
+	var key struct {
+		Public []byte
+		Blob   []byte `json:"KeyBlob"`
+	}
+
+	encoded, err := ak.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	if err = json.Unmarshal(encoded, &key); err != nil {
+		return 0, err
+	}
+	handle, _, err := tpm2.Load(rw, SRK_HANDLE, "", key.Public, key.Blob)
+	return handle, err
+}
+
+/*
+	activateECCCredential runs TPM2_ActivateCredential with the ECC EK,
+	as go-attestation does with the RSA one.
+*/
+func activateECCCredential(ak *attest.AK, ec attest.EncryptedCredential) ([]byte, error) {
+	if len(ec.Credential) < 2 || len(ec.Secret) < 2 {
+		return nil, errors.New("Malformed encrypted credential")
+	}
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	akHandle, err := loadAKHandle(rwc, ak)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rwc, akHandle)
+	ekHandle, _, err := createECCEK(rwc)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rwc, ekHandle)
+
+	// The EK policy requires the endorsement hierarchy authorization.
+	nonce, err := randomNonce(16)
+	if err != nil {
+		return nil, err
+	}
+	sessHandle, _, err := tpm2.StartAuthSession(rwc, tpm2.HandleNull, tpm2.HandleNull, nonce, nil, tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rwc, sessHandle)
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	if _, _, err = tpm2.PolicySecret(rwc, tpm2.HandleEndorsement, password, sessHandle, nil, nil, nil, 0); err != nil {
+		return nil, err
+	}
+	auths := []tpm2.AuthCommand{password, {Session: sessHandle, Attributes: tpm2.AttrContinueSession}}
+	return tpm2.ActivateCredentialUsingAuth(rwc, auths, akHandle, ekHandle, ec.Credential[2:], ec.Secret[2:])
+}
+
+/*
+	storeEKType records the type of the EK sent to the verifier @uuid.
+*/
+func (a *attester) storeEKType(uuid, ekType string) error {
+	return a.writeKeyFile(uuid + ".ek", []byte(ekType))
+}
+
+/*
+	loadEKType returns the type of the EK sent to the verifier @uuid
+	on enrollment. Verifiers enrolled by older versions use the RSA EK.
+*/
+func (a *attester) loadEKType(uuid string) (string, error) {
+	t, err := os.ReadFile(filepath.Join(a.cfg.KeysPath, uuid + ".ek"))
+	if errors.Is(err, os.ErrNotExist) {
+		return EK_TYPE_RSA, nil
+	}
+	return string(t), err
+}
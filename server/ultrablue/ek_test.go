@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/google/go-attestation/attest"
+)
+
+func TestEnrollData(t *testing.T) {
+	ecc, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pub := range []interface{}{&ecc.PublicKey, &rsaKey.PublicKey} {
+		typ, err := ekType(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eks := []endorsementKey{{attest.EK{Public: pub}, typ}}
+		data := newEnrollData(eks, true)
+		if data.EKType != typ || !data.PCRExtend || len(data.EKCert) != 0 || len(data.EKs) != 1 {
+			t.Errorf("Unexpected enrollment data: %+v", data)
+		}
+		switch typ {
+		case EK_TYPE_ECC:
+			x, y := elliptic.Unmarshal(elliptic.P256(), data.EKPub)
+			if x == nil || x.Cmp(ecc.X) != 0 || y.Cmp(ecc.Y) != 0 {
+				t.Errorf("Invalid ECC EK point: %x", data.EKPub)
+			}
+		case EK_TYPE_RSA:
+			if rsaKey.N.Cmp(new(big.Int).SetBytes(data.EKPub)) != 0 || data.EKExp != rsaKey.E {
+				t.Errorf("Invalid RSA EK: %x, %d", data.EKPub, data.EKExp)
+			}
+		}
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ekType(&p384.PublicKey); err == nil {
+		t.Error("ECC EKs on other curves than P-256 must be rejected")
+	}
+}
+
+func TestEKType(t *testing.T) {
+	a := &attester{cfg: Config{KeysPath: t.TempDir()}}
+
+	typ, err := a.loadEKType("enrolled-before-ecc")
+	if err != nil || typ != EK_TYPE_RSA {
+		t.Fatalf("Verifiers without EK type must use the RSA EK, got: %q, %v", typ, err)
+	}
+	if err = a.storeEKType("verifier", EK_TYPE_ECC); err != nil {
+		t.Fatal(err)
+	}
+	if typ, err = a.loadEKType("verifier"); err != nil || typ != EK_TYPE_ECC {
+		t.Errorf("Expected: %s, got: %q, %v", EK_TYPE_ECC, typ, err)
+	}
+}
+
+func TestSortEKs(t *testing.T) {
+	var cert = &x509.Certificate{}
+	var tests = []struct {
+		eks      []endorsementKey
+		expected []string
+	}{
+		{
+			[]endorsementKey{{attest.EK{}, EK_TYPE_ECC}, {attest.EK{}, EK_TYPE_RSA}},
+			[]string{EK_TYPE_RSA, EK_TYPE_ECC},
+		},
+		{
+			[]endorsementKey{{attest.EK{}, EK_TYPE_RSA}, {attest.EK{Certificate: cert}, EK_TYPE_ECC}},
+			[]string{EK_TYPE_ECC, EK_TYPE_RSA},
+		},
+		{
+			[]endorsementKey{{attest.EK{Certificate: cert}, EK_TYPE_ECC}, {attest.EK{Certificate: cert}, EK_TYPE_RSA}},
+			[]string{EK_TYPE_RSA, EK_TYPE_ECC},
+		},
+	}
+
+	for _, test := range tests {
+		sortEKs(test.eks)
+		for i, ek := range test.eks {
+			if ek.Type != test.expected[i] {
+				t.Errorf("Expected: %v, got: %v", test.expected, test.eks)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file wait for the HCI device to be ready.
+
+	Early in the boot, the Bluetooth adapter may not have been probed
+	yet, or its firmware may still be loading, in which case opening
+	it fails. It's retried with an exponential backoff until it
+	succeeds or the deadline is reached, so that boot is delayed as
+	little as possible on fast adapters, without failing on slow ones.
+
+	The adapter is powered on when it is opened, so that only rfkill
+	can keep it off.
+*/
+
+package ultrablue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/go-ble/ble/linux"
+	"github.com/sirupsen/logrus"
+)
+
+const DEFAULT_HCI_TIMEOUT = 30 * time.Second
+
+// Where the kernel lists the Bluetooth adapters
+const hciSysfsPath = "/sys/class/bluetooth"
+
+// Linux Bluetooth sockets, see include/net/bluetooth/hci_sock.h
+const (
+	afBluetooth   = 31         // AF_BLUETOOTH
+	btprotoHCI    = 1          // BTPROTO_HCI
+	hciGetDevInfo = 0x800448d3 // HCIGETDEVINFO, _IOR('H', 211, int)
+	hciUp         = 1 << 0     // HCI_UP flag of the powered on adapters
+)
+
+/*
+	hciDevInfo is the struct hci_dev_info filled by HCIGETDEVINFO.
+*/
+type hciDevInfo struct {
+	devID      uint16
+	name       [8]byte
+	bdaddr     [6]byte
+	flags      uint32
+	devType    uint8
+	features   [8]uint8
+	pktType    uint32
+	linkPolicy uint32
+	linkMode   uint32
+	aclMTU     uint16
+	aclPkts    uint16
+	scoMTU     uint16
+	scoPkts    uint16
+	stats      [10]uint32 // struct hci_dev_stats
+}
+
+// Bounds of the delay between two attempts to open the HCI device
+const (
+	minRetryDelay = 50 * time.Millisecond
+	maxRetryDelay = 2 * time.Second
+)
+
+/*
+	waitForDevice calls @open until it succeeds, @timeout
+	elapses or @ctx is done, and returns its last result.
+*/
+func waitForDevice(ctx context.Context, timeout time.Duration, open func() (*linux.Device, error)) (*linux.Device, error) {
+	var delay = minRetryDelay
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		device, err := open()
+		if err == nil {
+			return device, nil
+		}
+		logrus.Debug("The HCI device isn't ready: ", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("The HCI device isn't ready after %v: %v", timeout, err)
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+/*
+	openDevice opens the default HCI device, waiting
+	at most @timeout for it to be ready.
+*/
+func openDevice(ctx context.Context, timeout time.Duration) (*linux.Device, error) {
+	if timeout == 0 {
+		timeout = DEFAULT_HCI_TIMEOUT
+	}
+	return waitForDevice(ctx, timeout, func() (*linux.Device, error) {
+		return linux.NewDevice()
+	})
+}
+
+/*
+	AdapterStatus checks that a Bluetooth adapter is present,
+	and that it isn't blocked by rfkill. As linux.NewDevice, it
+	uses the first one that is usable. Its power state is reported,
+	but an adapter powered off doesn't fail the check, as the
+	attester powers it on when opening it.
+*/
+func AdapterStatus() (string, error) {
+	adapters, _ := filepath.Glob(filepath.Join(hciSysfsPath, "hci*"))
+	if len(adapters) == 0 {
+		return "", errors.New("No Bluetooth adapter")
+	}
+	var blocked []string
+	for _, adapter := range adapters {
+		name := filepath.Base(adapter)
+		if block := rfkillBlock(adapter); block != "" {
+			blocked = append(blocked, name + " (" + block + ")")
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(name, "hci"), 10, 16)
+		if err != nil {
+			return "", fmt.Errorf("Unexpected Bluetooth adapter name %s", name)
+		}
+		powered, err := adapterPowered(uint16(id))
+		if err != nil {
+			return "", fmt.Errorf("Failed to get the power state of %s: %v", name, err)
+		}
+		if !powered {
+			return name + " present, not blocked by rfkill, powered off (ultrablue powers it on when attesting)", nil
+		}
+		return name + " present, not blocked by rfkill, powered on", nil
+	}
+	return "", errors.New("All the Bluetooth adapters are blocked by rfkill: " + strings.Join(blocked, ", "))
+}
+
+/*
+	rfkillBlock returns how the adapter at the sysfs path
+	@adapter is blocked by rfkill, or "" if it isn't.
+*/
+func rfkillBlock(adapter string) string {
+	switches, _ := filepath.Glob(filepath.Join(adapter, "rfkill*"))
+	for _, sw := range switches {
+		for _, block := range []string{"hard", "soft"} {
+			state, err := os.ReadFile(filepath.Join(sw, block))
+			if err == nil && strings.TrimSpace(string(state)) == "1" {
+				return block + " blocked"
+			}
+		}
+	}
+	return ""
+}
+
+/*
+	adapterPowered returns whether the HCI device
+	@id is up, i.e. powered on.
+*/
+func adapterPowered(id uint16) (bool, error) {
+	fd, err := syscall.Socket(afBluetooth, syscall.SOCK_RAW | syscall.SOCK_CLOEXEC, btprotoHCI)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+
+	var info = hciDevInfo{devID: id}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), hciGetDevInfo, uintptr(unsafe.Pointer(&info))); errno != 0 {
+		return false, errno
+	}
+	return info.flags & hciUp != 0, nil
+}
@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/go-ble/ble/linux"
+)
+
+func TestWaitForDevice(t *testing.T) {
+	var attempts int
+	var ready = &linux.Device{}
+
+	device, err := waitForDevice(context.Background(), time.Second, func() (*linux.Device, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("no devices available")
+		}
+		return ready, nil
+	})
+	if err != nil || device != ready || attempts != 3 {
+		t.Errorf("Expected the device after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	start := time.Now()
+	_, err = waitForDevice(context.Background(), 200 * time.Millisecond, func() (*linux.Device, error) {
+		return nil, errors.New("no devices available")
+	})
+	if err == nil {
+		t.Error("Waiting must fail once the deadline is reached")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Waiting lasted %v after the deadline", elapsed)
+	}
+}
+
+func TestRfkillBlock(t *testing.T) {
+	var adapter = t.TempDir()
+	var sw = filepath.Join(adapter, "rfkill0")
+
+	if block := rfkillBlock(adapter); block != "" {
+		t.Errorf("An adapter without rfkill switch can't be blocked, got %q", block)
+	}
+	if err := os.Mkdir(sw, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(sw, "hard"), []byte("0\n"), 0644)
+	os.WriteFile(filepath.Join(sw, "soft"), []byte("0\n"), 0644)
+	if block := rfkillBlock(adapter); block != "" {
+		t.Errorf("Expected an unblocked adapter, got %q", block)
+	}
+	os.WriteFile(filepath.Join(sw, "soft"), []byte("1\n"), 0644)
+	if block := rfkillBlock(adapter); block != "soft blocked" {
+		t.Errorf("Expected a soft blocked adapter, got %q", block)
+	}
+}
+
+/*
+	Tests that hciDevInfo has the layout of the
+	kernel struct hci_dev_info, 92 bytes long
+*/
+func TestHCIDevInfoLayout(t *testing.T) {
+	var info hciDevInfo
+
+	if size := unsafe.Sizeof(info); size != 92 {
+		t.Errorf("Expected 92 bytes, got %d", size)
+	}
+	if off := unsafe.Offsetof(info.flags); off != 16 {
+		t.Errorf("Expected the flags at offset 16, got %d", off)
+	}
+}
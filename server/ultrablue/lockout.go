@@ -0,0 +1,180 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file handle the TPM dictionary attack
+	protection, which the enrollment keys sealed with a PIN are
+	subject to: each wrong PIN increments a counter, and once it
+	reaches its maximum, the TPM refuses to use them until the
+	counter decreases, one failure per lockout interval.
+
+	The counter is checked before asking for the PIN, so that the
+	user knows how many attempts are left, and isn't asked for a PIN
+	that can't be checked.
+*/
+
+package ultrablue
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+const DEFAULT_PIN_RETRIES = 3
+
+// TPM_RC_LOCKOUT, as returned by the commands sent without go-tpm
+const rcLockout = 0x900 + uint32(tpm2.RCLockout)
+
+// inLockout bit of TPMA_PERMANENT
+const permanentInLockout = 1 << 9
+
+/*
+	DAState is the state of the TPM dictionary attack protection.
+*/
+type DAState struct {
+	Counter  uint32        // Number of authorization failures
+	MaxTries uint32        // Number of failures that locks the TPM out
+	Interval time.Duration // Delay after which the counter is decremented, never if 0
+	Recovery time.Duration // Delay before the lockout authorization can be used again after a failure
+	Lockout  bool          // The TPM refuses DA protected authorizations
+}
+
+/*
+	Remaining returns the number of wrong PINs
+	that can be entered before the lockout.
+*/
+func (s *DAState) Remaining() uint32 {
+	if s.Lockout || s.Counter >= s.MaxTries {
+		return 0
+	}
+	return s.MaxTries - s.Counter
+}
+
+/*
+	RecoveryTime returns the maximum time before the TPM accepts
+	a PIN again, i.e. before the counter is decremented below
+	MaxTries, and false if it doesn't recover by itself.
+	As the TPM doesn't tell when the counter was last decremented,
+	it may recover earlier.
+*/
+func (s *DAState) RecoveryTime() (time.Duration, bool) {
+	if s.Remaining() > 0 {
+		return 0, true
+	}
+	if s.Interval == 0 {
+		return 0, false
+	}
+	if s.Counter < s.MaxTries {
+		return s.Interval, true
+	}
+	return time.Duration(s.Counter - s.MaxTries + 1) * s.Interval, true
+}
+
+/*
+	Err returns the error explaining that the TPM is
+	locked out, or nil if it accepts PINs.
+*/
+func (s *DAState) Err() error {
+	if s.Remaining() > 0 {
+		return nil
+	}
+	return lockoutError(s)
+}
+
+/*
+	lockoutError returns the error explaining that the TPM
+	is locked out, and when it will recover, given its @state.
+*/
+func lockoutError(state *DAState) error {
+	const reset = "reset its dictionary attack counter with its lockout authorization"
+
+	if state == nil {
+		return errors.New("The TPM is locked out after too many wrong PINs: wait for it to recover, or " + reset)
+	}
+	if recovery, ok := state.RecoveryTime(); ok {
+		return fmt.Errorf("The TPM is locked out after too many wrong PINs: it will accept a PIN again in at most %v, or once you %s", recovery, reset)
+	}
+	return errors.New("The TPM is locked out after too many wrong PINs, and won't recover by itself: " + reset)
+}
+
+/*
+	ReadDAState returns the state of the TPM
+	dictionary attack protection.
+*/
+func ReadDAState() (*DAState, error) {
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+	return readDAState(rwc)
+}
+
+func readDAState(rw io.ReadWriter) (*DAState, error) {
+	var state DAState
+
+	props, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 1, uint32(tpm2.TPMAPermanent))
+	if err != nil {
+		return nil, err
+	}
+	more, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 4, uint32(tpm2.LockoutCounter))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range append(props, more...) {
+		prop, ok := p.(tpm2.TaggedProperty)
+		if !ok {
+			continue
+		}
+		switch prop.Tag {
+		case tpm2.TPMAPermanent:
+			state.Lockout = prop.Value & permanentInLockout != 0
+		case tpm2.LockoutCounter:
+			state.Counter = prop.Value
+		case tpm2.MaxAuthFail:
+			state.MaxTries = prop.Value
+		case tpm2.LockoutInterval:
+			state.Interval = time.Duration(prop.Value) * time.Second
+		case tpm2.LockoutRecovery:
+			state.Recovery = time.Duration(prop.Value) * time.Second
+		}
+	}
+	return &state, nil
+}
+
+/*
+	isAuthFailure returns whether @err is a wrong
+	authorization value, i.e. a wrong PIN.
+*/
+func isAuthFailure(err error) bool {
+	var tpmErr *tpmError
+	var sessionErr tpm2.SessionError
+
+	if errors.As(err, &sessionErr) {
+		return sessionErr.Code == tpm2.RCAuthFail || sessionErr.Code == tpm2.RCBadAuth
+	}
+	if !errors.As(err, &tpmErr) || tpmErr.rc & 0x80 == 0 {
+		return false
+	}
+	// Format one response code, with the session number
+	code := tpm2.RCFmt1(tpmErr.rc & 0x3f)
+	return code == tpm2.RCAuthFail || code == tpm2.RCBadAuth
+}
+
+/*
+	isLockout returns whether @err is due
+	to the TPM being locked out.
+*/
+func isLockout(err error) bool {
+	var tpmErr *tpmError
+	var warning tpm2.Warning
+
+	if errors.As(err, &warning) {
+		return warning.Code == tpm2.RCLockout
+	}
+	return errors.As(err, &tpmErr) && uint32(tpmErr.rc) == rcLockout
+}
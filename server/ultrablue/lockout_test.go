@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestTPMErrors(t *testing.T) {
+	var cases = []struct {
+		err         error
+		authFailure bool
+		lockout     bool
+		name        string
+	}{
+		{responseError("TPM command 0x15e", 0x98e), true, false, "Wrong PIN in the first session"},
+		{responseError("TPM command 0x15e", 0x9a2), true, false, "Wrong PIN without DA implications"},
+		{responseError("TPM command 0x15e", 0x921), false, true, "Lockout"},
+		{responseError("TPM command 0x15e", 0x99d), false, false, "Policy failure"},
+		{responseError("TPM2_PolicyAuthValue", 0x0e), false, false, "Format zero response code"},
+		{fmt.Errorf("unseal: %w", tpm2.SessionError{Code: tpm2.RCAuthFail}), true, false, "Wrapped go-tpm session error"},
+		{tpm2.Warning{Code: tpm2.RCLockout}, false, true, "go-tpm lockout warning"},
+		{errors.New("failed with response code 0x98e"), false, false, "Untyped error"},
+	}
+
+	for _, c := range cases {
+		if isAuthFailure(c.err) != c.authFailure {
+			t.Errorf("[%s]: expected auth failure: %t", c.name, c.authFailure)
+		}
+		if isLockout(c.err) != c.lockout {
+			t.Errorf("[%s]: expected lockout: %t", c.name, c.lockout)
+		}
+	}
+}
+
+func TestDARemaining(t *testing.T) {
+	var cases = []struct {
+		state    DAState
+		expected uint32
+	}{
+		{DAState{Counter: 0, MaxTries: 32}, 32},
+		{DAState{Counter: 31, MaxTries: 32}, 1},
+		{DAState{Counter: 32, MaxTries: 32}, 0},
+		{DAState{Counter: 5, MaxTries: 3}, 0},
+	}
+
+	for _, c := range cases {
+		if r := c.state.Remaining(); r != c.expected {
+			t.Errorf("%+v: expected %d remaining attempts, got %d", c.state, c.expected, r)
+		}
+	}
+}
+
+func TestDARecoveryTime(t *testing.T) {
+	var cases = []struct {
+		state       DAState
+		expected    time.Duration
+		recoverable bool
+	}{
+		{DAState{Counter: 3, MaxTries: 32, Interval: time.Hour}, 0, true},
+		{DAState{Counter: 32, MaxTries: 32, Interval: time.Hour}, time.Hour, true},
+		{DAState{Counter: 34, MaxTries: 32, Interval: 10 * time.Minute}, 30 * time.Minute, true},
+		{DAState{Counter: 3, MaxTries: 32, Interval: time.Hour, Lockout: true}, time.Hour, true},
+		{DAState{Counter: 32, MaxTries: 32}, 0, false},
+	}
+
+	for _, c := range cases {
+		recovery, ok := c.state.RecoveryTime()
+		if recovery != c.expected || ok != c.recoverable {
+			t.Errorf("%+v: expected %v (recoverable: %t), got %v (%t)", c.state, c.expected, c.recoverable, recovery, ok)
+		}
+		if (c.state.Err() == nil) != (c.state.Remaining() > 0) {
+			t.Errorf("%+v: Err doesn't match the remaining attempts", c.state)
+		}
+	}
+}
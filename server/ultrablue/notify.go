@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement the systemd notification
+	protocol (see sd_notify(3)), so that a Type=notify unit can tell
+	an attester waiting for the phone from a stuck one:
+		- STATUS tells the current step of the attestation
+		- WATCHDOG pings are sent at half the watchdog interval for as
+		  long as Run runs and the protocol instances make progress:
+		  each message exchanged with the verifier, status change and
+		  long TPM operation (quote, credential activation, unsealing)
+		  counts as such. Waiting for a verifier to connect, or for the
+		  user to enter a PIN, doesn't stall the attester, and an
+		  instance ends when its verifier disconnects. An instance
+		  stuck for the whole interval stops the pings, so that the
+		  service manager restarts the service.
+		- READY is sent when advertising in daemon mode, and by the
+		  command once the attestation outcome has been handled otherwise
+
+	Notifications are silently dropped when not run by systemd.
+*/
+
+package ultrablue
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	Notify sends the notification @state, e.g. "READY=1",
+	to the service manager, if any.
+*/
+func Notify(state string) error {
+	var addr = os.Getenv("NOTIFY_SOCKET")
+
+	if addr == "" {
+		return nil
+	}
+	// Abstract socket names, starting with '@', are handled by net
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+/*
+	setStatus logs @status, sends it to the service manager,
+	and reports it to the OnStatus callback, if any.
+*/
+func (a *attester) setStatus(status string) {
+	a.watchdog.progress()
+	logrus.Info(status)
+	if err := Notify("STATUS=" + status); err != nil {
+		logrus.Debug("Failed to notify the service manager: ", err)
+	}
+	if a.cfg.OnStatus != nil {
+		a.cfg.OnStatus(status)
+	}
+}
+
+/*
+	watchdogInterval returns the watchdog interval
+	set by the service manager, or 0 if disabled.
+*/
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec == 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+/*
+	watchdog tracks the progress of the protocol instances, to
+	only ping the service manager watchdog while they make some.
+	A nil watchdog is disabled.
+*/
+type watchdog struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     time.Time // Last progress of a protocol instance
+	running  int       // Number of running protocol instances
+	waiting  int       // Number of them waiting for the user
+	stalled  bool      // The pings have been stopped
+}
+
+/*
+	newWatchdog returns the watchdog of the service manager
+	watchdog @interval, or nil if it's disabled.
+*/
+func newWatchdog(interval time.Duration) *watchdog {
+	if interval == 0 {
+		return nil
+	}
+	return &watchdog{interval: interval, last: time.Now()}
+}
+
+/*
+	run pings the service manager watchdog at half its
+	interval, while the protocol instances make
+	progress, until @ctx is done.
+*/
+func (w *watchdog) run(ctx context.Context) {
+	if w == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(w.interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				w.ping(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+/*
+	progress records that a protocol instance made progress.
+*/
+func (w *watchdog) progress() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = time.Now()
+}
+
+/*
+	start records the start of a protocol instance,
+	and returns the function to call once it's done.
+*/
+func (w *watchdog) start() func() {
+	if w == nil {
+		return func() {}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.running++
+	w.last = time.Now()
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.running--
+		w.last = time.Now()
+	}
+}
+
+/*
+	waitUser calls @f, which waits for the user, e.g. to
+	enter a PIN, without stalling the protocol instance.
+*/
+func (w *watchdog) waitUser(f func()) {
+	if w == nil {
+		f()
+		return
+	}
+	w.mu.Lock()
+	w.waiting++
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.waiting--
+		w.last = time.Now()
+	}()
+	f()
+}
+
+/*
+	healthy returns whether, at @now, all the protocol instances
+	are waiting for the user, or one made progress within the
+	watchdog interval.
+*/
+func (w *watchdog) healthy(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.running == w.waiting || now.Sub(w.last) < w.interval
+}
+
+/*
+	ping pings the service manager watchdog at @now,
+	unless the protocol instances stopped progressing.
+*/
+func (w *watchdog) ping(now time.Time) {
+	if !w.healthy(now) {
+		if !w.stalled {
+			logrus.Error("The attestation hasn't progressed for ", w.interval, ", stopping the watchdog pings")
+		}
+		w.stalled = true
+		return
+	}
+	w.stalled = false
+	if err := Notify("WATCHDOG=1"); err != nil {
+		logrus.Debug("Failed to ping the watchdog: ", err)
+	}
+}
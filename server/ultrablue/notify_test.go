@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "notify")
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("Notifications must be dropped without a service manager: %v", err)
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err = Notify("STATUS=Attesting"); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "STATUS=Attesting" {
+		t.Errorf("Unexpected notification: %q", buf[:n])
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := watchdogInterval(); interval != 30 * time.Second {
+		t.Errorf("Expected 30s, got %v", interval)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("The watchdog of another process must be ignored, got %v", interval)
+	}
+	t.Setenv("WATCHDOG_USEC", "")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("The watchdog must be disabled, got %v", interval)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "notify")
+	var interval = 30 * time.Second
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	pinged := func() bool {
+		var buf = make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		return err == nil && string(buf[:n]) == "WATCHDOG=1"
+	}
+
+	if newWatchdog(0) != nil {
+		t.Errorf("The watchdog must be disabled without an interval")
+	}
+	var w = newWatchdog(interval)
+	var later = time.Now().Add(2 * interval)
+	if w.ping(later); !pinged() {
+		t.Errorf("An idle attester must ping the watchdog")
+	}
+
+	done := w.start()
+	if w.ping(time.Now()); !pinged() {
+		t.Errorf("A progressing attester must ping the watchdog")
+	}
+	if w.ping(later); pinged() || !w.stalled {
+		t.Errorf("A stalled attester must stop pinging the watchdog")
+	}
+	w.waitUser(func() {
+		if w.ping(later); !pinged() {
+			t.Errorf("Waiting for the user must not stall the attester")
+		}
+	})
+	w.progress()
+	if w.ping(time.Now()); !pinged() || w.stalled {
+		t.Errorf("The pings must resume once the attester progresses")
+	}
+	done()
+	if w.ping(later.Add(interval)); !pinged() {
+		t.Errorf("The pings must resume once the stalled instance is done")
+	}
+
+	// A disabled watchdog can be used as an enabled one
+	var disabled *watchdog
+	disabled.progress()
+	disabled.start()()
+	disabled.waitUser(func() {})
+	disabled.run(nil)
+}
@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file parse the PE images of the boot
+	chain (shim, boot loaders, EFI stub kernels and UKIs) to
+	compute the digests the firmware and systemd-stub measure.
+*/
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Security directory entry, pointing to the Authenticode certificates
+const peCertificateTableEntry = 4
+
+/*
+	peSection is a section of a PE image.
+*/
+type peSection struct {
+	Name        string
+	VirtualSize uint32
+	Size        uint32 // SizeOfRawData
+	Offset      uint32 // PointerToRawData
+}
+
+/*
+	peImage holds the parsed headers of a PE image.
+*/
+type peImage struct {
+	data        []byte
+	checksum    int // Offset of the CheckSum field
+	certEntry   int // Offset of the certificate table directory entry
+	certOffset  uint32
+	certSize    uint32
+	headersSize uint32
+	sections    []peSection
+}
+
+/*
+	parsePE parses the headers of the PE image @data.
+*/
+func parsePE(data []byte) (*peImage, error) {
+	var img = peImage{data: data}
+	var invalid = errors.New("Invalid PE image")
+
+	if len(data) < 0x40 || !bytes.Equal(data[:2], []byte("MZ")) {
+		return nil, invalid
+	}
+	peOffset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	if peOffset + 24 > len(data) || !bytes.Equal(data[peOffset:peOffset + 4], []byte("PE\x00\x00")) {
+		return nil, invalid
+	}
+	coff := data[peOffset + 4:]
+	sectionCount := int(binary.LittleEndian.Uint16(coff[2:]))
+	optSize := int(binary.LittleEndian.Uint16(coff[16:]))
+	opt := peOffset + 24
+	if opt + optSize > len(data) || optSize < 68 {
+		return nil, invalid
+	}
+
+	var dirs, dirCount int
+	switch binary.LittleEndian.Uint16(data[opt:]) {
+	case 0x10b: // PE32
+		dirs, dirCount = opt + 96, int(binary.LittleEndian.Uint32(data[opt + 92:]))
+	case 0x20b: // PE32+
+		dirs, dirCount = opt + 112, int(binary.LittleEndian.Uint32(data[opt + 108:]))
+	default:
+		return nil, invalid
+	}
+	img.checksum = opt + 64
+	img.headersSize = binary.LittleEndian.Uint32(data[opt + 60:])
+	img.certEntry = dirs + peCertificateTableEntry * 8
+	if dirCount <= peCertificateTableEntry || img.certEntry + 8 > opt + optSize || img.certEntry + 8 > int(img.headersSize) {
+		return nil, invalid
+	}
+	img.certOffset = binary.LittleEndian.Uint32(data[img.certEntry:])
+	img.certSize = binary.LittleEndian.Uint32(data[img.certEntry + 4:])
+	if int(img.headersSize) > len(data) || uint64(img.certOffset) + uint64(img.certSize) > uint64(len(data)) {
+		return nil, invalid
+	}
+
+	table := opt + optSize
+	if table + sectionCount * 40 > len(data) {
+		return nil, invalid
+	}
+	for i := 0; i < sectionCount; i++ {
+		hdr := data[table + i * 40:]
+		s := peSection{
+			Name:        strings.TrimRight(string(hdr[:8]), "\x00"),
+			VirtualSize: binary.LittleEndian.Uint32(hdr[8:]),
+			Size:        binary.LittleEndian.Uint32(hdr[16:]),
+			Offset:      binary.LittleEndian.Uint32(hdr[20:]),
+		}
+		if uint64(s.Offset) + uint64(s.Size) > uint64(len(data)) {
+			return nil, invalid
+		}
+		img.sections = append(img.sections, s)
+	}
+	return &img, nil
+}
+
+/*
+	authenticodeHash returns the SHA256 Authenticode digest of
+	@img, as measured by the firmware when loading it.
+*/
+func (img *peImage) authenticodeHash() []byte {
+	var h = sha256.New()
+	var data = img.data
+
+	h.Write(data[:img.checksum])
+	h.Write(data[img.checksum + 4:img.certEntry])
+	h.Write(data[img.certEntry + 8:img.headersSize])
+	hashed := uint64(img.headersSize)
+
+	sections := append([]peSection{}, img.sections...)
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Offset < sections[j].Offset })
+	for _, s := range sections {
+		if s.Size == 0 {
+			continue
+		}
+		h.Write(data[s.Offset:s.Offset + s.Size])
+		hashed += uint64(s.Size)
+	}
+	end := uint64(len(data)) - uint64(img.certSize)
+	if hashed < end {
+		h.Write(data[hashed:end])
+	}
+	return h.Sum(nil)
+}
+
+/*
+	section returns the content of the section @name of @img,
+	as loaded in memory, or nil if there is no such section.
+*/
+func (img *peImage) section(name string) []byte {
+	for _, s := range img.sections {
+		if s.Name != name {
+			continue
+		}
+		size := s.VirtualSize
+		if size == 0 {
+			size = s.Size
+		}
+		content := make([]byte, size)
+		if s.Size < size {
+			copy(content, img.data[s.Offset:s.Offset + s.Size])
+		} else {
+			copy(content, img.data[s.Offset:s.Offset + size])
+		}
+		return content
+	}
+	return nil
+}
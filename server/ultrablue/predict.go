@@ -0,0 +1,546 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file predict the PCR values of the next
+	boot, once an update of the boot chain has been installed.
+
+	The current event log is replayed, with the digests of the
+	updated components replaced by the ones they'll be measured with:
+		- PCR4: the Authenticode digest of the boot applications
+		  (shim, boot loaders, EFI stub kernels or UKIs)
+		- PCR7: the dbx variable, when it's updated. The authorities
+		  that verified the boot applications are measured too, once
+		  per boot: as new boot applications or kernels may be signed
+		  by other ones, PCR7 isn't predicted when they are updated
+		- PCR8: the strings measured by GRUB, such as its
+		  commands and the kernel command line
+		- PCR9: the files measured by GRUB, such as the kernel,
+		  the initrd and the GRUB configuration
+		- PCR11: the sections of the UKI, measured by systemd-stub in
+		  place of the ones of the current UKI, followed by the phases
+		  measured by systemd-pcrphase before the attestation, which
+		  aren't in the event log
+
+	The predicted values are stored in the keys directory, and sent
+	to the verifiers that ask for them after a successful attestation,
+	so that they can accept the next boot. They are signed with the AK,
+	along with the nonce of the attestation, so that the verifier knows
+	they come from the attester it just trusted: the signed message is
+
+		NEXT_STATE_LABEL || nonce || SHA256(index || value || ...)
+
+	with the PCRs sorted by index, encoded as big endian uint32.
+	The label starts the message with something else than
+	TPM_GENERATED_VALUE, which the restricted AK requires.
+*/
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	NEXT_STATE_FILE  = "next-state.json"
+	NEXT_STATE_LABEL = "ULTRABLUE NEXT STATE\x00"
+)
+
+// PCRs whose values are predicted
+var PREDICTED_PCRS = []int{4, 7, 8, 9, 11}
+
+// Event types, from the TCG PC Client Platform Firmware Profile
+const (
+	evNoAction                   = 0x00000003
+	evIPL                        = 0x0000000d
+	evEFIVariableDriverConfig    = 0x80000001
+	evEFIBootServicesApplication = 0x80000003
+)
+
+// Sections of an UKI measured by systemd-stub, in order. The
+// .pcrsig section isn't measured, as it depends on the others.
+var ukiSections = []string{".linux", ".osrel", ".cmdline", ".initrd", ".ucode", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey"}
+
+// Prefixes GRUB adds to the description of the strings it measures
+var grubStringPrefixes = []string{"grub_cmd: ", "kernel_cmdline: ", "module_cmdline: "}
+
+// Prediction describes the update of the boot chain to predict the PCRs for.
+type Prediction struct {
+	Images  map[string][]byte // New boot applications, by path on the ESP (e.g. \EFI\BOOT\BOOTX64.EFI)
+	Kernel  []byte            // New kernel or UKI, replacing the boot application identified by kernelEvent
+	Files   map[string][]byte // New files measured by GRUB, by path (e.g. /vmlinuz-6.1.0-13-amd64)
+	Strings map[string]string // New strings measured by GRUB, by current string (e.g. "grub_cmd: linux /vmlinuz-6.1.0-12-amd64")
+	Cmdline *string           // New kernel command line measured by GRUB, if it changes
+	DBX     []byte            // New content of the dbx variable, if it changes
+	Phases  []string          // systemd-pcrphase phases measured in PCR11 before the attestation
+}
+
+func decodeUTF16(b []byte) string {
+	var chars []uint16
+	for i := 0; i + 1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars))
+}
+
+/*
+	decodeString decodes the NUL terminated description of an
+	event, which is either an ASCII or an UTF-16 string.
+*/
+func decodeString(b []byte) string {
+	if len(b) >= 2 && b[0] != 0 && b[1] == 0 {
+		return decodeUTF16(b)
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
+
+/*
+	isUKISection returns whether @e is a measurement of
+	an UKI section by systemd-stub, which describes both
+	the name and the content measurements with the name.
+*/
+func isUKISection(e attest.Event) bool {
+	if e.Index != 11 || e.Type != evIPL {
+		return false
+	}
+	name := decodeString(e.Data)
+	for _, section := range ukiSections {
+		if name == section {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	isKernelPath returns whether @path is the one of a
+	kernel image, or of a UKI installed by kernel-install.
+*/
+func isKernelPath(path string) bool {
+	path = strings.ToLower(strings.ReplaceAll(path, "/", `\`))
+	name := path[strings.LastIndex(path, `\`) + 1:]
+	for _, prefix := range []string{"vmlinuz", "vmlinux", "bzimage", "linux"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(path, `\efi\linux\`)
+}
+
+/*
+	kernelEvent returns the index in @events of the boot application
+	the new kernel replaces, or -1 if there is none: the UKI whose
+	sections systemd-stub measured, else the last application loaded
+	from a kernel path, else the last application. Boot loaders and
+	chainloaded ones may be loaded after the kernel, and systemd-stub
+	may load the kernel of the UKI from memory after it.
+*/
+func kernelEvent(events []attest.Event) int {
+	var last, lastKernel = -1, -1
+
+	for i, e := range events {
+		switch {
+		case e.Index == 4 && e.Type == evEFIBootServicesApplication:
+			last = i
+			if isKernelPath(imagePath(e.Data)) {
+				lastKernel = i
+			}
+		case isUKISection(e) && last >= 0:
+			return last
+		}
+	}
+	if lastKernel >= 0 {
+		return lastKernel
+	}
+	return last
+}
+
+/*
+	imagePath returns the path on the ESP of the image whose
+	UEFI_IMAGE_LOAD_EVENT structure is @data, or "" if it
+	hasn't been loaded from a file.
+*/
+func imagePath(data []byte) string {
+	var path string
+
+	if len(data) < 32 {
+		return ""
+	}
+	size := binary.LittleEndian.Uint64(data[24:])
+	if size > uint64(len(data) - 32) {
+		return ""
+	}
+	for dp := data[32:32 + size]; len(dp) >= 4; {
+		length := int(binary.LittleEndian.Uint16(dp[2:]))
+		if length < 4 || length > len(dp) || dp[0] == 0x7f {
+			break
+		}
+		// Media device path, file path node
+		if dp[0] == 0x04 && dp[1] == 0x04 {
+			path += decodeUTF16(dp[4:length])
+		}
+		dp = dp[length:]
+	}
+	return path
+}
+
+/*
+	variableDigest returns the digest of the UEFI variable event
+	@data, with the value of the variable @name replaced by @value,
+	or nil if @data is another variable.
+*/
+func variableDigest(data []byte, name string, value []byte) []byte {
+	if len(data) < 32 {
+		return nil
+	}
+	nameLength := binary.LittleEndian.Uint64(data[16:])
+	if nameLength > uint64(len(data) - 32) / 2 || decodeUTF16(data[32:32 + nameLength * 2]) != name {
+		return nil
+	}
+	var event bytes.Buffer
+	event.Write(data[:24])
+	binary.Write(&event, binary.LittleEndian, uint64(len(value)))
+	event.Write(data[32:32 + nameLength * 2])
+	event.Write(value)
+	digest := sha256.Sum256(event.Bytes())
+	return digest[:]
+}
+
+/*
+	grubStringDigest returns the digest GRUB measures along
+	with the description @s: the one of the string without prefix.
+*/
+func grubStringDigest(s string) []byte {
+	for _, prefix := range grubStringPrefixes {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	digest := sha256.Sum256([]byte(s))
+	return digest[:]
+}
+
+/*
+	predictDigest returns the digest the event @e will be
+	measured with once @p is applied.
+*/
+func (p *Prediction) predictDigest(e attest.Event, kernel bool) ([]byte, error) {
+	switch {
+	case e.Index == 4 && e.Type == evEFIBootServicesApplication:
+		image, ok := p.Images[strings.ToUpper(imagePath(e.Data))]
+		if kernel && p.Kernel != nil {
+			image, ok = p.Kernel, true
+		}
+		if !ok {
+			break
+		}
+		pe, err := parsePE(image)
+		if err != nil {
+			return nil, err
+		}
+		return pe.authenticodeHash(), nil
+	case e.Index == 7 && e.Type == evEFIVariableDriverConfig && p.DBX != nil:
+		if digest := variableDigest(e.Data, "dbx", p.DBX); digest != nil {
+			return digest, nil
+		}
+	case e.Index == 8 && e.Type == evIPL:
+		s := strings.TrimRight(string(e.Data), "\x00")
+		if p.Cmdline != nil && strings.HasPrefix(s, "kernel_cmdline: ") {
+			return grubStringDigest(*p.Cmdline), nil
+		}
+		if n, ok := p.Strings[s]; ok {
+			return grubStringDigest(n), nil
+		}
+	case e.Index == 9 && e.Type == evIPL:
+		if file, ok := p.Files[strings.TrimRight(string(e.Data), "\x00")]; ok {
+			digest := sha256.Sum256(file)
+			return digest[:], nil
+		}
+	}
+	return e.Digest, nil
+}
+
+func extend(pcr, digest []byte) []byte {
+	h := sha256.Sum256(append(append([]byte{}, pcr...), digest...))
+	return h[:]
+}
+
+/*
+	ukiMeasurements returns the digests systemd-stub extends PCR11
+	with for the UKI @pe, in order, or nil if @pe isn't an UKI.
+*/
+func ukiMeasurements(pe *peImage) [][]byte {
+	var digests [][]byte
+
+	if pe.section(".linux") == nil {
+		return nil
+	}
+	for _, name := range ukiSections {
+		content := pe.section(name)
+		if content == nil {
+			continue
+		}
+		nameDigest := sha256.Sum256(append([]byte(name), 0))
+		contentDigest := sha256.Sum256(content)
+		digests = append(digests, nameDigest[:], contentDigest[:])
+	}
+	return digests
+}
+
+/*
+	changesAuthorities returns whether @p updates an image verified
+	by the firmware or shim, which may then measure other authorities
+	in PCR7: a boot application, or a kernel loaded by GRUB.
+*/
+func (p *Prediction) changesAuthorities() bool {
+	if len(p.Images) > 0 || p.Kernel != nil {
+		return true
+	}
+	for path := range p.Files {
+		if isKernelPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	PredictPCRs returns the SHA256 values of the PREDICTED_PCRS
+	for the next boot, from the current @eventlog and the update @p.
+	An empty update predicts the current values. PCR7 is missing if
+	the update changes the images the authorities are measured for.
+*/
+func PredictPCRs(eventlog []byte, p *Prediction) (map[int][]byte, error) {
+	var pcrs = make(map[int][]byte)
+	var uki [][]byte
+
+	el, err := attest.ParseEventLog(eventlog)
+	if err != nil {
+		return nil, err
+	}
+	for _, pcr := range PREDICTED_PCRS {
+		pcrs[pcr] = make([]byte, sha256.Size)
+	}
+	// Paths on the ESP are case insensitive
+	var images = make(map[string][]byte)
+	for path, image := range p.Images {
+		images[strings.ToUpper(path)] = image
+	}
+	var prediction = *p
+	prediction.Images = images
+
+	if p.Kernel != nil {
+		pe, err := parsePE(p.Kernel)
+		if err != nil {
+			return nil, err
+		}
+		uki = ukiMeasurements(pe)
+	}
+	events := el.Events(attest.HashSHA256)
+	kernel := kernelEvent(events)
+	// The sections of the new UKI are measured in place of the
+	// ones of the current UKI, or first if it isn't one.
+	var sections = -1
+	for i, e := range events {
+		if isUKISection(e) {
+			sections = i
+			break
+		}
+	}
+	if sections < 0 {
+		for _, digest := range uki {
+			pcrs[11] = extend(pcrs[11], digest)
+		}
+	}
+
+	for i, e := range events {
+		if _, ok := pcrs[e.Index]; !ok || e.Type == evNoAction {
+			continue
+		}
+		if e.Digest == nil {
+			return nil, errors.New("The event log has no SHA256 digests")
+		}
+		if p.Kernel != nil && isUKISection(e) {
+			if i == sections {
+				for _, digest := range uki {
+					pcrs[11] = extend(pcrs[11], digest)
+				}
+			}
+			continue
+		}
+		digest, err := prediction.predictDigest(e, i == kernel)
+		if err != nil {
+			return nil, fmt.Errorf("PCR %d: %v", e.Index, err)
+		}
+		pcrs[e.Index] = extend(pcrs[e.Index], digest)
+	}
+
+	for _, phase := range p.Phases {
+		digest := sha256.Sum256([]byte(phase))
+		pcrs[11] = extend(pcrs[11], digest[:])
+	}
+	if p.changesAuthorities() {
+		delete(pcrs, 7)
+	}
+	return pcrs, nil
+}
+
+/*
+	ReadPCRValues reads the JSON file at @path, mapping PCR indexes
+	to hex encoded SHA256 values, e.g. {"4": "3d45...", "7": "b5a1..."}.
+*/
+func ReadPCRValues(path string) (map[int][]byte, error) {
+	var encoded map[string]string
+	var values = make(map[int][]byte)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	for index, value := range encoded {
+		pcr, err := strconv.Atoi(index)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PCR index: %s", index)
+		}
+		if values[pcr], err = hex.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("Invalid value for PCR %d: %v", pcr, err)
+		}
+	}
+	return values, nil
+}
+
+/*
+	WritePCRValues writes the PCR @values to the file at @path,
+	in the format read by ReadPCRValues.
+*/
+func WritePCRValues(path string, values map[int][]byte) error {
+	var encoded = make(map[string]string)
+
+	for pcr, value := range values {
+		encoded[strconv.Itoa(pcr)] = hex.EncodeToString(value)
+	}
+	data, err := json.MarshalIndent(encoded, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// NextState is sent to the verifiers that ask for it after
+// a successful attestation.
+type NextState struct {
+	PCRs      map[int][]byte // Expected SHA256 PCR values on next boot, empty if no update is pending
+	Signature []byte         // RSASSA-SHA256 signature of the AK, see above
+}
+
+/*
+	NextStateMessage returns the message signed with the AK to
+	propose the SHA256 @pcrs, during the attestation with @nonce.
+*/
+func NextStateMessage(nonce []byte, pcrs map[int][]byte) []byte {
+	var indexes []int
+	var h = sha256.New()
+
+	for pcr := range pcrs {
+		indexes = append(indexes, pcr)
+	}
+	sort.Ints(indexes)
+	for _, pcr := range indexes {
+		binary.Write(h, binary.BigEndian, uint32(pcr))
+		h.Write(pcrs[pcr])
+	}
+	msg := append([]byte(NEXT_STATE_LABEL), nonce...)
+	return h.Sum(msg)
+}
+
+/*
+	sign signs @state with @ak, for the attestation with @nonce.
+	As the AK is restricted, the message is hashed by the TPM,
+	which checks it isn't a forged quote.
+*/
+func (state *NextState) sign(ak *attest.AK, nonce []byte) error {
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+
+	akHandle, err := loadAKHandle(rwc, ak)
+	if err != nil {
+		return err
+	}
+	defer tpm2.FlushContext(rwc, akHandle)
+
+	digest, ticket, err := tpm2.Hash(rwc, tpm2.AlgSHA256, NextStateMessage(nonce, state.PCRs), tpm2.HandleOwner)
+	if err != nil {
+		return err
+	}
+	sig, err := tpm2.Sign(rwc, akHandle, "", digest, ticket, nil)
+	if err != nil {
+		return err
+	}
+	if sig.RSA == nil {
+		return errors.New("The next state isn't signed with RSA")
+	}
+	state.Signature = sig.RSA.Signature
+	return nil
+}
+
+/*
+	nextState returns the PCR values predicted for the next boot,
+	if an update is pending. Once the update has been booted, the
+	prediction matches the current values and is removed.
+*/
+func (a *attester) nextState() (NextState, error) {
+	var path = filepath.Join(a.cfg.KeysPath, NEXT_STATE_FILE)
+	var state NextState
+
+	values, err := ReadPCRValues(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	var pcrs []int
+	for pcr := range values {
+		pcrs = append(pcrs, pcr)
+	}
+	current, err := ReadPCRs(pcrs)
+	if err != nil {
+		return state, err
+	}
+	for pcr, value := range values {
+		if !bytes.Equal(current[pcr], value) {
+			state.PCRs = values
+			return state, nil
+		}
+	}
+	logrus.Info("The predicted update has been booted, removing its prediction")
+	return state, os.Remove(path)
+}
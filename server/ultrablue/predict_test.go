@@ -0,0 +1,381 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+)
+
+const (
+	evSeparator            = 0x00000004
+	evEFIVariableAuthority = 0x800000e0
+)
+
+/*
+	testEvent is an event of the event logs built by buildEventLog.
+	Its digest is the one of its data, unless @digest is set.
+*/
+type testEvent struct {
+	pcr    int
+	typ    uint32
+	data   []byte
+	digest []byte
+}
+
+/*
+	buildEventLog returns the crypto agile event log of @events,
+	and the PCR values it replays to. Only the SHA256 bank is
+	logged, as it's the only one predicted.
+*/
+func buildEventLog(t *testing.T, events []testEvent) ([]byte, map[int][]byte) {
+	var log, spec bytes.Buffer
+	var le = binary.LittleEndian
+	var pcrs = make(map[int][]byte)
+
+	// TCG_EfiSpecIDEvent, in the SHA1 log format
+	spec.WriteString("Spec ID Event03\x00")
+	binary.Write(&spec, le, uint32(0))
+	spec.Write([]byte{0, 2, 0, 2})
+	binary.Write(&spec, le, []uint32{1, uint32(tpm2.AlgSHA256) | sha256.Size << 16})
+	spec.WriteByte(0)
+	binary.Write(&log, le, []uint32{0, evNoAction})
+	log.Write(make([]byte, 20))
+	binary.Write(&log, le, uint32(spec.Len()))
+	log.Write(spec.Bytes())
+
+	for _, e := range events {
+		digest := e.digest
+		if digest == nil {
+			h := sha256.Sum256(e.data)
+			digest = h[:]
+		}
+		binary.Write(&log, le, []uint32{uint32(e.pcr), e.typ, 1})
+		binary.Write(&log, le, uint16(tpm2.AlgSHA256))
+		log.Write(digest)
+		binary.Write(&log, le, uint32(len(e.data)))
+		log.Write(e.data)
+		if pcrs[e.pcr] == nil {
+			pcrs[e.pcr] = make([]byte, sha256.Size)
+		}
+		pcrs[e.pcr] = extend(pcrs[e.pcr], digest)
+	}
+	if _, err := attest.ParseEventLog(log.Bytes()); err != nil {
+		t.Fatalf("Invalid test event log: %v", err)
+	}
+	return log.Bytes(), pcrs
+}
+
+/*
+	imageLoadData returns the UEFI_IMAGE_LOAD_EVENT of an image loaded
+	from @path, or from memory if it's empty. Its device path only has
+	the file path node, the one read by imagePath.
+*/
+func imageLoadData(path string) []byte {
+	var data = make([]byte, 32)
+	if path == "" {
+		return data
+	}
+	var node = []byte{0x04, 0x04, 0, 0}
+	for _, c := range utf16.Encode([]rune(path)) {
+		node = binary.LittleEndian.AppendUint16(node, c)
+	}
+	binary.LittleEndian.PutUint16(node[2:], uint16(len(node)))
+	binary.LittleEndian.PutUint64(data[24:], uint64(len(node)))
+	return append(data, node...)
+}
+
+/*
+	authenticode returns the Authenticode digest of @image.
+*/
+func authenticode(t *testing.T, image []byte) []byte {
+	pe, err := parsePE(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pe.authenticodeHash()
+}
+
+/*
+	sectionEvents returns the events systemd-stub logs
+	when measuring the sections @names of an UKI.
+*/
+func sectionEvents(sections map[string][]byte, names []string) []testEvent {
+	var events []testEvent
+	for _, name := range names {
+		nameDigest := sha256.Sum256(append([]byte(name), 0))
+		contentDigest := sha256.Sum256(sections[name])
+		events = append(events,
+			testEvent{pcr: 11, typ: evIPL, data: append([]byte(name), 0), digest: nameDigest[:]},
+			testEvent{pcr: 11, typ: evIPL, data: append([]byte(name), 0), digest: contentDigest[:]},
+		)
+	}
+	return events
+}
+
+/*
+	buildPE returns a minimal PE32+ image with the given
+	@sections, followed by @certs as its certificate table.
+*/
+func buildPE(sections map[string][]byte, names []string, certs []byte) []byte {
+	const peOffset, optSize, headersSize = 0x40, 240, 0x200
+	var image = make([]byte, headersSize)
+
+	copy(image, "MZ")
+	binary.LittleEndian.PutUint32(image[0x3c:], peOffset)
+	copy(image[peOffset:], "PE\x00\x00")
+	coff := image[peOffset + 4:]
+	binary.LittleEndian.PutUint16(coff[2:], uint16(len(names)))
+	binary.LittleEndian.PutUint16(coff[16:], optSize)
+	opt := image[peOffset + 24:]
+	binary.LittleEndian.PutUint16(opt, 0x20b)
+	binary.LittleEndian.PutUint32(opt[60:], headersSize)
+	binary.LittleEndian.PutUint32(opt[64:], 0xdeadbeef)
+	binary.LittleEndian.PutUint32(opt[108:], 16)
+
+	table := image[peOffset + 24 + optSize:]
+	var content []byte
+	for i, name := range names {
+		hdr := table[i * 40:]
+		copy(hdr, name)
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(len(sections[name])))
+		binary.LittleEndian.PutUint32(hdr[16:], uint32(len(sections[name])))
+		binary.LittleEndian.PutUint32(hdr[20:], uint32(headersSize + len(content)))
+		content = append(content, sections[name]...)
+	}
+	binary.LittleEndian.PutUint32(opt[112 + 4 * 8:], uint32(headersSize + len(content)))
+	binary.LittleEndian.PutUint32(opt[112 + 4 * 8 + 4:], uint32(len(certs)))
+	return append(append(image, content...), certs...)
+}
+
+func TestPEImage(t *testing.T) {
+	var sections = map[string][]byte{".linux": []byte("kernel"), ".cmdline": []byte("quiet")}
+	var names = []string{".linux", ".cmdline"}
+
+	image := buildPE(sections, names, []byte("signature"))
+	pe, err := parsePE(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pe.section(".cmdline"), []byte("quiet")) || pe.section(".initrd") != nil {
+		t.Errorf("Unexpected sections: %+v", pe.sections)
+	}
+
+	// Neither the checksum, the certificate table entry nor
+	// the certificates are part of the Authenticode digest
+	unsigned := buildPE(sections, names, nil)
+	binary.LittleEndian.PutUint32(unsigned[0x40 + 24 + 64:], 0)
+	other, err := parsePE(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pe.authenticodeHash(), other.authenticodeHash()) {
+		t.Error("The Authenticode digest depends on the signature")
+	}
+	modified := buildPE(map[string][]byte{".linux": []byte("kernel"), ".cmdline": []byte("debug")}, names, nil)
+	if other, err = parsePE(modified); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(pe.authenticodeHash(), other.authenticodeHash()) {
+		t.Error("The Authenticode digest doesn't depend on the sections")
+	}
+
+	// systemd-stub measures the name, then the content, of each section, in order
+	var pcr = make([]byte, sha256.Size)
+	for _, s := range []string{".linux", ".cmdline"} {
+		name := sha256.Sum256(append([]byte(s), 0))
+		content := sha256.Sum256(sections[s])
+		pcr = extend(extend(pcr, name[:]), content[:])
+	}
+	var measured = make([]byte, sha256.Size)
+	for _, digest := range ukiMeasurements(pe) {
+		measured = extend(measured, digest)
+	}
+	if !bytes.Equal(measured, pcr) {
+		t.Errorf("Unexpected UKI PCR11 value: %x", measured)
+	}
+
+	if _, err := parsePE(image[:0x100]); err == nil {
+		t.Error("A truncated image should be rejected")
+	}
+}
+
+func TestGRUBStringDigest(t *testing.T) {
+	expected := sha256.Sum256([]byte("linux /vmlinuz root=/dev/sda1"))
+	if !bytes.Equal(grubStringDigest("grub_cmd: linux /vmlinuz root=/dev/sda1"), expected[:]) {
+		t.Error("The GRUB prefix must not be measured")
+	}
+}
+
+func TestPCRValuesFile(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), NEXT_STATE_FILE)
+	var values = map[int][]byte{4: bytes.Repeat([]byte{0xaa}, 32), 11: bytes.Repeat([]byte{0xbb}, 32)}
+
+	if err := WritePCRValues(path, values); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadPCRValues(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, values) {
+		t.Errorf("Expected %v, got %v", values, read)
+	}
+}
+
+func TestNextStateMessage(t *testing.T) {
+	var nonce = []byte("nonce")
+	var pcrs = map[int][]byte{9: {0x09}, 4: {0x04}}
+
+	msg := NextStateMessage(nonce, pcrs)
+	digest := sha256.Sum256([]byte{0, 0, 0, 4, 0x04, 0, 0, 0, 9, 0x09})
+	if !bytes.Equal(msg, append([]byte(NEXT_STATE_LABEL + "nonce"), digest[:]...)) {
+		t.Errorf("Unexpected message: %x", msg)
+	}
+	if bytes.Equal(msg, NextStateMessage([]byte("other"), pcrs)) {
+		t.Error("The message isn't bound to the nonce")
+	}
+}
+
+func TestKernelEvent(t *testing.T) {
+	var app = func(path string) testEvent {
+		return testEvent{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(path)}
+	}
+	var cases = []struct {
+		events   []testEvent
+		expected int
+		name     string
+	}{
+		{[]testEvent{app(`\EFI\debian\shimx64.efi`), app(`\EFI\debian\grubx64.efi`), app(`\vmlinuz-6.1.0-13-amd64`)}, 2, "GRUB"},
+		{[]testEvent{app(`\EFI\debian\shimx64.efi`), app(`\vmlinuz-6.1.0-13-amd64`), app(`\EFI\tools\fwupdx64.efi`)}, 1, "Application after the kernel"},
+		{append([]testEvent{app(`\EFI\systemd\systemd-bootx64.efi`), app(`\EFI\Linux\debian.efi`)}, sectionEvents(map[string][]byte{}, []string{".linux"})...), 1, "UKI"},
+		{append([]testEvent{app(`\EFI\BOOT\BOOTX64.EFI`), app(`\EFI\debian.efi`)}, append(sectionEvents(map[string][]byte{}, []string{".linux"}), app(""))...), 1, "UKI loading its kernel from memory"},
+		{[]testEvent{app(`\EFI\BOOT\BOOTX64.EFI`), app(`\EFI\debian\loader.efi`)}, 1, "Unknown kernel"},
+		{nil, -1, "No application"},
+	}
+
+	for _, c := range cases {
+		log, _ := buildEventLog(t, c.events)
+		el, err := attest.ParseEventLog(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := kernelEvent(el.Events(attest.HashSHA256)); i != c.expected {
+			t.Errorf("[%s]: expected event %d, got %d", c.name, c.expected, i)
+		}
+	}
+}
+
+func TestPredictPCRs(t *testing.T) {
+	var sections = map[string][]byte{".linux": []byte("kernel 6.1"), ".cmdline": []byte("quiet"), ".initrd": []byte("initrd 6.1")}
+	var newSections = map[string][]byte{".linux": []byte("kernel 6.5"), ".cmdline": []byte("quiet"), ".initrd": []byte("initrd 6.5")}
+	var names = []string{".linux", ".cmdline", ".initrd"}
+	var shim, grub = buildPE(map[string][]byte{".text": []byte("shim")}, []string{".text"}, nil), buildPE(map[string][]byte{".text": []byte("grub")}, []string{".text"}, nil)
+	var uki, newUKI = buildPE(sections, names, nil), buildPE(newSections, names, nil)
+	var stubKernel = buildPE(map[string][]byte{".text": []byte("vmlinuz 6.5")}, []string{".text"}, nil)
+	var sbVar = make([]byte, 32)
+	var separator = testEvent{pcr: 7, typ: evSeparator, data: []byte{0, 0, 0, 0}}
+	var authority = testEvent{pcr: 7, typ: evEFIVariableAuthority, data: []byte("db certificate")}
+	var other = testEvent{pcr: 11, typ: evIPL, data: []byte("other measurement\x00")}
+	var phase = sha256.Sum256([]byte("enter-initrd"))
+
+	// systemd-boot loading an UKI, whose kernel is then loaded from memory
+	var ukiEvents = []testEvent{
+		{pcr: 7, typ: evEFIVariableDriverConfig, data: sbVar},
+		separator,
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\systemd\systemd-bootx64.efi`), digest: authenticode(t, grub)},
+		authority,
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\Linux\debian.efi`), digest: authenticode(t, uki)},
+	}
+	ukiEvents = append(append(append(ukiEvents, sectionEvents(sections, names)...), other),
+		testEvent{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(""), digest: bytes.Repeat([]byte{1}, sha256.Size)})
+	// shim loading GRUB, loading the kernel
+	var grubEvents = []testEvent{
+		{pcr: 7, typ: evEFIVariableDriverConfig, data: sbVar},
+		separator,
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\debian\shimx64.efi`), digest: authenticode(t, shim)},
+		authority,
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\debian\grubx64.efi`), digest: authenticode(t, grub)},
+		{pcr: 9, typ: evIPL, data: []byte("/vmlinuz-6.1\x00")},
+		{pcr: 8, typ: evIPL, data: []byte("kernel_cmdline: /vmlinuz-6.1 quiet\x00"), digest: grubStringDigest("kernel_cmdline: /vmlinuz-6.1 quiet")},
+		{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\vmlinuz-6.1`), digest: bytes.Repeat([]byte{2}, sha256.Size)},
+	}
+
+	ukiLog, ukiPCRs := buildEventLog(t, ukiEvents)
+	grubLog, grubPCRs := buildEventLog(t, grubEvents)
+	var replay = func(events []testEvent, pcr int) []byte {
+		_, pcrs := buildEventLog(t, events)
+		return pcrs[pcr]
+	}
+	var withPhase = func(pcr []byte) []byte {
+		return extend(pcr, phase[:])
+	}
+	var cmdline = "/vmlinuz-6.1 debug"
+
+	var newUKIEvents = append([]testEvent{}, ukiEvents...)
+	newUKIEvents[4].digest = authenticode(t, newUKI)
+	newUKIEvents = append(append(newUKIEvents[:5], sectionEvents(newSections, names)...), newUKIEvents[5 + 2 * len(names):]...)
+	var stubEvents = append([]testEvent{}, grubEvents...)
+	stubEvents[7].digest = authenticode(t, stubKernel)
+	var ukiFromGRUB = append(sectionEvents(newSections, names), grubEvents...)
+	ukiFromGRUB[2 * len(names) + 7].digest = authenticode(t, newUKI)
+	var noSections = append(append([]testEvent{}, ukiEvents[:4]...), testEvent{pcr: 4, typ: evEFIBootServicesApplication, data: imageLoadData(`\EFI\Linux\debian.efi`), digest: authenticode(t, stubKernel)}, other, ukiEvents[len(ukiEvents) - 1])
+	var newGRUB = append([]testEvent{}, grubEvents...)
+	newGRUB[4].digest = authenticode(t, shim)
+	var newCmdline = append([]testEvent{}, grubEvents...)
+	newCmdline[6].digest = grubStringDigest(cmdline)
+	var newFile = append([]testEvent{}, grubEvents...)
+	newFile[5].digest = sha256Of("vmlinuz 6.5")
+
+	var cases = []struct {
+		log      []byte
+		p        Prediction
+		expected map[int][]byte
+		name     string
+	}{
+		{ukiLog, Prediction{}, ukiPCRs, "Current UKI boot"},
+		{grubLog, Prediction{}, grubPCRs, "Current GRUB boot"},
+		{ukiLog, Prediction{Kernel: newUKI, Phases: []string{"enter-initrd"}}, map[int][]byte{4: replay(newUKIEvents, 4), 11: withPhase(replay(newUKIEvents, 11))}, "New UKI"},
+		{ukiLog, Prediction{Kernel: stubKernel}, map[int][]byte{4: replay(noSections, 4), 11: replay(noSections, 11)}, "UKI replaced by an EFI stub kernel"},
+		{grubLog, Prediction{Kernel: stubKernel}, map[int][]byte{4: replay(stubEvents, 4), 11: make([]byte, sha256.Size)}, "New EFI stub kernel"},
+		{grubLog, Prediction{Kernel: newUKI}, map[int][]byte{4: replay(ukiFromGRUB, 4), 11: replay(ukiFromGRUB, 11)}, "GRUB kernel replaced by an UKI"},
+		{grubLog, Prediction{Images: map[string][]byte{`\efi\DEBIAN\grubx64.efi`: shim}}, map[int][]byte{4: replay(newGRUB, 4)}, "New boot loader"},
+		{grubLog, Prediction{Cmdline: &cmdline}, map[int][]byte{7: grubPCRs[7], 8: replay(newCmdline, 8)}, "New command line"},
+		{grubLog, Prediction{Files: map[string][]byte{"/vmlinuz-6.1": []byte("vmlinuz 6.5")}}, map[int][]byte{4: grubPCRs[4], 9: replay(newFile, 9)}, "New kernel loaded by GRUB"},
+		{grubLog, Prediction{Files: map[string][]byte{"/boot/grub/grub.cfg": []byte("menuentry")}}, map[int][]byte{7: grubPCRs[7]}, "New GRUB configuration"},
+	}
+
+	for _, c := range cases {
+		predicted, err := PredictPCRs(c.log, &c.p)
+		if err != nil {
+			t.Errorf("[%s]: %v", c.name, err)
+			continue
+		}
+		for pcr, value := range c.expected {
+			if !bytes.Equal(predicted[pcr], value) {
+				t.Errorf("[%s]: PCR %d: expected %x, got %x", c.name, pcr, value, predicted[pcr])
+			}
+		}
+		if _, ok := predicted[7]; ok == c.p.changesAuthorities() {
+			t.Errorf("[%s]: PCR 7 must only be predicted if the authorities can't change", c.name)
+		}
+	}
+
+	if _, err := PredictPCRs(grubLog, &Prediction{Kernel: []byte("not a PE")}); err == nil {
+		t.Errorf("An invalid kernel must be rejected")
+	}
+}
+
+func sha256Of(s string) []byte {
+	digest := sha256.Sum256([]byte(s))
+	return digest[:]
+}
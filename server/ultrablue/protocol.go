@@ -0,0 +1,378 @@
+// SPDX-FileCopyrightText: 2022 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const PCR_EXTENSION_INDEX = 9
+
+// ------------- PROTOCOL FUNCTIONS ---------------- //
+
+/*
+	Note on error handling: In the following functions, the channel
+	is closed on some errors, but not on others.
+	We must close the channel on error only if it is
+	not already closed, that is, on errors that comes from
+	the application layer.
+	When the error comes from the transport layer (the
+	sendMsg/recvMsg functions), the channel has already been
+	closed, and the program will panic if we try to close it
+	again.
+*/
+
+// EKData contains a TPM's endorsement public key
+// with an optional certificate.
+// It is used to deconstruct complex crypto.Certificate go type
+// in order to encode and send it.
+type EKData struct {
+	Type string // EK_TYPE_RSA or EK_TYPE_ECC
+	Cert []byte // x509 key certificate (empty if none)
+	Pub  []byte // RSA modulus, or uncompressed ECC point
+	Exp  int    // RSA public key exponent
+}
+
+// EnrollData contains the endorsement key the attester will
+// activate credentials with, flattened for older verifiers, followed
+// by all the usable EKs of the TPM, in order of preference.
+// It also contains a boolean @PCRExtend that indicates the new verifier
+// it must generate a new secret to send back on attestation success.
+type EnrollData struct {
+	EKType    string   // EK_TYPE_RSA or EK_TYPE_ECC (RSA if empty)
+	EKCert    []byte   // x509 key certificate (empty if none)
+	EKPub     []byte   // RSA modulus, or uncompressed ECC point
+	EKExp     int      // RSA public key exponent
+	EKs       []EKData // All the EKs, the one above first
+	PCRExtend bool     // Whether or not PCR_EXTENSION_INDEX must be extended on attestation success
+}
+
+// As encoding raw byte arrays to CBOR is not handled very well by
+// most libraries out there, we encapsulate those in a one-field
+// structure.
+type Bytestring struct {
+	Bytes []byte
+}
+
+func (a *attester) establishEncryptedSession(ch chan []byte, disconnected <-chan struct{}) (*Session, error) {
+	var data Bytestring
+	var key []byte
+	var session = NewSession(ch, disconnected)
+	var err error
+
+	session.onProgress = a.watchdog.progress
+	logrus.Info("Getting client UUID")
+	if err = recvMsg(&data, session); err != nil {
+		return nil, err
+	}
+	if session.uuid, err = uuid.FromBytes(data.Bytes); err != nil {
+		close(ch)
+		return nil, err
+	}
+	a.setStatus("Verifier " + session.uuid.String() + " connected")
+	if a.cfg.Verifier != "" && a.cfg.Verifier != session.uuid.String() {
+		close(ch)
+		return nil, errors.New("The verifier is not allowed to attest: " + session.uuid.String())
+	}
+	if a.limiter != nil {
+		if err = a.limiter.allow(session.uuid.String(), time.Now()); err != nil {
+			close(ch)
+			return nil, err
+		}
+	}
+
+	if a.cfg.Enroll {
+		if a.enrollkey == nil {
+			close(ch)
+			return nil, errors.New("The enrollment key has already been used")
+		}
+		key = a.enrollkey
+		a.enrollkey = nil
+		logrus.Info("Saving UUID & encryption key")
+		err = a.storeKey(session.uuid.String(), key)
+	} else {
+		logrus.Info("Fetching encryption key")
+		key, err = a.loadKey(session.uuid.String())
+	}
+	if err != nil {
+		close(ch)
+		return nil, err
+	}
+	if err := session.StartEncryption(key); err != nil {
+		close(ch)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (a *attester) enrollment(session *Session, tpm *attest.TPM) error {
+	logrus.Info("Retrieving EK pub and EK cert")
+	eks, err := endorsementKeys(tpm)
+	if err != nil {
+		close(session.ch)
+		return err
+	}
+
+	var ek = eks[0]
+	logrus.Info("Using the ", ek.Type, " EK (certified: ", ek.Certificate != nil, ")")
+	if err = a.storeEKType(session.uuid.String(), ek.Type); err != nil {
+		close(session.ch)
+		return err
+	}
+	logrus.Info("Sending enrollment data")
+	err = sendMsg(newEnrollData(eks, a.cfg.PCRExtend), session)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func authentication(session *Session) error {
+	logrus.Info("Starting authentication process")
+	logrus.Info("Generating nonce")
+	rbytes := make([]byte, 16)
+	_, err := rand.Read(rbytes)
+	if err != nil {
+		close(session.ch)
+		return err
+	}
+	nonce := Bytestring{rbytes}
+	logrus.Info("Sending nonce")
+	err = sendMsg(nonce, session)
+	if err != nil {
+		return err
+	}
+	logrus.Info("Getting nonce back")
+	var rcvd_nonce Bytestring
+	err = recvMsg(&rcvd_nonce, session)
+	if err != nil {
+		return err
+	}
+	logrus.Info("Verifying nonce")
+	if bytes.Equal(nonce.Bytes, rcvd_nonce.Bytes) == false {
+		close(session.ch)
+		return errors.New("Authentication failure: nonces differ")
+	}
+	logrus.Info("The client is now authenticated")
+	return nil
+}
+
+func (a *attester) credentialActivation(session *Session, tpm *attest.TPM) (*attest.AK, error) {
+	ekType, err := a.loadEKType(session.uuid.String())
+	if err != nil {
+		close(session.ch)
+		return nil, err
+	}
+	a.watchdog.progress()
+	ak, fresh, err := a.loadAK(session.uuid.String(), tpm)
+	a.watchdog.progress()
+	if err != nil {
+		close(session.ch)
+		return nil, err
+	}
+	err = sendMsg(ak.AttestationParameters(), session)
+	if err != nil {
+		ak.Close(tpm)
+		return nil, err
+	}
+	logrus.Info("Getting credential blob")
+	var ec attest.EncryptedCredential
+	err = recvMsg(&ec, session)
+	if err != nil {
+		ak.Close(tpm)
+		return nil, err
+	}
+	// The verifier sends an empty credential when it has
+	// already activated the credential of this AK.
+	if len(ec.Credential) == 0 && len(ec.Secret) == 0 {
+		if fresh {
+			ak.Close(tpm)
+			close(session.ch)
+			return nil, errors.New("The verifier skipped the activation of a new AK")
+		}
+		logrus.Info("The AK is already certified by the verifier")
+		return ak, nil
+	}
+	logrus.Info("Decrypting credential blob")
+	a.watchdog.progress()
+	decrypted, err := activateCredential(tpm, ak, ekType, ec)
+	a.watchdog.progress()
+	if err != nil {
+		ak.Close(tpm)
+		close(session.ch)
+		return nil, err
+	}
+	logrus.Info("Sending back decrypted credential blob")
+	err = sendMsg(Bytestring{decrypted}, session)
+	if err != nil {
+		ak.Close(tpm)
+		return nil, err
+	}
+	if fresh {
+		logrus.Info("Storing AK")
+		blob, err := ak.Marshal()
+		if err == nil {
+			err = a.storeAK(session.uuid.String(), blob)
+		}
+		if err != nil {
+			logrus.Warn("Failed to store the AK, it will be generated again: ", err)
+		}
+	}
+	return ak, nil
+}
+
+func (a *attester) attestation(session *Session, tpm *attest.TPM, ak *attest.AK) ([]byte, error) {
+	logrus.Info("Getting anti replay nonce and PCR selection")
+	var req QuoteRequest
+	err := recvMsg(&req, session)
+	if err != nil {
+		return nil, err
+	}
+	a.setStatus("Attesting: quoting the PCRs")
+	ap, err := attestPlatform(tpm, ak, &req)
+	a.watchdog.progress()
+	if err != nil {
+		close(session.ch)
+		return nil, err
+	}
+	var data = PlatformData{PlatformParameters: *ap}
+	if req.IMA && !a.cfg.IMALog {
+		logrus.Warn("The verifier asked for the IMA log, which isn't sent without -ima-log")
+	} else if req.IMA {
+		logrus.Info("Reading the IMA log")
+		if data.IMALog, err = os.ReadFile(IMA_LOG_PATH); err != nil {
+			close(session.ch)
+			return nil, err
+		}
+	}
+	err = sendMsg(data, session)
+	if err != nil {
+		return nil, err
+	}
+	return req.Bytes, nil
+}
+
+/*
+	response gets the verifier response to the attestation
+	with @nonce, and sends it the next state signed with @ak
+	if it asks for it.
+*/
+func (a *attester) response(session *Session, ak *attest.AK, nonce []byte) (*Result, error) {
+	logrus.Info("Getting attestation response")
+	var response struct  {
+		Err        bool
+		Secret     []byte
+		NextState  bool // The verifier asks for the PCR values of the next boot
+	}
+	err := recvMsg(&response, session)
+	if err != nil {
+		return nil, err
+	}
+	if response.Err {
+		close(session.ch)
+		return nil, errors.New("Attestation failure")
+	}
+	if a.cfg.Enroll {
+		logrus.Info("Enrollment success")
+	} else {
+		logrus.Info("Attestation success")
+	}
+	if response.NextState {
+		state, err := a.nextState()
+		if err == nil && len(state.PCRs) > 0 {
+			err = state.sign(ak, nonce)
+		}
+		if err != nil {
+			logrus.Warn("Failed to read the PCR values predicted for the next boot: ", err)
+			state = NextState{}
+		}
+		logrus.Info("Sending the PCR values predicted for the next boot")
+		if err = sendMsg(state, session); err != nil {
+			return nil, err
+		}
+	}
+	if len(response.Secret) > 0 && a.cfg.Daemon {
+		logrus.Info("Not extending PCR ", PCR_EXTENSION_INDEX, " in daemon mode")
+	} else if len(response.Secret) > 0 && a.cfg.NoPCRExtend {
+		logrus.Info("Not extending PCR ", PCR_EXTENSION_INDEX, ", as configured")
+	} else if len(response.Secret) > 0 {
+		a.setStatus(fmt.Sprint("Extending PCR ", PCR_EXTENSION_INDEX))
+		err = TPM2_PCRExtend(PCR_EXTENSION_INDEX, response.Secret)
+		a.watchdog.progress()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Result{session.uuid, session.key, response.Secret}, nil
+}
+
+/*
+	ultrablueProtocol is the function that drives
+	the server-client interaction, and implements the
+	attestation protocol. It runs in a go routine, and
+	closely cooperates with the ultrablueChr go-routine
+	through the @ch channel, until the client disconnects
+	and @disconnected is closed. (As pointed out at the
+	top of attester.go, the BLE client has the control over
+	the communication.)
+	Once the verifier has sent its response, the outcome
+	is reported to Run through the attester done channel.
+
+	About error handling: When the error comes from the
+	sendMsg/recvMsg methods, we can just return, and assume the
+	connection has already been closed. When the
+	error comes from the protocol, we need to first
+	close the channel, to notify the characteristic that
+	it needs to close the connection on the next client interaction.
+*/
+func (a *attester) ultrablueProtocol(ch chan []byte, disconnected <-chan struct{}) {
+	var session *Session
+
+	defer a.watchdog.start()()
+	tpm, err := attest.OpenTPM(nil)
+	if err != nil {
+		close(ch)
+		a.done <- outcome{nil, err}
+		return
+	}
+	defer tpm.Close()
+
+	if session, err = a.establishEncryptedSession(ch, disconnected); err != nil {
+		logrus.Error(err); return
+	}
+	err = authentication(session)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if a.cfg.Enroll {
+		err = a.enrollment(session, tpm)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+	}
+	ak, err := a.credentialActivation(session, tpm)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer ak.Close(tpm)
+	nonce, err := a.attestation(session, tpm, ak)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	result, err := a.response(session, ak, nonce)
+	a.done <- outcome{result, err}
+}
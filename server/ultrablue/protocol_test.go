@@ -1,7 +1,7 @@
 // SPDX-FileCopyrightText: 2022 ANSSI
 // SPDX-License-Identifier: Apache-2.0
 
-package main
+package ultrablue
 
 import (
 	"reflect"
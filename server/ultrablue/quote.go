@@ -0,0 +1,200 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file quote the PCRs selected by the
+	verifier, in the bank it asked for.
+
+	go-attestation always quotes the 24 PCRs of both the SHA1 and
+	SHA256 banks, which fails on TPMs with the SHA1 bank disabled.
+	It's still used when the verifier doesn't select PCRs, as older
+	verifiers expect its quotes.
+
+	Whatever the bank, the TPM digests the quoted PCR values with
+	the hash of the AK signing scheme, SHA256. The verifier can't
+	replay the event log against SHA384 banks, but still checks
+	their quotes.
+
+	The verifier can also ask for the IMA runtime measurement log,
+	to attest the state of the system after boot. It's read after
+	the quote, so that it holds at least the quoted measurements.
+*/
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+const (
+	PCR_COUNT    = 24
+	IMA_LOG_PATH = "/sys/kernel/security/ima/binary_runtime_measurements"
+)
+
+/*
+	QuoteRequest is the message the verifier starts the
+	attestation with. Older verifiers only send the nonce.
+*/
+type QuoteRequest struct {
+	Bytes []byte // Anti replay nonce
+	Bank  string // "SHA1", "SHA256" or "SHA384", SHA256 if empty
+	PCRs  []int  // PCRs to quote in Bank, all of them if empty
+	IMA   bool   // Also send the IMA log, PCR 10 must then be quoted
+}
+
+/*
+	PlatformData is the attestation data sent to the verifier. The
+	fields of the platform parameters are encoded inline, so that
+	older verifiers can decode them as attest.PlatformParameters.
+*/
+type PlatformData struct {
+	attest.PlatformParameters
+	IMALog []byte `cbor:",omitempty"` // IMA runtime measurement log, if asked for
+}
+
+var pcrBanks = map[string]struct {
+	alg  tpm2.Algorithm
+	hash crypto.Hash
+}{
+	"SHA1":   {tpm2.AlgSHA1, crypto.SHA1},
+	"SHA256": {tpm2.AlgSHA256, crypto.SHA256},
+	"SHA384": {tpm2.AlgSHA384, crypto.SHA384},
+}
+
+/*
+	selection returns the PCR selection of @req, sorted as
+	the TPM will digest them, after checking it.
+*/
+func (req *QuoteRequest) selection() (tpm2.PCRSelection, crypto.Hash, error) {
+	var name = req.Bank
+	if name == "" {
+		name = "SHA256"
+	}
+	bank, ok := pcrBanks[name]
+	if !ok {
+		return tpm2.PCRSelection{}, 0, errors.New("Unsupported PCR bank: " + req.Bank)
+	}
+	var sel = tpm2.PCRSelection{Hash: bank.alg}
+	var seen = make(map[int]bool)
+	for _, pcr := range req.PCRs {
+		if pcr < 0 || pcr >= PCR_COUNT {
+			return tpm2.PCRSelection{}, 0, fmt.Errorf("Invalid PCR index: %d", pcr)
+		}
+		if !seen[pcr] {
+			sel.PCRs = append(sel.PCRs, pcr)
+			seen[pcr] = true
+		}
+	}
+	if len(sel.PCRs) == 0 {
+		for pcr := 0; pcr < PCR_COUNT; pcr++ {
+			sel.PCRs = append(sel.PCRs, pcr)
+		}
+	}
+	sort.Ints(sel.PCRs)
+	return sel, bank.hash, nil
+}
+
+/*
+	quotePCRs quotes the PCRs selected in @req with @ak,
+	and returns them along with the quote.
+*/
+func quotePCRs(ak *attest.AK, req *QuoteRequest) (*attest.Quote, []attest.PCR, error) {
+	sel, hash, err := req.selection()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rwc.Close()
+
+	akHandle, err := loadAKHandle(rwc, ak)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tpm2.FlushContext(rwc, akHandle)
+
+	values, err := readPCRBank(rwc, sel.Hash, sel.PCRs)
+	if err != nil {
+		return nil, nil, err
+	}
+	quoted, sig, err := tpm2.Quote(rwc, akHandle, "", "", req.Bytes, sel, tpm2.AlgNull)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sig.RSA == nil {
+		return nil, nil, errors.New("The quote isn't signed with RSA")
+	}
+	rawSig, err := tpmutil.Pack(sig.Alg, sig.RSA.HashAlg, sig.RSA.Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sigHash, err := sig.RSA.HashAlg.Hash()
+	if err != nil {
+		return nil, nil, err
+	}
+	pcrs, err := quotedPCRs(quoted, sigHash, sel, hash, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &attest.Quote{Version: attest.TPMVersion20, Quote: quoted, Signature: rawSig}, pcrs, nil
+}
+
+/*
+	quotedPCRs returns the PCRs of @sel, whose @values were read
+	in the bank of @hash before the quote, after checking that
+	they were not extended before being @quoted: the TPM digests
+	them with @sigHash, the hash of the AK signing scheme.
+*/
+func quotedPCRs(quoted []byte, sigHash crypto.Hash, sel tpm2.PCRSelection, hash crypto.Hash, values map[int][]byte) ([]attest.PCR, error) {
+	att, err := tpm2.DecodeAttestationData(quoted)
+	if err != nil {
+		return nil, err
+	}
+	var pcrs []attest.PCR
+	var digest = sigHash.New()
+	for _, pcr := range sel.PCRs {
+		pcrs = append(pcrs, attest.PCR{Index: pcr, Digest: values[pcr], DigestAlg: hash})
+		digest.Write(values[pcr])
+	}
+	if att.AttestedQuoteInfo == nil || !bytes.Equal(att.AttestedQuoteInfo.PCRDigest, digest.Sum(nil)) {
+		return nil, errors.New("The PCRs changed while being quoted")
+	}
+	return pcrs, nil
+}
+
+/*
+	attestPlatform returns the attestation data the verifier asked
+	for in @req, or the go-attestation one if it only sent a nonce.
+*/
+func attestPlatform(tpm *attest.TPM, ak *attest.AK, req *QuoteRequest) (*attest.PlatformParameters, error) {
+	if req.Bank == "" && len(req.PCRs) == 0 {
+		return tpm.AttestPlatform(ak, req.Bytes, nil)
+	}
+	el, err := tpm.MeasurementLog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event log: %v", err)
+	}
+	quote, pcrs, err := quotePCRs(ak, req)
+	if err != nil {
+		return nil, err
+	}
+	return &attest.PlatformParameters{
+		TPMVersion: attest.TPMVersion20,
+		Public:     ak.AttestationParameters().Public,
+		Quotes:     []attest.Quote{*quote},
+		PCRs:       pcrs,
+		EventLog:   el,
+	}, nil
+}
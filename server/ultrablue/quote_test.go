@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+func TestQuoteSelection(t *testing.T) {
+	req := QuoteRequest{PCRs: []int{7, 0, 4, 7}}
+	sel, hash, err := req.selection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.Hash != tpm2.AlgSHA256 || hash != crypto.SHA256 || !reflect.DeepEqual(sel.PCRs, []int{0, 4, 7}) {
+		t.Errorf("Unexpected selection: %+v, %v", sel, hash)
+	}
+
+	req = QuoteRequest{Bank: "SHA1"}
+	sel, hash, err = req.selection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.Hash != tpm2.AlgSHA1 || hash != crypto.SHA1 || len(sel.PCRs) != PCR_COUNT {
+		t.Errorf("Unexpected selection: %+v, %v", sel, hash)
+	}
+
+	req = QuoteRequest{Bank: "SHA384", PCRs: []int{7}}
+	sel, hash, err = req.selection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel.Hash != tpm2.AlgSHA384 || hash != crypto.SHA384 || !reflect.DeepEqual(sel.PCRs, []int{7}) {
+		t.Errorf("Unexpected selection: %+v, %v", sel, hash)
+	}
+
+	for _, req := range []QuoteRequest{{Bank: "MD5"}, {PCRs: []int{24}}, {PCRs: []int{-1}}} {
+		if _, _, err := req.selection(); err == nil {
+			t.Errorf("Selection %+v should be rejected", req)
+		}
+	}
+}
+
+func TestQuotedSHA1PCRs(t *testing.T) {
+	var sel = tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: []int{0, 7}}
+	var values = map[int][]byte{
+		0: bytes.Repeat([]byte{0}, sha1.Size),
+		7: bytes.Repeat([]byte{7}, sha1.Size),
+	}
+
+	quote := func(digest []byte) []byte {
+		quoted, err := tpm2.AttestationData{
+			Magic:             0xff544347,
+			Type:              tpm2.TagAttestQuote,
+			QualifiedSigner:   tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: make([]byte, sha256.Size)}},
+			AttestedQuoteInfo: &tpm2.QuoteInfo{PCRSelection: sel, PCRDigest: digest},
+		}.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return quoted
+	}
+
+	// The TPM digests the SHA1 values with the SHA256 signing scheme hash
+	digest := sha256.Sum256(append(append([]byte{}, values[0]...), values[7]...))
+	pcrs, err := quotedPCRs(quote(digest[:]), crypto.SHA256, sel, crypto.SHA1, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcrs) != 2 || pcrs[1].Index != 7 || pcrs[1].DigestAlg != crypto.SHA1 || !bytes.Equal(pcrs[1].Digest, values[7]) {
+		t.Errorf("Unexpected quoted PCRs: %+v", pcrs)
+	}
+
+	bankDigest := sha1.Sum(append(append([]byte{}, values[0]...), values[7]...))
+	if _, err = quotedPCRs(quote(bankDigest[:]), crypto.SHA256, sel, crypto.SHA1, values); err == nil {
+		t.Error("A digest computed with the bank hash must not match")
+	}
+}
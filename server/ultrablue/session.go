@@ -1,11 +1,12 @@
 // SPDX-FileCopyrightText: 2023 ANSSI
 // SPDX-License-Identifier: Apache-2.0
 
-package main
+package ultrablue
 
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"errors"
 
 	"github.com/fxamacker/cbor/v2"
@@ -22,16 +23,24 @@ import (
 type Session struct {
 	ch chan []byte
 	aesgcm cipher.AEAD
+	key []byte
 	encrypted bool
 	uuid uuid.UUID
+	disconnected <-chan struct{} // Closed once the client disconnects
+	onProgress func() // Called once a message has been exchanged, if set
 }
 
+// Returned by sendMsg/recvMsg once the client disconnected
+var errDisconnected = errors.New("The verifier disconnected")
+
 /*
-	Creates and returns a new Session for the given channel
+	Creates and returns a new Session for the given channel,
+	of a connection that closes @disconnected when it ends
 */
-func NewSession(ch chan []byte) *Session {
+func NewSession(ch chan []byte, disconnected <-chan struct{}) *Session {
 	return &Session {
 		ch: ch,
+		disconnected: disconnected,
 	}
 }
 
@@ -53,10 +62,21 @@ func (s *Session) StartEncryption(key []byte) error {
 	if s.aesgcm, err = cipher.NewGCM(block); err != nil {
 		return err
 	}
+	s.key = key
 	s.encrypted = true
 	return nil
 }
 
+/*
+	progressed reports that a message has been
+	exchanged to the onProgress callback, if any.
+*/
+func (s *Session) progressed() {
+	if s.onProgress != nil {
+		s.onProgress()
+	}
+}
+
 /*
 	sendMsg takes the data to send, which is a generic,
 	and sends it to the message channel (through the session)
@@ -66,7 +86,8 @@ func (s *Session) StartEncryption(key []byte) error {
 	block until the client reads it completely.
 
 	If an error arises, and the channel is still open,
-	sendMsg closes it.
+	sendMsg closes it. It returns errDisconnected if the
+	client disconnects before reading the message.
 */
 func sendMsg[T any](obj T, session *Session) error {
 	logrus.Debug("Encoding to CBOR")
@@ -77,19 +98,28 @@ func sendMsg[T any](obj T, session *Session) error {
 	}
 	if session.encrypted {
 		logrus.Debug("Encrypting (AES/GCM)")
-		iv, err := TPM2_GetRandom(uint16(session.aesgcm.NonceSize()))
-		if err != nil {
+		iv := make([]byte, session.aesgcm.NonceSize())
+		if _, err := rand.Read(iv); err != nil {
 			close(session.ch)
 			return err
 		}
 		data = session.aesgcm.Seal(iv, iv, data, nil) // Append encrypted data to the IV
 	}
 	logrus.Debug("Sending message")
-	session.ch <- data
-	_, ok := <-session.ch
-	if !ok {
-		return errors.New("The channel has been closed")
+	select {
+	case session.ch <- data:
+	case <-session.disconnected:
+		return errDisconnected
+	}
+	select {
+	case _, ok := <-session.ch:
+		if !ok {
+			return errors.New("The channel has been closed")
+		}
+	case <-session.disconnected:
+		return errDisconnected
 	}
+	session.progressed()
 	return nil
 }
 
@@ -102,15 +132,22 @@ func sendMsg[T any](obj T, session *Session) error {
 	will be able to decode it.
 
 	If an error arises, and the channel is still open,
-	recvMsg closes it.
+	recvMsg closes it. It returns errDisconnected if the
+	client disconnects before writing the message.
 */
 func recvMsg[T any](obj *T, session *Session) error {
 	var err error
 
 	logrus.Debug("Receiving message")
-	data, ok := <-session.ch
-	if !ok {
-		return errors.New("The channel has been closed")
+	var data []byte
+	var ok bool
+	select {
+	case data, ok = <-session.ch:
+		if !ok {
+			return errors.New("The channel has been closed")
+		}
+	case <-session.disconnected:
+		return errDisconnected
 	}
 	if session.encrypted {
 		logrus.Debug("Decrypting (AES/GCM)")
@@ -128,5 +165,6 @@ func recvMsg[T any](obj *T, session *Session) error {
 		close(session.ch)
 		return err
 	}
+	session.progressed()
 	return nil
 }
@@ -0,0 +1,26 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"testing"
+)
+
+/*
+	Tests that sendMsg and recvMsg return once the client
+	disconnects, instead of waiting for it forever
+*/
+func TestSessionDisconnected(t *testing.T) {
+	var disconnected = make(chan struct{})
+	var session = NewSession(make(chan []byte), disconnected)
+	var data Bytestring
+
+	close(disconnected)
+	if err := recvMsg(&data, session); err != errDisconnected {
+		t.Errorf("recvMsg: expected errDisconnected, got %v", err)
+	}
+	if err := sendMsg(data, session); err != errDisconnected {
+		t.Errorf("sendMsg: expected errDisconnected, got %v", err)
+	}
+}
@@ -1,7 +1,7 @@
 // SPDX-FileCopyrightText: 2022 ANSSI
 // SPDX-License-Identifier: Apache-2.0
 
-package main
+package ultrablue
 
 import (
 	"context"
@@ -63,6 +63,13 @@ type State struct {
 		function will return.
 	*/
 	ch chan []byte
+
+	/*
+		disconnected is closed once the client disconnects, e.g. when
+		the phone goes out of range, for the ultrablueProtocol function
+		to return instead of waiting on the channel forever.
+	*/
+	disconnected <-chan struct{}
 }
 
 // Key type to get/set the state value for
@@ -72,19 +79,20 @@ type key int
 /*
 	getConnectionState returns the attestation state
 	for the given connection. If there's no
-	value, it sets it with a newly created state, and
-	returns it.
+	value, it sets it with a newly created state, starts
+	the @protocol on its channel, and returns it.
 
 	This is useful to keep a separate state for each
 	connection, and avoid leaks.
 */
-func getConnectionState(conn ble.Conn) *State {
+func getConnectionState(conn ble.Conn, protocol func(ch chan []byte, disconnected <-chan struct{})) *State {
 	var connCtx = conn.Context()
 	var stateKey key
 
 	if connCtx.Value(stateKey) == nil {
 		s := &State{
-			ch: make(chan []byte),
+			ch:           make(chan []byte),
+			disconnected: conn.Disconnected(),
 		}
 		s.reset()
 		ctx := context.WithValue(connCtx, stateKey, s)
@@ -92,7 +100,7 @@ func getConnectionState(conn ble.Conn) *State {
 		connCtx = ctx
 		// Start the attestation protocol that runs in a goroutine
 		// and reads/receives messages through the channel.
-		go ultrablueProtocol(s.ch)
+		go protocol(s.ch, s.disconnected)
 	}
 	return connCtx.Value(stateKey).(*State)
 }
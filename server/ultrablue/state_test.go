@@ -1,7 +1,7 @@
 // SPDX-FileCopyrightText: 2022 ANSSI
 // SPDX-License-Identifier: Apache-2.0
 
-package main
+package ultrablue
 
 import (
 	"context"
@@ -85,7 +85,7 @@ func TestGetConnectionState(t *testing.T) {
 	if conn.Context().Value(stateKey) != nil {
 		t.Errorf("Context has value for stateKey key: %+v", conn.Context())
 	}
-	_ = getConnectionState(&conn)
+	_ = getConnectionState(&conn, func(ch chan []byte, disconnected <-chan struct{}) {})
 	if conn.Context().Value(stateKey) == nil {
 		t.Errorf("Context value for stateKey key is nil: %+v", conn.Context())
 	}
@@ -0,0 +1,225 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file check what the attestation depends
+	on, for the status command. They only read the state of the TPM
+	and of the keys directory: unlike the attester, they never create
+	the SRK, and never unseal the enrollment keys, which would require
+	their PIN and increment the TPM lockout counter on failure.
+
+	Each of them returns a short description of what it checked on
+	success, and an error explaining what is broken otherwise.
+*/
+
+package ultrablue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-attestation/attest"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/uuid"
+)
+
+/*
+	TPMStatus checks that the TPM is reachable, and
+	describes its manufacturer and firmware version.
+*/
+func TPMStatus() (string, error) {
+	tpm, err := attest.OpenTPM(nil)
+	if err != nil {
+		return "", err
+	}
+	defer tpm.Close()
+
+	info, err := tpm.Info()
+	if err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("%s, firmware %d.%d", info.Manufacturer, info.FirmwareVersionMajor, info.FirmwareVersionMinor)
+	if vendor := strings.TrimSpace(strings.Trim(info.VendorInfo, "\x00")); vendor != "" {
+		detail += " (" + vendor + ")"
+	}
+	return detail, nil
+}
+
+/*
+	SRKStatus checks that a storage key is persisted at SRK_HANDLE,
+	without creating it as TPM2_LoadSRK would.
+*/
+func SRKStatus() (string, error) {
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return "", err
+	}
+	defer rwc.Close()
+
+	pub, _, _, err := tpm2.ReadPublic(rwc, SRK_HANDLE)
+	if err != nil {
+		return "", fmt.Errorf("No SRK at 0x%x, it is created on the first enrollment: %v", uint32(SRK_HANDLE), err)
+	}
+	const storage = tpm2.FlagRestricted | tpm2.FlagDecrypt
+	if pub.Attributes & storage != storage {
+		return "", fmt.Errorf("The key at 0x%x isn't a storage key", uint32(SRK_HANDLE))
+	}
+	detail := fmt.Sprintf("storage key at 0x%x", uint32(SRK_HANDLE))
+	if pub.RSAParameters != nil {
+		detail = fmt.Sprintf("RSA %d %s", pub.RSAParameters.KeyBits, detail)
+	}
+	return detail, nil
+}
+
+/*
+	EKStatus checks that the TPM has a usable EK, and describes
+	them in order of preference, with their certificate issuer.
+*/
+func EKStatus() (string, error) {
+	tpm, err := attest.OpenTPM(nil)
+	if err != nil {
+		return "", err
+	}
+	defer tpm.Close()
+
+	eks, err := endorsementKeys(tpm)
+	if err != nil {
+		return "", err
+	}
+	var descriptions []string
+	for _, ek := range eks {
+		if ek.Certificate == nil {
+			descriptions = append(descriptions, ek.Type + " (no certificate)")
+			continue
+		}
+		issuer := ek.Certificate.Issuer.CommonName
+		if issuer == "" {
+			issuer = ek.Certificate.Issuer.String()
+		}
+		descriptions = append(descriptions, ek.Type + " (certified by " + issuer + ")")
+	}
+	return strings.Join(descriptions, ", "), nil
+}
+
+/*
+	KeysDirStatus checks that the keys directory @path can't be
+	modified by other users, that its files are only accessible
+	by their owner, as they are written.
+*/
+func KeysDirStatus(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", errors.New(path + " isn't a directory")
+	}
+	if info.Mode().Perm() & 0022 != 0 {
+		return "", fmt.Errorf("%s is writable by other users (%v)", path, info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+	var exposed []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return "", err
+		}
+		if info.Mode().IsRegular() && info.Mode().Perm() & 0077 != 0 {
+			exposed = append(exposed, fmt.Sprintf("%s (%v)", e.Name(), info.Mode().Perm()))
+		}
+	}
+	if len(exposed) > 0 {
+		return "", errors.New("Files accessible by other users: " + strings.Join(exposed, ", "))
+	}
+	return fmt.Sprintf("%s holds %d files, only accessible by their owner", path, len(entries)), nil
+}
+
+/*
+	EnrolledVerifiers returns the UUIDs of the verifiers
+	whose enrollment key is stored in the keys directory @path.
+*/
+func EnrolledVerifiers(path string) ([]string, error) {
+	var uuids []string
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if _, err := uuid.Parse(e.Name()); err == nil && e.Type().IsRegular() {
+			uuids = append(uuids, e.Name())
+		}
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+/*
+	VerifierStatus checks that the enrollment key of the verifier
+	@id, stored in the keys directory @path, still loads under the
+	SRK, which is still the one recorded at enrollment, and that an
+	authorized PCR policy matches the current PCR values if it is
+	sealed to those. It describes the seal policy.
+*/
+func VerifierStatus(path, id string) (string, error) {
+	var a = attester{cfg: Config{KeysPath: path}}
+
+	policy, err := a.loadPolicy(id)
+	if err != nil {
+		return "", err
+	}
+	priv, err := os.ReadFile(filepath.Join(path, id))
+	if err != nil {
+		return "", err
+	}
+	pub, err := os.ReadFile(filepath.Join(path, id + ".pub"))
+	if err != nil {
+		return "", err
+	}
+
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return "", err
+	}
+	defer rwc.Close()
+	handle, _, err := tpm2.Load(rwc, SRK_HANDLE, "", pub, priv)
+	if err != nil {
+		return "", fmt.Errorf("The sealed enrollment key doesn't load under the SRK: %v", err)
+	}
+	tpm2.FlushContext(rwc, handle)
+
+	var sealing = []string{"the SRK"}
+	if policy.SRKName == nil {
+		sealing[0] = "an unrecorded SRK"
+	} else if _, _, err = srkPublicKey(rwc, policy.SRKName); err != nil {
+		return "", err
+	}
+	if policy.PIN {
+		sealing = append(sealing, "a PIN")
+	}
+	if len(policy.PCRs) > 0 {
+		sealing = append(sealing, fmt.Sprint("PCRs ", policy.PCRs))
+	}
+	if policy.AuthorizeKey != nil {
+		auths, err := LoadAuthorizations(filepath.Join(path, AUTHORIZATIONS_FILE))
+		if err != nil {
+			return "", err
+		}
+		auth, err := matchAuthorization(rwc, auths)
+		if err != nil {
+			return "", err
+		}
+		if auth == nil {
+			return "", errors.New("No authorized PCR policy matches the current PCR values")
+		}
+		sealing = append(sealing, fmt.Sprintf("authorized PCR policies (PCRs %v match)", auth.PCRs))
+	}
+	return "sealed to " + strings.Join(sealing, ", "), nil
+}
@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeysDirStatus(t *testing.T) {
+	var dir = t.TempDir()
+	var id = "8a6fa9ec-5b2d-4b7e-9d3a-0f3e4c2b1a90"
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{id, id + ".pub", id + ".policy", AUTHORIZATIONS_FILE} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := KeysDirStatus(dir); err != nil {
+		t.Errorf("Unexpected failure: %v", err)
+	}
+	verifiers, err := EnrolledVerifiers(dir)
+	if err != nil || !reflect.DeepEqual(verifiers, []string{id}) {
+		t.Errorf("Expected the verifier %s, got %v (%v)", id, verifiers, err)
+	}
+
+	if err := os.Chmod(filepath.Join(dir, id), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := KeysDirStatus(dir); err == nil {
+		t.Error("A key readable by other users must be reported")
+	}
+	os.Chmod(filepath.Join(dir, id), 0600)
+
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := KeysDirStatus(dir); err == nil {
+		t.Error("A directory writable by other users must be reported")
+	}
+}
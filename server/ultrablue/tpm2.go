@@ -0,0 +1,417 @@
+// SPDX-FileCopyrightText: 2022 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TCG TPM v2.0 Provisioning Guidance, section 7.8:
+// https://trustedcomputinggroup.org/wp-content/uploads/TCG-TPM-v2.0-Provisioning-Guidance-Published-v1r1.pdf
+const SRK_HANDLE tpmutil.Handle = 0x81000001
+
+// TCG TPM v2.0 Provisioning Guidance, section 7.5.1:
+// https://trustedcomputinggroup.org/wp-content/uploads/TCG-TPM-v2.0-Provisioning-Guidance-Published-v1r1.pdf
+// TCG EK Credential Profile, section 2.1.5.1:
+// https://trustedcomputinggroup.org/wp-content/uploads/Credential_Profile_EK_V2.0_R14_published.pdf
+var SRK_TEMPLATE = tpm2.Public {
+	Type: tpm2.AlgRSA,
+	NameAlg: tpm2.AlgSHA256,
+	Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth | tpm2.FlagRestricted | tpm2.FlagDecrypt | tpm2.FlagNoDA,
+	AuthPolicy: nil,
+	RSAParameters: &tpm2.RSAParams {
+		Symmetric: &tpm2.SymScheme {
+			Alg: tpm2.AlgAES,
+			KeyBits: 128,
+			Mode: tpm2.AlgCFB,
+		},
+		KeyBits: 2048,
+		ModulusRaw: make([]byte, 256),
+	},
+}
+
+/*
+	Returns a handle to the TPM Storage Rook Key (SRK) if it's already present
+	in its non volatile memory.
+	Otherwise, a new SRK is created using the default template, and is persisted
+	in the TPM Non Volatile memory, at its default location. A handle to the newly
+	created key is then returned
+*/
+func TPM2_LoadSRK(rwc io.ReadWriteCloser) (tpmutil.Handle, error) {
+	// TPM2 Library commands, section 30.2:
+	// https://trustedcomputinggroup.org/wp-content/uploads/TCG_TPM2_r1p59_Part3_Commands_pub.pdf
+	// "TPM_CAP_HANDLES – Returns a list of all of the handles within the handle range
+	// of the property parameter. The range of the returned handles is determined
+	// by the handle type (the most-significant octet (MSO) of the property)."
+	const PROPERTY = uint32(tpm2.HandleTypePersistent) << 24
+	const MAX_OBJECTS = 256
+
+	handles, _, err := tpm2.GetCapability(rwc, tpm2.CapabilityHandles, MAX_OBJECTS, PROPERTY)
+	if err != nil {
+		return 0, err
+	}
+	for _, h := range handles {
+		if h.(tpmutil.Handle) == SRK_HANDLE {
+			return SRK_HANDLE, nil
+		}
+	}
+	logrus.Info("SRK not found, creating one. This may take a while.")
+
+	handle, _, err := tpm2.CreatePrimary(rwc, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", SRK_TEMPLATE)
+	if err != nil {
+		return 0, err
+	}
+	if err = tpm2.EvictControl(rwc, "", tpm2.HandleOwner, handle, SRK_HANDLE); err != nil {
+		return 0, err
+	}
+	logrus.Infof("Persistent SRK created at NV index %x\n", SRK_HANDLE)
+	return SRK_HANDLE, nil
+}
+
+/*
+	SealPolicy describes the policy a key is sealed with. It must be
+	the same at seal and unseal time, thus it is stored along with
+	the sealed key.
+*/
+type SealPolicy struct {
+	PIN          bool   // Whether a password policy is used
+	PCRs         []int  // SHA256 PCRs bound to their values at seal time, if any
+	AuthorizeKey []byte // If set, DER public key that signs the allowed PCR policies, instead of PCRs
+	SRKName      []byte // Name of the SRK the key is sealed under, checked before salting sessions with it
+}
+
+/*
+	ParsePCRs parses a comma separated list of PCR indexes, e.g. "0,2,7".
+	PCR_EXTENSION_INDEX is rejected, as its value is expected to change
+	on attestation success.
+*/
+func ParsePCRs(list string) ([]int, error) {
+	var pcrs []int
+
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	for _, field := range strings.Split(list, ",") {
+		pcr, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if pcr < 0 || pcr > 23 {
+			return nil, fmt.Errorf("Invalid PCR index: %d", pcr)
+		}
+		if pcr == PCR_EXTENSION_INDEX {
+			return nil, fmt.Errorf("PCR %d is extended by ultrablue and can't be part of a policy", pcr)
+		}
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+	return pcrs, nil
+}
+
+/*
+	applySealPolicy runs the policy commands described by @policy on
+	the policy session @sessHandle. The order of the commands matters,
+	as each one extends the session policy digest.
+	@auth is the authorized PCR policy to use if @policy.AuthorizeKey
+	is set, and is ignored otherwise.
+*/
+func applySealPolicy(rwc io.ReadWriter, sessHandle tpmutil.Handle, policy SealPolicy, auth *Authorization) error {
+	if policy.AuthorizeKey != nil {
+		if auth == nil {
+			return errors.New("No authorized PCR policy matches the current PCR values")
+		}
+		key, err := parseAuthorizeKey(policy.AuthorizeKey)
+		if err != nil {
+			return err
+		}
+		if err = applyAuthorizedPolicy(rwc, sessHandle, key, auth); err != nil {
+			return err
+		}
+	} else if len(policy.PCRs) > 0 {
+		sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: policy.PCRs}
+		// An empty digest makes the TPM use the current PCR values.
+		if err := tpm2.PolicyPCR(rwc, sessHandle, nil, sel); err != nil {
+			return err
+		}
+	}
+	if policy.PIN {
+		// TPM2_PolicyAuthValue yields the same digest as TPM2_PolicyPassword,
+		// but the PIN is mixed in the session HMAC key instead of being sent
+		// in the clear.
+		if err := policyAuthValue(rwc, sessHandle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Seals the given data to the TPM Storage Root Key (SRK), and to the
+	provided PIN and the current values of PCRs according to @policy.
+	Returns the resulting private and public blobs
+
+	If @policy.PIN is set, a password policy will be used to seal the key.
+	If @policy.PCRs is not empty, a PCR policy will be used, so that the
+	key can only be unsealed in the same boot state.
+	If @policy.AuthorizeKey is set, an authorized policy will be used
+	instead, so that the key can be unsealed in any boot state whose
+	PCR values are signed by the authorize key.
+	To get it back, the same policy will be needed at unseal time.
+
+	The data and the PIN are encrypted on the bus by a salted session.
+	If @policy.SRKName is not set, the name of the SRK is recorded in
+	it, so that the SRK the sessions are salted with at unseal time
+	can be checked.
+*/
+func TPM2_Seal(data []byte, pin string, policy *SealPolicy) ([]byte, []byte, error) {
+	var rwc io.ReadWriteCloser
+	var digest, srkName []byte
+	var sess *tpmSession
+	var err error
+
+	if rwc, err = tpm2.OpenTPM(); err != nil {
+		return nil, nil, err
+	}
+	defer rwc.Close()
+
+	if _, err = TPM2_LoadSRK(rwc); err != nil {
+		return nil, nil, err
+	}
+	if _, srkName, err = srkPublicKey(rwc, policy.SRKName); err != nil {
+		return nil, nil, err
+	}
+	policy.SRKName = srkName
+
+	// An authorized policy can't be run before a PCR policy is signed,
+	// thus its digest is computed rather than read from a session.
+	if policy.AuthorizeKey != nil {
+		if digest, err = authorizedPolicyDigest(*policy); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// The trial session is only used to compute the digest.
+		if sess, err = startSaltedSession(rwc, tpm2.SessionTrial, srkName); err != nil {
+			return nil, nil, err
+		}
+		defer tpm2.FlushContext(rwc, sess.handle)
+
+		// Note that we check for @policy.PIN rather than for an empty PIN,
+		// because we don't want to transparently disable the PIN
+		// policy for the session if the user inputs an empty string while providing
+		// the --with-pin option.
+		if err = applySealPolicy(rwc, sess.handle, *policy, nil); err != nil {
+			return nil, nil, err
+		}
+
+		if digest, err = tpm2.PolicyGetDigest(rwc, sess.handle); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The data and the PIN are encrypted on the bus by the
+	// HMAC session authorizing the use of the SRK.
+	if sess, err = startSaltedSession(rwc, tpm2.SessionHMAC, srkName); err != nil {
+		return nil, nil, err
+	}
+	defer tpm2.FlushContext(rwc, sess.handle)
+	return sealWithSession(rwc, sess, srkName, []byte(pin), digest, data)
+}
+
+/*
+	Unseals the given object with the TPM Storage Root Key (SRK)
+	and returns the original data, assuming the policy is correct:
+
+	If @policy.PIN is set, a password policy is used for the session.
+	This means that an incorrect PIN will increment
+	the TPM DA counter, and may lock the TPM. This is wanted and prevents
+	brute-force attacks.
+	If the key was sealed with a password policy, and @policy.PIN is not set
+	at attestation time: The password policy will not be
+	used and TPM2_Unseal will return a policy error, without trying any password.
+	In consequence, the TPM DA counter will NOT be incremented, which is also
+	wanted because it is likely to be a usage error.
+
+	If @policy.PCRs is not empty, the PCR policy will only be satisfied if the
+	PCRs have the same values than at seal time, e.g. if the Secure Boot state
+	didn't change.
+	If @policy.AuthorizeKey is set, the first of @auths matching the current
+	PCR values is used to satisfy the authorized policy.
+
+	The policy session is salted, so that the unsealed data is encrypted
+	on the bus, and the PIN is never sent in the clear. It is salted with
+	the SRK named @policy.SRKName, unless the key was sealed by a version
+	that didn't record it.
+*/
+func TPM2_Unseal(priv, pub []byte, pin string, policy SealPolicy, auths []Authorization) ([]byte, error) {
+	var rwc io.ReadWriteCloser
+	var keyName []byte
+	var srkHandle, keyHandle tpmutil.Handle
+	var sess *tpmSession
+	var err error
+
+	if rwc, err = tpm2.OpenTPM(); err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	if srkHandle, err = TPM2_LoadSRK(rwc); err != nil {
+		return nil, err
+	}
+	if sess, err = startSaltedSession(rwc, tpm2.SessionPolicy, policy.SRKName); err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rwc, sess.handle)
+	if keyHandle, keyName, err = tpm2.Load(rwc, srkHandle, "", pub, priv); err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rwc, keyHandle)
+
+	var auth *Authorization
+	if policy.AuthorizeKey != nil {
+		if auth, err = matchAuthorization(rwc, auths); err != nil {
+			return nil, err
+		}
+	}
+	if err = applySealPolicy(rwc, sess.handle, policy, auth); err != nil {
+		return nil, err
+	}
+	// The key is encrypted on the bus by the policy session.
+	return unsealWithSession(rwc, sess, keyHandle, keyName, []byte(pin))
+}
+
+/*
+	tpmError is the error of a @command sent without the
+	help of go-tpm, that failed with the response code @rc.
+*/
+type tpmError struct {
+	command string
+	rc      tpmutil.ResponseCode
+}
+
+func (e *tpmError) Error() string {
+	return fmt.Sprintf("%s failed with response code 0x%x", e.command, uint32(e.rc))
+}
+
+func responseError(command string, rc tpmutil.ResponseCode) error {
+	return &tpmError{command, rc}
+}
+
+/*
+	TPM2_VerifySignature checks the ASN.1 ECDSA @signature of @digest
+	with the loaded key @keyHandle, and returns the verification ticket.
+	It is not implemented by go-tpm.
+*/
+func TPM2_VerifySignature(rw io.ReadWriter, keyHandle tpmutil.Handle, digest, signature []byte) (*tpm2.Ticket, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	var ticket tpm2.Ticket
+
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		return nil, err
+	}
+	encoded, err := tpm2.Signature{
+		Alg: tpm2.AlgECDSA,
+		ECC: &tpm2.SignatureECC{HashAlg: tpm2.AlgSHA256, R: sig.R, S: sig.S},
+	}.Encode()
+	if err != nil {
+		return nil, err
+	}
+	resp, rc, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, cmdVerifySignature, keyHandle, tpmutil.U16Bytes(digest), tpmutil.RawBytes(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if rc != tpmutil.RCSuccess {
+		return nil, responseError("TPM2_VerifySignature", rc)
+	}
+	if _, err = tpmutil.Unpack(resp, &ticket.Type, &ticket.Hierarchy, &ticket.Digest); err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
+
+/*
+	TPM2_PolicyAuthorize approves the current digest of the policy
+	session @sessHandle if it equals @approved, and @ticket proves
+	that the key named @keyName signed it along with @policyRef.
+	It is not implemented by go-tpm.
+*/
+func TPM2_PolicyAuthorize(rw io.ReadWriter, sessHandle tpmutil.Handle, approved, policyRef, keyName []byte, ticket *tpm2.Ticket) error {
+	_, rc, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, cmdPolicyAuthorize, sessHandle,
+		tpmutil.U16Bytes(approved), tpmutil.U16Bytes(policyRef), tpmutil.U16Bytes(keyName),
+		ticket.Type, ticket.Hierarchy, ticket.Digest)
+	if err != nil {
+		return err
+	}
+	if rc != tpmutil.RCSuccess {
+		return responseError("TPM2_PolicyAuthorize", rc)
+	}
+	return nil
+}
+
+/*
+   Returns @size bytes of random data from the TPM.
+   They are encrypted on the bus by a salted session, which
+   takes an RSA decryption and may create the SRK: it's only
+   meant for secrets, i.e. the enrollment key. The SRK isn't
+   pinned, as nothing is recorded yet on enrollment. Public
+   random values, e.g. nonces and IVs, come from crypto/rand.
+*/
+func TPM2_GetRandom(size uint16) ([]byte, error) {
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	if _, err = TPM2_LoadSRK(rwc); err != nil {
+		return nil, err
+	}
+	sess, err := startSaltedSession(rwc, tpm2.SessionHMAC, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm2.FlushContext(rwc, sess.handle)
+
+	rbytes, err := getRandomWithSession(rwc, sess, size)
+	if err != nil {
+		return nil, err
+	}
+	if rbytes == nil || len(rbytes) != int(size) || onlyContainsZeros(rbytes) {
+		return nil, errors.New("Failed to generate random bytes")
+	}
+	return rbytes, nil
+}
+
+/*
+	Extends the PCR at the given index with @secret
+	TODO: The following extends the PCR, but does not adds
+	any event log entry. This is sufficient for our needs,
+	but it means that after an ultrablue attestation, the
+	eventlog will differ from the pcrs, thus making any
+	replay fail.
+	NOTE: It seems that it's not possible to add an event log
+	entry directly from the tss stack, and that we need to use
+	exposed UEFI function pointers.
+*/
+func TPM2_PCRExtend(index int, secret []byte) error {
+	rwc, err := tpm2.OpenTPM()
+	if err != nil {
+		return err
+	}
+	defer rwc.Close()
+
+	return tpm2.PCREvent(rwc, tpmutil.Handle(index), secret)
+}
@@ -0,0 +1,402 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+	The functions in this file implement salted TPM sessions with
+	parameter encryption, which go-tpm doesn't support.
+
+	Without them, the enrollment key is sent in the clear on the bus
+	between the CPU and the TPM (LPC, SPI or I2C), where an attacker with
+	physical access can sniff it: when sealed (TPM2_Create), when
+	generated (TPM2_GetRandom), and when unsealed (TPM2_Unseal).
+
+	A salted session derives a session key from a random salt encrypted
+	with the public key of the SRK, thus only known by the caller and the
+	TPM. The SRK is pinned by its name, recorded along with the sealed key,
+	so that a device impersonating the TPM can't get the salt. The session key is used to:
+	- encrypt the first parameter of the command and/or of the response
+	  (AES-128-CFB), e.g. the sealed data or the unsealed key;
+	- authenticate commands and responses with an HMAC, so that a tampered
+	  response is detected.
+	A PIN is never sent on the bus either: it is mixed in the HMAC key,
+	thus policies use TPM2_PolicyAuthValue rather than TPM2_PolicyPassword.
+
+	See TPM2 Library, Part 1: Architecture, sections 19 and 21:
+	https://trustedcomputinggroup.org/wp-content/uploads/TCG_TPM2_r1p59_Part1_Architecture_pub.pdf
+*/
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Size of the salt and of the caller nonces, the digest
+// size of the session hash algorithm.
+const SESSION_NONCE_SIZE = sha256.Size
+
+/*
+	A tpmSession is a salted session, started with the SRK
+	as tpmKey and with AES-128-CFB parameter encryption.
+*/
+type tpmSession struct {
+	handle   tpmutil.Handle
+	key      []byte // Session key, derived from the salt
+	nonceTPM []byte // Last nonce returned by the TPM
+}
+
+/*
+	randomNonce returns @size random bytes from the host RNG: getting them
+	from the TPM would send them in the clear on the bus.
+*/
+func randomNonce(size int) ([]byte, error) {
+	nonce := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	if onlyContainsZeros(nonce) {
+		return nil, errors.New("Failed to generate a nonce")
+	}
+	return nonce, nil
+}
+
+/*
+	srkPublicKey returns the public key and the name of the SRK.
+	The public area is read without authentication, so that a TPM
+	impersonated on the bus could send its own key to get the salts:
+	its name is thus checked against @pinned, the one recorded when
+	the key was sealed, if set.
+*/
+func srkPublicKey(rw io.ReadWriter, pinned []byte) (*rsa.PublicKey, []byte, error) {
+	var public, name, qualifiedName tpmutil.U16Bytes
+
+	resp, rc, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdReadPublic, SRK_HANDLE)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rc != tpmutil.RCSuccess {
+		return nil, nil, responseError("TPM2_ReadPublic", rc)
+	}
+	if _, err = tpmutil.Unpack(resp, &public, &name, &qualifiedName); err != nil {
+		return nil, nil, err
+	}
+	pub, err := tpm2.DecodePublic(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pub.Type != tpm2.AlgRSA || pub.RSAParameters == nil || pub.NameAlg != tpm2.AlgSHA256 {
+		return nil, nil, errors.New("The SRK is not an RSA key named with SHA256")
+	}
+	// The name is computed rather than trusted, so that it
+	// certifies the public key the salts are encrypted with.
+	digest := sha256.Sum256(public)
+	computed := append([]byte{0x00, 0x0b}, digest[:]...)
+	if !bytes.Equal(computed, name) {
+		return nil, nil, errors.New("The SRK name doesn't match its public area")
+	}
+	if pinned != nil && !bytes.Equal(computed, pinned) {
+		return nil, nil, errors.New("The SRK isn't the one the key was sealed with, the TPM may be impersonated")
+	}
+	var exponent = int(pub.RSAParameters.Exponent())
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(pub.RSAParameters.ModulusRaw), E: exponent}, computed, nil
+}
+
+/*
+	sessionKey returns the key of an unbound session salted
+	with @salt, started with the nonces @nonceTPM and @nonceCaller.
+*/
+func sessionKey(salt, nonceTPM, nonceCaller []byte) ([]byte, error) {
+	return tpm2.KDFa(tpm2.AlgSHA256, salt, "ATH", nonceTPM, nonceCaller, 8 * sha256.Size)
+}
+
+/*
+	startSaltedSession starts a session of type @se, salted with
+	the SRK, which must be loaded, and whose name must be @srkName
+	if set.
+*/
+func startSaltedSession(rw io.ReadWriter, se tpm2.SessionType, srkName []byte) (*tpmSession, error) {
+	srk, _, err := srkPublicKey(rw, srkName)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := randomNonce(SESSION_NONCE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	nonceCaller, err := randomNonce(SESSION_NONCE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	// TPM2 Library, Part 1, annex B.10.2: the salt is encrypted
+	// with RSA-OAEP, using the "SECRET" label.
+	secret, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, srk, salt, []byte("SECRET\x00"))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, rc, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdStartAuthSession,
+		SRK_HANDLE, tpm2.HandleNull, tpmutil.U16Bytes(nonceCaller), tpmutil.U16Bytes(secret),
+		se, tpm2.AlgAES, uint16(128), tpm2.AlgCFB, tpm2.AlgSHA256)
+	if err != nil {
+		return nil, err
+	}
+	if rc != tpmutil.RCSuccess {
+		return nil, responseError("TPM2_StartAuthSession", rc)
+	}
+
+	var s tpmSession
+	var nonceTPM tpmutil.U16Bytes
+	if _, err = tpmutil.Unpack(resp, &s.handle, &nonceTPM); err != nil {
+		return nil, err
+	}
+	s.nonceTPM = nonceTPM
+	// The session is not bound, thus the session key
+	// is only derived from the salt.
+	if s.key, err = sessionKey(salt, s.nonceTPM, nonceCaller); err != nil {
+		tpm2.FlushContext(rw, s.handle)
+		return nil, err
+	}
+	return &s, nil
+}
+
+/*
+	cryptParameter encrypts or decrypts in place the first
+	parameter of @params, which must be a TPM2B, with the AES-128-CFB
+	key derived from @sessionValue and the nonces.
+*/
+func cryptParameter(params, sessionValue, nonceNewer, nonceOlder []byte, decrypt bool) error {
+	if len(params) < 2 {
+		return errors.New("No parameter to encrypt")
+	}
+	size := int(binary.BigEndian.Uint16(params))
+	if len(params) < 2 + size {
+		return errors.New("Truncated parameter")
+	}
+	keyIV, err := tpm2.KDFa(tpm2.AlgSHA256, sessionValue, "CFB", nonceNewer, nonceOlder, 256)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(keyIV[:16])
+	if err != nil {
+		return err
+	}
+	data := params[2:2 + size]
+	if decrypt {
+		cipher.NewCFBDecrypter(block, keyIV[16:]).XORKeyStream(data, data)
+	} else {
+		cipher.NewCFBEncrypter(block, keyIV[16:]).XORKeyStream(data, data)
+	}
+	return nil
+}
+
+/*
+	sessionHMAC returns the HMAC of a command or a response, keyed
+	with @sessionValue.
+*/
+func sessionHMAC(sessionValue, pHash, nonceNewer, nonceOlder []byte, attrs tpm2.SessionAttributes) []byte {
+	mac := hmac.New(sha256.New, sessionValue)
+	mac.Write(pHash)
+	mac.Write(nonceNewer)
+	mac.Write(nonceOlder)
+	mac.Write([]byte{byte(attrs)})
+	return mac.Sum(nil)
+}
+
+/*
+	commandHash returns the cpHash of the command @cc on the entities
+	named @names, with the encoded @params, as sent.
+*/
+func commandHash(cc tpmutil.Command, names [][]byte, params []byte) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(cc))
+	for _, name := range names {
+		h.Write(name)
+	}
+	h.Write(params)
+	return h.Sum(nil)
+}
+
+/*
+	responseHash returns the rpHash of the successful response
+	to the command @cc, with the encoded @params, as received.
+*/
+func responseHash(cc tpmutil.Command, params []byte) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(tpmutil.RCSuccess))
+	binary.Write(h, binary.BigEndian, uint32(cc))
+	h.Write(params)
+	return h.Sum(nil)
+}
+
+/*
+	run sends the command @cc with @handles, whose names are @names, and
+	the encoded @params, with the session as only session. @authValue is
+	the authorization value of the entity the session authorizes, if any.
+	@attrs tells whether the first command and/or response parameter is
+	encrypted. Returns the response parameters, decrypted.
+	Only commands that don't return handles are supported.
+*/
+func (s *tpmSession) run(rw io.ReadWriter, cc tpmutil.Command, handles []tpmutil.Handle, names [][]byte, authValue []byte, attrs tpm2.SessionAttributes, params []byte) ([]byte, error) {
+	var sessionValue = append(append([]byte{}, s.key...), authValue...)
+	var err error
+
+	nonceCaller, err := randomNonce(SESSION_NONCE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	params = append([]byte{}, params...)
+	if attrs & tpm2.AttrDecrypt != 0 {
+		if err = cryptParameter(params, sessionValue, nonceCaller, s.nonceTPM, false); err != nil {
+			return nil, err
+		}
+	}
+
+	auth, err := tpmutil.Pack(s.handle, tpmutil.U16Bytes(nonceCaller), attrs,
+		tpmutil.U16Bytes(sessionHMAC(sessionValue, commandHash(cc, names, params), nonceCaller, s.nonceTPM, attrs)))
+	if err != nil {
+		return nil, err
+	}
+
+	var in []interface{}
+	for _, h := range handles {
+		in = append(in, h)
+	}
+	in = append(in, tpmutil.U32Bytes(auth), tpmutil.RawBytes(params))
+	resp, rc, err := tpmutil.RunCommand(rw, tpm2.TagSessions, cc, in...)
+	if err != nil {
+		return nil, err
+	}
+	if rc != tpmutil.RCSuccess {
+		return nil, responseError(fmt.Sprintf("TPM command 0x%x", uint32(cc)), rc)
+	}
+
+	var rparams, nonceTPM, rhmac tpmutil.U16Bytes
+	var rattrs tpm2.SessionAttributes
+	buf := bytes.NewBuffer(resp)
+	var paramSize uint32
+	if err = tpmutil.UnpackBuf(buf, &paramSize); err != nil {
+		return nil, err
+	}
+	if int(paramSize) > buf.Len() {
+		return nil, errors.New("Truncated TPM response")
+	}
+	rparams = buf.Next(int(paramSize))
+	if err = tpmutil.UnpackBuf(buf, &nonceTPM, &rattrs, &rhmac); err != nil {
+		return nil, err
+	}
+	s.nonceTPM = nonceTPM
+
+	if !hmac.Equal(rhmac, sessionHMAC(sessionValue, responseHash(cc, rparams), s.nonceTPM, nonceCaller, rattrs)) {
+		return nil, errors.New("Invalid TPM response HMAC, the response may have been tampered with")
+	}
+
+	rparams = append([]byte{}, rparams...)
+	if attrs & tpm2.AttrEcrypt != 0 {
+		if err = cryptParameter(rparams, sessionValue, s.nonceTPM, nonceCaller, true); err != nil {
+			return nil, err
+		}
+	}
+	return rparams, nil
+}
+
+/*
+	policyAuthValue runs TPM2_PolicyAuthValue on the policy session
+	@sessHandle, so that the authorization value of the object is
+	mixed in the session HMAC key. go-tpm doesn't implement it.
+*/
+func policyAuthValue(rw io.ReadWriter, sessHandle tpmutil.Handle) error {
+	_, rc, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, cmdPolicyAuthValue, sessHandle)
+	if err != nil {
+		return err
+	}
+	if rc != tpmutil.RCSuccess {
+		return responseError("TPM2_PolicyAuthValue", rc)
+	}
+	return nil
+}
+
+/*
+	sealWithSession creates a sealed data object holding @data under the
+	SRK, with the @authValue and @authPolicy. The SRK is authorized by
+	the HMAC session @s, which also encrypts the sensitive data.
+*/
+func sealWithSession(rw io.ReadWriter, s *tpmSession, srkName []byte, authValue, authPolicy, data []byte) ([]byte, []byte, error) {
+	public, err := tpm2.Public{
+		Type:       tpm2.AlgKeyedHash,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent,
+		AuthPolicy: authPolicy,
+	}.Encode()
+	if err != nil {
+		return nil, nil, err
+	}
+	sensitive, err := tpmutil.Pack(tpmutil.U16Bytes(authValue), tpmutil.U16Bytes(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	// TPM2B_SENSITIVE_CREATE, TPM2B_PUBLIC, outsideInfo and creationPCR.
+	params, err := tpmutil.Pack(tpmutil.U16Bytes(sensitive), tpmutil.U16Bytes(public), tpmutil.U16Bytes(nil), uint32(0))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.run(rw, tpm2.CmdCreate, []tpmutil.Handle{SRK_HANDLE}, [][]byte{srkName}, nil, tpm2.AttrContinueSession | tpm2.AttrDecrypt, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	var priv, pub tpmutil.U16Bytes
+	if _, err = tpmutil.Unpack(resp, &priv, &pub); err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+/*
+	unsealWithSession unseals the loaded object @keyHandle, named
+	@keyName, with the policy session @s, and gets the data back
+	encrypted.
+*/
+func unsealWithSession(rw io.ReadWriter, s *tpmSession, keyHandle tpmutil.Handle, keyName, authValue []byte) ([]byte, error) {
+	resp, err := s.run(rw, tpm2.CmdUnseal, []tpmutil.Handle{keyHandle}, [][]byte{keyName}, authValue, tpm2.AttrContinueSession | tpm2.AttrEcrypt, nil)
+	if err != nil {
+		return nil, err
+	}
+	var data tpmutil.U16Bytes
+	if _, err = tpmutil.Unpack(resp, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/*
+	getRandomWithSession gets @size random bytes from the TPM, encrypted
+	by the session @s.
+*/
+func getRandomWithSession(rw io.ReadWriter, s *tpmSession, size uint16) ([]byte, error) {
+	params, err := tpmutil.Pack(size)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.run(rw, tpm2.CmdGetRandom, nil, nil, nil, tpm2.AttrContinueSession | tpm2.AttrEcrypt, params)
+	if err != nil {
+		return nil, err
+	}
+	var rbytes tpmutil.U16Bytes
+	if _, err = tpmutil.Unpack(resp, &rbytes); err != nil {
+		return nil, err
+	}
+	return rbytes, nil
+}
@@ -0,0 +1,268 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+/*
+	fakeTPM answers TPM2_GetRandom commands sent in a salted
+	session keyed with @key, as a TPM would.
+*/
+type fakeTPM struct {
+	key      []byte
+	nonceTPM []byte
+	random   []byte
+	tamper   bool
+	resp     bytes.Buffer
+}
+
+func (f *fakeTPM) Write(cmd []byte) (int, error) {
+	var tag tpmutil.Tag
+	var size, cc, authSize, handle uint32
+	var nonceCaller, cmdHMAC tpmutil.U16Bytes
+	var attrs tpm2.SessionAttributes
+	var requested uint16
+
+	buf := bytes.NewBuffer(cmd)
+	if err := tpmutil.UnpackBuf(buf, &tag, &size, &cc, &authSize, &handle, &nonceCaller, &attrs, &cmdHMAC); err != nil {
+		return 0, err
+	}
+	params := buf.Bytes()
+	cpHash := sha256.New()
+	binary.Write(cpHash, binary.BigEndian, cc)
+	cpHash.Write(params)
+	if !hmac.Equal(cmdHMAC, sessionHMAC(f.key, cpHash.Sum(nil), nonceCaller, f.nonceTPM, attrs)) {
+		return 0, errors.New("Invalid command HMAC")
+	}
+	if _, err := tpmutil.Unpack(params, &requested); err != nil {
+		return 0, err
+	}
+
+	f.nonceTPM = bytes.Repeat([]byte{0x42}, SESSION_NONCE_SIZE)
+	rparams, _ := tpmutil.Pack(tpmutil.U16Bytes(f.random[:requested]))
+	if err := cryptParameter(rparams, f.key, f.nonceTPM, nonceCaller, false); err != nil {
+		return 0, err
+	}
+	rpHash := sha256.New()
+	binary.Write(rpHash, binary.BigEndian, uint32(0))
+	binary.Write(rpHash, binary.BigEndian, cc)
+	rpHash.Write(rparams)
+	rhmac := sessionHMAC(f.key, rpHash.Sum(nil), f.nonceTPM, nonceCaller, attrs)
+	if f.tamper {
+		rparams[2] ^= 1
+	}
+	body, _ := tpmutil.Pack(tpmutil.U32Bytes(rparams), tpmutil.U16Bytes(f.nonceTPM), attrs, tpmutil.U16Bytes(rhmac))
+	resp, _ := tpmutil.Pack(tpm2.TagSessions, uint32(10 + len(body)), tpmutil.RCSuccess, tpmutil.RawBytes(body))
+	f.resp.Write(resp)
+	return len(cmd), nil
+}
+
+func (f *fakeTPM) Read(p []byte) (int, error) {
+	return f.resp.Read(p)
+}
+
+func TestSessionGetRandom(t *testing.T) {
+	var key = bytes.Repeat([]byte{1}, sha256.Size)
+	var nonce = bytes.Repeat([]byte{2}, SESSION_NONCE_SIZE)
+	var random = []byte("0123456789abcdef0123456789abcdef")
+
+	tpm := &fakeTPM{key: key, nonceTPM: nonce, random: random}
+	s := &tpmSession{handle: 0x02000000, key: key, nonceTPM: nonce}
+	rbytes, err := getRandomWithSession(tpm, s, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rbytes, random) {
+		t.Errorf("Expected: %x, got: %x", random, rbytes)
+	}
+	if !bytes.Equal(s.nonceTPM, tpm.nonceTPM) {
+		t.Errorf("The session nonce wasn't updated")
+	}
+
+	tpm.tamper = true
+	if _, err = getRandomWithSession(tpm, s, 32); err == nil {
+		t.Errorf("A tampered response must be rejected")
+	}
+}
+
+func TestCryptParameter(t *testing.T) {
+	var key = []byte("session key")
+	var clear = []byte{0, 4, 'd', 'a', 't', 'a', 0xff}
+	var params = append([]byte{}, clear...)
+
+	if err := cryptParameter(params, key, []byte("newer"), []byte("older"), false); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(params[2:6], clear[2:6]) || !bytes.Equal(params[:2], clear[:2]) || params[6] != 0xff {
+		t.Fatalf("Only the parameter data must be encrypted: %x", params)
+	}
+	if err := cryptParameter(params, key, []byte("newer"), []byte("older"), true); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(params, clear) {
+		t.Errorf("Expected: %x, got: %x", clear, params)
+	}
+	if err := cryptParameter([]byte{0, 8, 1}, key, nil, nil, false); err == nil {
+		t.Errorf("A truncated parameter must be rejected")
+	}
+}
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+/*
+	TestSessionKnownAnswers checks the session computations against
+	values computed from the TPM2 Library, Part 1 definitions with
+	another implementation (Python hmac and hashlib, OpenSSL AES-128-CFB),
+	whose KDFa gives the expected result on the go-tpm KDFa vectors.
+*/
+func TestSessionKnownAnswers(t *testing.T) {
+	var salt = make([]byte, 32)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	var nonceTPM = bytes.Repeat([]byte{0x42}, SESSION_NONCE_SIZE)
+	var nonceCaller = bytes.Repeat([]byte{0x17}, SESSION_NONCE_SIZE)
+	var data = []byte("ultrablue enrollment key")
+
+	// Section 19.6.8: KDFa(sessionAlg, salt, "ATH", nonceTPM, nonceCaller, bits)
+	key, err := sessionKey(salt, nonceTPM, nonceCaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := unhex(t, "a7aeb310a79608e7ed0469a6ca2548d453468fbcc5f1ca4d93ace6510a38b1f5"); !bytes.Equal(key, expected) {
+		t.Fatalf("Session key: expected %x, got %x", expected, key)
+	}
+	var sessionValue = append(append([]byte{}, key...), "1234"...)
+
+	// Section 21.3: the command parameters are encrypted with nonceCaller
+	// as nonceNewer, and the response ones with nonceTPM.
+	var cases = []struct {
+		newer, older []byte
+		expected     string
+		name         string
+	}{
+		{nonceCaller, nonceTPM, "c9258cf3b94ad43a8cf5c7f6dd04405804fb91edac9cd5a6", "Command parameter"},
+		{nonceTPM, nonceCaller, "c343287ac4473fcddcb07bf33464b972211279487d303555", "Response parameter"},
+	}
+	for _, c := range cases {
+		params := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+		params = append(params, data...)
+		if err = cryptParameter(params, sessionValue, c.newer, c.older, false); err != nil {
+			t.Fatal(err)
+		}
+		if expected := unhex(t, c.expected); !bytes.Equal(params[2:], expected) {
+			t.Errorf("%s: expected %x, got %x", c.name, expected, params[2:])
+		}
+	}
+
+	// Sections 18.7 and 19.6.5: TPM2_Create on an object named
+	// with SHA256, continuing an HMAC session that decrypts.
+	var params = []byte{0, 4, 'd', 'a', 't', 'a'}
+	objectName := sha256.Sum256([]byte("sealed object"))
+	name := append([]byte{0x00, 0x0b}, objectName[:]...)
+	cpHash := commandHash(tpm2.CmdCreate, [][]byte{name}, params)
+	if expected := unhex(t, "fb1b5af6ee702348b89a27ae0a235a9628cc8a50e04a01b4fab93534f0f9cd22"); !bytes.Equal(cpHash, expected) {
+		t.Errorf("cpHash: expected %x, got %x", expected, cpHash)
+	}
+	mac := sessionHMAC(sessionValue, cpHash, nonceCaller, nonceTPM, tpm2.AttrContinueSession | tpm2.AttrDecrypt)
+	if expected := unhex(t, "ba5e9bfcfd143130eaedba3fe8cc7d6285a73304ddabb51dedd47cb99cd53970"); !bytes.Equal(mac, expected) {
+		t.Errorf("Command HMAC: expected %x, got %x", expected, mac)
+	}
+
+	// TPM2_Unseal response, with the response parameter encrypted
+	rpHash := responseHash(tpm2.CmdUnseal, params)
+	if expected := unhex(t, "7cd74b371523d0a08b933926a248383ef30b05c71ff84d281a9ede6fbf3e75ed"); !bytes.Equal(rpHash, expected) {
+		t.Errorf("rpHash: expected %x, got %x", expected, rpHash)
+	}
+	mac = sessionHMAC(sessionValue, rpHash, nonceTPM, nonceCaller, tpm2.AttrContinueSession | tpm2.AttrEcrypt)
+	if expected := unhex(t, "2477b256e855c709dbd7ef1378dd4f3176c29069dc969fa44593e0009ef6195e"); !bytes.Equal(mac, expected) {
+		t.Errorf("Response HMAC: expected %x, got %x", expected, mac)
+	}
+}
+
+/*
+	publicTPM answers TPM2_ReadPublic commands with
+	the public area @public and the name @name.
+*/
+type publicTPM struct {
+	public []byte
+	name   []byte
+	resp   bytes.Buffer
+}
+
+func (p *publicTPM) Write(cmd []byte) (int, error) {
+	body, _ := tpmutil.Pack(tpmutil.U16Bytes(p.public), tpmutil.U16Bytes(p.name), tpmutil.U16Bytes(p.name))
+	resp, _ := tpmutil.Pack(tpm2.TagNoSessions, uint32(10 + len(body)), tpmutil.RCSuccess, tpmutil.RawBytes(body))
+	p.resp.Write(resp)
+	return len(cmd), nil
+}
+
+func (p *publicTPM) Read(b []byte) (int, error) {
+	return p.resp.Read(b)
+}
+
+func TestSRKPublicKey(t *testing.T) {
+	var encode = func(key *rsa.PrivateKey) ([]byte, []byte) {
+		var template = SRK_TEMPLATE
+		var params = *template.RSAParameters
+		params.ModulusRaw = key.N.Bytes()
+		template.RSAParameters = &params
+		public, err := template.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(public)
+		return public, append([]byte{0x00, 0x0b}, digest[:]...)
+	}
+	srk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, name := encode(srk)
+	otherPublic, otherName := encode(other)
+
+	var cases = []struct {
+		public, name, pinned []byte
+		valid                bool
+		desc                 string
+	}{
+		{public, name, name, true, "Pinned SRK"},
+		{public, name, nil, true, "Unpinned SRK"},
+		{otherPublic, otherName, name, false, "Other SRK"},
+		{otherPublic, name, name, false, "Other SRK with the pinned name"},
+	}
+	for _, c := range cases {
+		pub, computed, err := srkPublicKey(&publicTPM{public: c.public, name: c.name}, c.pinned)
+		if (err == nil) != c.valid {
+			t.Errorf("[%s]: expected valid: %t, got error: %v", c.desc, c.valid, err)
+			continue
+		}
+		if c.valid && (pub.N.Cmp(srk.N) != 0 || !bytes.Equal(computed, name)) {
+			t.Errorf("[%s]: unexpected SRK %x named %x", c.desc, pub.N.Bytes(), computed)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// SPDX-FileCopyrightText: 2023 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePCRs(t *testing.T) {
+	var cases = []struct {
+		list     string
+		expected []int
+		valid    bool
+		name     string
+	}{
+		{"", nil, true, "Empty list"},
+		{"7", []int{7}, true, "Single PCR"},
+		{"7, 0,2", []int{0, 2, 7}, true, "Unsorted list with spaces"},
+		{"9", nil, false, "Ultrablue extended PCR"},
+		{"24", nil, false, "Out of range PCR"},
+		{"-1", nil, false, "Negative PCR"},
+		{"0,,7", nil, false, "Empty field"},
+		{"seven", nil, false, "Not a number"},
+	}
+
+	for _, c := range cases {
+		pcrs, err := ParsePCRs(c.list)
+		if (err == nil) != c.valid {
+			t.Errorf("[%s]: expected valid: %t, got error: %v", c.name, c.valid, err)
+			continue
+		}
+		if c.valid && !reflect.DeepEqual(pcrs, c.expected) {
+			t.Errorf("[%s]: expected: %v, got: %v", c.name, c.expected, pcrs)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// SPDX-FileCopyrightText: 2022 ANSSI
+// SPDX-License-Identifier: Apache-2.0
+
+package ultrablue
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+	readPIN asks the configured ReadPIN callback for a PIN
+	if @needed, and returns nil otherwise.
+*/
+func (a *attester) readPIN(prompt string, needed bool) ([]byte, error) {
+	if !needed {
+		return nil, nil
+	}
+	if a.cfg.ReadPIN == nil {
+		return nil, errors.New("A PIN is required, but there is no way to read it")
+	}
+	var pin []byte
+	var err error
+	a.watchdog.waitUser(func() {
+		pin, err = a.cfg.ReadPIN(prompt)
+	})
+	return pin, err
+}
+
+/*
+	writeKeyFile creates the file @name in the keys directory
+	and writes @data in it. If the file already exists, an
+	error is returned.
+*/
+func (a *attester) writeKeyFile(name string, data []byte) error {
+	f, err := os.OpenFile(filepath.Join(a.cfg.KeysPath, name), os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+/*
+	Seals the given key with the TPM Storage Root Key
+	and stores it under two files named after the given
+	uuid, along with a third one describing the policy
+	the key is sealed with. If those files already exists,
+	an error is returned.
+*/
+func (a *attester) storeKey(uuid string, key []byte) error {
+	var priv, pub, encoded []byte
+	var pin []byte
+	var err error
+	var policy = SealPolicy{
+		PIN:  a.cfg.WithPIN,
+		PCRs: a.cfg.SealPCRs,
+	}
+
+	if a.cfg.SealAuthorize && a.cfg.AuthorizeKey == nil {
+		return errors.New("Sealing to authorized PCR policies requires the authorize key")
+	}
+	if err = os.MkdirAll(a.cfg.KeysPath, os.ModeDir); err != nil {
+		return err
+	}
+	if a.cfg.SealAuthorize {
+		if policy.AuthorizeKey, err = a.authorizeCurrentPCRs(); err != nil {
+			return err
+		}
+		policy.PCRs = nil
+	}
+	if pin, err = a.readPIN("Choose a PIN to seal the encryption key on disk:", policy.PIN); err != nil {
+		return err
+	}
+	if priv, pub, err = TPM2_Seal(key, string(pin), &policy); err != nil {
+		return err
+	}
+	if encoded, err = json.Marshal(policy); err != nil {
+		return err
+	}
+	if err = a.writeKeyFile(uuid, priv); err != nil {
+		return err
+	}
+	if err = a.writeKeyFile(uuid + ".pub", pub); err != nil {
+		return err
+	}
+	if err = a.writeKeyFile(uuid + ".policy", encoded); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+	authorizeCurrentPCRs signs the current values of the SealPCRs
+	with the configured authorize key, which is never stored.
+	Returns the DER encoded public authorize key.
+*/
+func (a *attester) authorizeCurrentPCRs() ([]byte, error) {
+	var key = a.cfg.AuthorizeKey
+
+	values, err := ReadPCRs(a.cfg.SealPCRs)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := AuthorizePCRs(key, a.cfg.SealPCRs, values)
+	if err != nil {
+		return nil, err
+	}
+	if err = StoreAuthorization(filepath.Join(a.cfg.KeysPath, AUTHORIZATIONS_FILE), auth); err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(&key.PublicKey)
+}
+
+/*
+	loadPolicy returns the policy the key of the verifier @uuid is
+	sealed with. Keys stored by older versions have no policy file:
+	they are sealed to the SRK, and to a PIN if WithPIN is set.
+*/
+func (a *attester) loadPolicy(uuid string) (SealPolicy, error) {
+	var policy SealPolicy
+
+	encoded, err := os.ReadFile(filepath.Join(a.cfg.KeysPath, uuid + ".policy"))
+	if errors.Is(err, os.ErrNotExist) {
+		return SealPolicy{PIN: a.cfg.WithPIN}, nil
+	}
+	if err != nil {
+		return policy, err
+	}
+	err = json.Unmarshal(encoded, &policy)
+	return policy, err
+}
+
+/*
+	Gets the sealed key from the ultrablue keys directory
+	and tries to unseal it with the TPM Storage Root Key.
+	When the key is sealed with a PIN, a wrong one is asked
+	for again, up to PINRetries times, but never beyond the
+	number of failures the TPM allows before locking out.
+	Returns the unsealed key on success
+*/
+func (a *attester) loadKey(uuid string) ([]byte, error) {
+	var priv, pub, key []byte
+	var pin []byte
+	var policy SealPolicy
+	var auths []Authorization
+	var err error
+
+	if policy, err = a.loadPolicy(uuid); err != nil {
+		return nil, err
+	}
+	if policy.SRKName == nil {
+		logrus.Warn("The SRK the key of ", uuid, " is sealed under isn't recorded, enroll again to check it")
+	}
+	if policy.AuthorizeKey != nil {
+		if auths, err = LoadAuthorizations(filepath.Join(a.cfg.KeysPath, AUTHORIZATIONS_FILE)); err != nil {
+			return nil, err
+		}
+	}
+	if priv, err = os.ReadFile(filepath.Join(a.cfg.KeysPath, uuid)); err != nil {
+		return nil, err
+	}
+	if pub, err = os.ReadFile(filepath.Join(a.cfg.KeysPath, uuid + ".pub")); err != nil {
+		return nil, err
+	}
+
+	var retries = a.cfg.PINRetries
+	if retries <= 0 {
+		retries = DEFAULT_PIN_RETRIES
+	}
+	var prompt = "Please enter the PIN used to seal the encryption key:"
+	for attempt := 1; ; attempt++ {
+		left := retries - attempt + 1
+		if policy.PIN {
+			da, err := ReadDAState()
+			if err != nil {
+				logrus.Warn("Failed to read the TPM dictionary attack counter: ", err)
+			} else if err = da.Err(); err != nil {
+				return nil, err
+			} else {
+				logrus.Info("The TPM allows ", da.Remaining(), " wrong PINs before locking out")
+				if int(da.Remaining()) < left {
+					left = int(da.Remaining())
+				}
+			}
+		}
+		if attempt > 1 {
+			prompt = fmt.Sprintf("Wrong PIN, please try again (%d attempts left):", left)
+		} else if left < retries {
+			prompt = fmt.Sprintf("Please enter the PIN used to seal the encryption key (%d attempts left before the TPM locks out):", left)
+		}
+		if pin, err = a.readPIN(prompt, policy.PIN); err != nil {
+			return nil, err
+		}
+		a.watchdog.progress()
+		key, err = TPM2_Unseal(priv, pub, string(pin), policy, auths)
+		a.watchdog.progress()
+		if err == nil {
+			return key, nil
+		}
+		if isLockout(err) {
+			da, _ := ReadDAState()
+			return nil, lockoutError(da)
+		}
+		if !policy.PIN || !isAuthFailure(err) {
+			return nil, err
+		}
+		logrus.Warn("Wrong PIN for the encryption key of ", uuid)
+		if left <= 1 {
+			return nil, errors.New("Wrong PIN")
+		}
+	}
+}
+
+/*
+	Returns true if the data only contains zeros, false otherwise
+*/
+func onlyContainsZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}